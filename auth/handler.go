@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+// KeysHandler serves the rotation API for the keyset in Store. Every step
+// responds with the resulting keys as described by Describe, secrets are
+// never returned. Services maps a service name to the store its keys are
+// deployed from, for the report.
+type KeysHandler struct {
+	Store    KeyStore
+	Rotator  *Rotator
+	Services map[string]KeyStore
+
+	mu sync.Mutex
+}
+
+func NewKeysHandler(store KeyStore, rotator *Rotator) *KeysHandler {
+	return &KeysHandler{Store: store, Rotator: rotator, Services: map[string]KeyStore{}}
+}
+
+// Routes mounts the API behind auth, defaulting to middleware.ValidateHmac.
+func (h *KeysHandler) Routes(auth func(next http.Handler) http.Handler) chi.Router {
+	if auth == nil {
+		auth = kit_middleware.ValidateHmac
+	}
+	r := chi.NewRouter()
+	r.Use(auth)
+	r.Get("/", h.ListKeys)
+	r.Post("/", h.step("added", func(keys *models.HmacKeys, r *http.Request) error {
+		_, err := h.Rotator.Add(keys)
+		return err
+	}))
+	r.Post("/rotate", h.step("rotated", func(keys *models.HmacKeys, r *http.Request) error {
+		_, err := h.Rotator.Rotate(keys)
+		return err
+	}))
+	r.Post("/prune", h.step("pruned", func(keys *models.HmacKeys, r *http.Request) error {
+		h.Rotator.Prune(keys)
+		return nil
+	}))
+	r.Post("/{id}/promote", h.step("promoted", func(keys *models.HmacKeys, r *http.Request) error {
+		return h.Rotator.Promote(keys, chi.URLParam(r, "id"))
+	}))
+	r.Post("/{id}/retire", h.step("retired", func(keys *models.HmacKeys, r *http.Request) error {
+		return h.Rotator.Retire(keys, chi.URLParam(r, "id"))
+	}))
+	r.Get("/report", h.Report)
+	return r
+}
+
+func (h *KeysHandler) ListKeys(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	keys, err := h.Store.Load(r.Context())
+	if err != nil {
+		logger.Error("error loading hmac keys: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+		return
+	}
+	render.JSON(rw, r, Describe(keys))
+}
+
+func (h *KeysHandler) Report(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	current, err := h.Store.Load(r.Context())
+	if err != nil {
+		logger.Error("error loading hmac keys: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+		return
+	}
+	services := make(map[string]*models.HmacKeys, len(h.Services))
+	for name, store := range h.Services {
+		keys, err := store.Load(r.Context())
+		if err != nil {
+			logger.Error("error loading hmac keys of ", name, ": ", err)
+			keys = &models.HmacKeys{}
+		}
+		services[name] = keys
+	}
+	render.JSON(rw, r, Report(current, services))
+}
+
+// step loads the keyset, applies update and saves it, one step at a time.
+func (h *KeysHandler) step(event string, update func(*models.HmacKeys, *http.Request) error) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		logger := kit_logger.GetLogEntry(r)
+		reqId := middleware.GetReqID(r.Context())
+
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		keys, err := h.Store.Load(r.Context())
+		if err != nil {
+			logger.Error("error loading hmac keys: ", err)
+			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+			return
+		}
+		if err := update(keys, r); err != nil {
+			status := http.StatusConflict
+			if err == ErrKeyNotFound {
+				status = http.StatusNotFound
+			}
+			logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, status, err.Error())))
+			return
+		}
+		if err := h.Store.Save(r.Context(), keys); err != nil {
+			logger.Error("error saving hmac keys: ", err)
+			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+			return
+		}
+		logger.Info("hmac keys ", event)
+		render.JSON(rw, r, Describe(keys))
+	}
+}
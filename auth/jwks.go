@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+)
+
+// Signature algorithms, named as in JWA.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgES256 = "ES256"
+	AlgES384 = "ES384"
+)
+
+var ErrUnknownPublicKey = errors.New("unknown public key id")
+
+type PublicKey struct {
+	ID  string
+	Alg string
+	Key crypto.PublicKey
+}
+
+// KeyLookup finds the public key a request was signed with.
+type KeyLookup interface {
+	PublicKey(ctx context.Context, id string) (*PublicKey, error)
+}
+
+// PublicKeySet is a fixed set of public keys, serialized as a JWKS.
+type PublicKeySet struct {
+	Keys map[string]*PublicKey
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use,omitempty"`
+	X   string `json:"x"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+func NewPublicKeySet(keys ...*PublicKey) *PublicKeySet {
+	set := &PublicKeySet{Keys: make(map[string]*PublicKey)}
+	for _, k := range keys {
+		set.Keys[k.ID] = k
+	}
+	return set
+}
+
+func (s *PublicKeySet) PublicKey(ctx context.Context, id string) (*PublicKey, error) {
+	k, ok := s.Keys[id]
+	if !ok {
+		return nil, ErrUnknownPublicKey
+	}
+	return k, nil
+}
+
+// ParseJWKS reads a JWKS of Ed25519 (OKP) and P-256/P-384 (EC) keys. Keys of
+// other types are skipped.
+func ParseJWKS(b []byte) (*PublicKeySet, error) {
+	var doc jwks
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("error decoding jwks: %v", err)
+	}
+	set := NewPublicKeySet()
+	for _, k := range doc.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("skipping jwk %s: %v", k.Kid, err)
+			continue
+		}
+		set.Keys[pub.ID] = pub
+	}
+	return set, nil
+}
+
+func (s *PublicKeySet) MarshalJSON() ([]byte, error) {
+	doc := jwks{Keys: []jwk{}}
+	for _, k := range s.Keys {
+		j, err := toJWK(k)
+		if err != nil {
+			return nil, err
+		}
+		doc.Keys = append(doc.Keys, j)
+	}
+	return json.Marshal(doc)
+}
+
+func LoadPublicKeys(path string) (*PublicKeySet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(b)
+}
+
+// JWKSHandler serves the set, e.g. by the gateway at /.well-known/jwks.json.
+func JWKSHandler(set *PublicKeySet) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		render.JSON(rw, r, set)
+	}
+}
+
+// RemoteKeySet fetches a JWKS from URL and caches it for TTL. An unknown key
+// id triggers a refetch, at most once per MinRefresh, so new keys are picked
+// up without waiting for the TTL. Concurrent callers share a single fetch,
+// which runs detached from their requests, bounded by the client's timeout.
+type RemoteKeySet struct {
+	URL        string
+	Client     *http.Client
+	TTL        time.Duration
+	MinRefresh time.Duration
+
+	mu       sync.Mutex
+	set      *PublicKeySet
+	fetched  time.Time
+	inflight *keyFetch
+}
+
+type keyFetch struct {
+	done chan struct{}
+	err  error
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		URL:        url,
+		Client:     httpclient.Default(),
+		TTL:        10 * time.Minute,
+		MinRefresh: 30 * time.Second,
+	}
+}
+
+func (s *RemoteKeySet) PublicKey(ctx context.Context, id string) (*PublicKey, error) {
+	set, fetched := s.current()
+	if set == nil || time.Since(fetched) > s.TTL {
+		if err := s.refresh(ctx); err != nil && set == nil {
+			return nil, err
+		}
+		set, fetched = s.current()
+	}
+	k, err := set.PublicKey(ctx, id)
+	if err == ErrUnknownPublicKey && time.Since(fetched) > s.MinRefresh {
+		if err := s.refresh(ctx); err != nil {
+			return nil, err
+		}
+		set, _ = s.current()
+		return set.PublicKey(ctx, id)
+	}
+	return k, err
+}
+
+func (s *RemoteKeySet) current() (*PublicKeySet, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.set, s.fetched
+}
+
+// refresh fetches the set, or waits for the fetch already in flight.
+func (s *RemoteKeySet) refresh(ctx context.Context) error {
+	s.mu.Lock()
+	f := s.inflight
+	if f == nil {
+		f = &keyFetch{done: make(chan struct{})}
+		s.inflight = f
+		go s.run(f)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *RemoteKeySet) run(f *keyFetch) {
+	set, err := s.fetch(context.Background())
+
+	s.mu.Lock()
+	if err == nil {
+		s.set = set
+		s.fetched = time.Now()
+	}
+	s.inflight = nil
+	s.mu.Unlock()
+
+	f.err = err
+	close(f.done)
+}
+
+func (s *RemoteKeySet) fetch(ctx context.Context) (*PublicKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := httpclient.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("error decoding jwks: %v", err)
+	}
+	return ParseJWKS(raw)
+}
+
+func (k jwk) publicKey() (*PublicKey, error) {
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case k.Kty == "OKP" && k.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 key size")
+		}
+		return &PublicKey{ID: k.Kid, Alg: AlgEdDSA, Key: ed25519.PublicKey(x)}, nil
+	case k.Kty == "EC":
+		curve, alg := curveAlg(k.Crv)
+		if curve == nil {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &PublicKey{ID: k.Kid, Alg: alg, Key: pub}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s %s", k.Kty, k.Crv)
+}
+
+func toJWK(k *PublicKey) (jwk, error) {
+	switch pub := k.Key.(type) {
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Crv: "Ed25519", Kid: k.ID, Alg: AlgEdDSA, Use: "sig", X: base64.RawURLEncoding.EncodeToString(pub)}, nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return jwk{
+			Kty: "EC",
+			Crv: pub.Curve.Params().Name,
+			Kid: k.ID,
+			Alg: k.Alg,
+			Use: "sig",
+			X:   base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, size))),
+		}, nil
+	}
+	return jwk{}, fmt.Errorf("unsupported public key type %T", k.Key)
+}
+
+func curveAlg(crv string) (elliptic.Curve, string) {
+	switch crv {
+	case "P-256":
+		return elliptic.P256(), AlgES256
+	case "P-384":
+		return elliptic.P384(), AlgES384
+	}
+	return nil, ""
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrOverlapPending = errors.New("key is still in its overlap period")
+	ErrLastSigningKey = errors.New("can't retire the only signing key")
+)
+
+// Rotator moves HMAC keys through their lifecycle: a new key is added as
+// verify-only, promoted to signing once it is at least Overlap old, and the
+// key it replaces stays accepted for another Overlap before it expires.
+// Every step edits the keyset in place.
+type Rotator struct {
+	Overlap time.Duration
+	// random bytes per key, defaults to 32.
+	KeySize int
+	Now     func() time.Time
+}
+
+func NewRotator(overlap time.Duration) *Rotator {
+	return &Rotator{Overlap: overlap, KeySize: 32, Now: time.Now}
+}
+
+// GenerateKey returns a new verify-only key with a random id and value.
+func (rt *Rotator) GenerateKey() (models.Key, error) {
+	size := rt.KeySize
+	if size <= 0 {
+		size = 32
+	}
+	value := make([]byte, size)
+	if _, err := rand.Read(value); err != nil {
+		return models.Key{}, fmt.Errorf("error generating key: %v", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return models.Key{}, fmt.Errorf("error generating key id: %v", err)
+	}
+	now := rt.now()
+	return models.Key{
+		ID:        hex.EncodeToString(id),
+		Created:   now,
+		NotBefore: now,
+		Status:    models.KeyVerify,
+		Value:     base64.StdEncoding.EncodeToString(value),
+	}, nil
+}
+
+// Add generates a verify-only key and adds it to keys.
+func (rt *Rotator) Add(keys *models.HmacKeys) (models.Key, error) {
+	key, err := rt.GenerateKey()
+	if err != nil {
+		return models.Key{}, err
+	}
+	keys.Keys = append(keys.Keys, key)
+	return key, nil
+}
+
+// Promote makes key id the signing key. The key must have been verify-only
+// for at least Overlap so every service had time to pick it up. Previous
+// signing keys become verify-only and expire after Overlap.
+func (rt *Rotator) Promote(keys *models.HmacKeys, id string) error {
+	key := findKey(keys, id)
+	if key == nil {
+		return ErrKeyNotFound
+	}
+	if key.Status == models.KeyRetired {
+		return fmt.Errorf("key %s is retired", id)
+	}
+	now := rt.now()
+	if now.Sub(key.Created) < rt.Overlap {
+		return ErrOverlapPending
+	}
+	for i := range keys.Keys {
+		k := &keys.Keys[i]
+		if k.ID == id || !k.CanSign() {
+			continue
+		}
+		k.Status = models.KeyVerify
+		if k.NotAfter.IsZero() || k.NotAfter.After(now.Add(rt.Overlap)) {
+			k.NotAfter = now.Add(rt.Overlap)
+		}
+	}
+	key.Status = models.KeySigning
+	key.NotAfter = time.Time{}
+	return nil
+}
+
+// Retire stops accepting key id right away.
+func (rt *Rotator) Retire(keys *models.HmacKeys, id string) error {
+	key := findKey(keys, id)
+	if key == nil {
+		return ErrKeyNotFound
+	}
+	now := rt.now()
+	if key.CanSign() && key.ValidAt(now) && countSigning(keys, now) == 1 {
+		return ErrLastSigningKey
+	}
+	key.Status = models.KeyRetired
+	key.NotAfter = now
+	return nil
+}
+
+// Prune removes retired and expired keys, returning their ids.
+func (rt *Rotator) Prune(keys *models.HmacKeys) []string {
+	now := rt.now()
+	var pruned []string
+	var kept []models.Key
+	for _, k := range keys.Keys {
+		if k.Status == models.KeyRetired || (!k.NotAfter.IsZero() && !now.Before(k.NotAfter)) {
+			pruned = append(pruned, k.ID)
+			continue
+		}
+		kept = append(kept, k)
+	}
+	keys.Keys = kept
+	return pruned
+}
+
+// Rotate does the next due step: promote the newest pending verify-only key
+// once its overlap passed, or add one if none is pending. Expired keys are
+// pruned either way.
+func (rt *Rotator) Rotate(keys *models.HmacKeys) (string, error) {
+	rt.Prune(keys)
+	if pending := newestPending(keys); pending != nil {
+		id := pending.ID
+		if err := rt.Promote(keys, id); err != nil {
+			return "", err
+		}
+		return "promoted " + id, nil
+	}
+	key, err := rt.Add(keys)
+	if err != nil {
+		return "", err
+	}
+	return "added " + key.ID, nil
+}
+
+func (rt *Rotator) now() time.Time {
+	if rt.Now != nil {
+		return rt.Now()
+	}
+	return time.Now()
+}
+
+func findKey(keys *models.HmacKeys, id string) *models.Key {
+	for i := range keys.Keys {
+		if keys.Keys[i].ID == id {
+			return &keys.Keys[i]
+		}
+	}
+	return nil
+}
+
+func countSigning(keys *models.HmacKeys, now time.Time) int {
+	n := 0
+	for i := range keys.Keys {
+		if keys.Keys[i].CanSign() && keys.Keys[i].ValidAt(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// newestPending is the latest verify-only key that never signed, i.e. has
+// no expiry set by a promotion.
+func newestPending(keys *models.HmacKeys) *models.Key {
+	var pending *models.Key
+	for i := range keys.Keys {
+		k := &keys.Keys[i]
+		if k.Status != models.KeyVerify || !k.NotAfter.IsZero() {
+			continue
+		}
+		if pending == nil || k.Created.After(pending.Created) {
+			pending = k
+		}
+	}
+	return pending
+}
+
+// KeyInfo describes a key without its value.
+type KeyInfo struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Created   time.Time `json:"created"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Accepted  bool      `json:"accepted"`
+	Signing   bool      `json:"signing"`
+}
+
+func Describe(keys *models.HmacKeys) []KeyInfo {
+	now := time.Now()
+	latest, _ := keys.LatestKey()
+	infos := make([]KeyInfo, 0, len(keys.Keys))
+	for _, k := range keys.Keys {
+		status := k.Status
+		if status == "" {
+			status = models.KeySigning
+		}
+		infos = append(infos, KeyInfo{
+			ID:        k.ID,
+			Status:    status,
+			Created:   k.Created,
+			NotBefore: k.NotBefore,
+			NotAfter:  k.NotAfter,
+			Accepted:  k.ValidAt(now),
+			Signing:   k.Value == latest.Value,
+		})
+	}
+	return infos
+}
+
+// ServiceReport lists the keys a service accepts and which accepted keys of
+// the rotated keyset it is missing.
+type ServiceReport struct {
+	Service  string   `json:"service"`
+	Accepts  []string `json:"accepts"`
+	Signing  string   `json:"signing"`
+	Missing  []string `json:"missing,omitempty"`
+	UpToDate bool     `json:"up_to_date"`
+}
+
+// Report compares the keyset of each service against the rotated one. Keys
+// are matched by value, so keysets from before key ids are reported too.
+func Report(current *models.HmacKeys, services map[string]*models.HmacKeys) []ServiceReport {
+	now := time.Now()
+	var reports []ServiceReport
+	for name, keys := range services {
+		accepted := map[string]bool{}
+		report := ServiceReport{Service: name}
+		for _, k := range keys.Keys {
+			if k.ValidAt(now) {
+				accepted[k.Value] = true
+				report.Accepts = append(report.Accepts, k.ID)
+			}
+		}
+		if latest, err := keys.LatestKey(); err == nil {
+			report.Signing = latest.ID
+		}
+		for _, k := range current.Keys {
+			if k.ValidAt(now) && !accepted[k.Value] {
+				report.Missing = append(report.Missing, k.ID)
+			}
+		}
+		report.UpToDate = len(report.Missing) == 0
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Service < reports[j].Service })
+	return reports
+}
@@ -0,0 +1,95 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/auth"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Rotation Tests", func() {
+
+	var now time.Time
+	var rotator *auth.Rotator
+	var keys *models.HmacKeys
+
+	BeforeEach(func() {
+		now = time.Now()
+		rotator = auth.NewRotator(time.Hour)
+		rotator.Now = func() time.Time { return now }
+		keys = &models.HmacKeys{Keys: []models.Key{
+			{ID: "old", Created: now.Add(-48 * time.Hour), Value: "old"},
+		}}
+	})
+
+	It("should add a verify-only key and promote it after the overlap", func() {
+		step, err := rotator.Rotate(keys)
+		Expect(err).To(BeNil())
+		Expect(step).To(HavePrefix("added"))
+		Expect(keys.GetLatestKey()).To(Equal("old"))
+
+		_, err = rotator.Rotate(keys)
+		Expect(err).To(Equal(auth.ErrOverlapPending))
+
+		now = now.Add(time.Hour)
+		step, err = rotator.Rotate(keys)
+		Expect(err).To(BeNil())
+		Expect(step).To(HavePrefix("promoted"))
+		Expect(keys.GetLatestKey()).To(Equal(keys.Keys[1].Value))
+
+		// the old key is accepted until the overlap passed.
+		Expect(keys.Keys[0].Status).To(Equal(models.KeyVerify))
+		Expect(keys.Keys[0].NotAfter).To(Equal(now.Add(time.Hour)))
+
+		now = now.Add(time.Hour)
+		Expect(rotator.Prune(keys)).To(Equal([]string{"old"}))
+		Expect(keys.Keys).To(HaveLen(1))
+	})
+
+	It("should not retire the only signing key", func() {
+		Expect(rotator.Retire(keys, "old")).To(Equal(auth.ErrLastSigningKey))
+		Expect(rotator.Retire(keys, "missing")).To(Equal(auth.ErrKeyNotFound))
+	})
+
+	It("should report services missing accepted keys", func() {
+		stale := &models.HmacKeys{Keys: append([]models.Key(nil), keys.Keys...)}
+		rotator.Add(keys)
+		reports := auth.Report(keys, map[string]*models.HmacKeys{"stale": stale, "current": keys})
+		Expect(reports).To(HaveLen(2))
+		Expect(reports[0].UpToDate).To(BeTrue())
+		Expect(reports[1].Service).To(Equal("stale"))
+		Expect(reports[1].Missing).To(Equal([]string{keys.Keys[1].ID}))
+	})
+
+	It("should not return secrets from the rotation api", func() {
+		dir, err := os.MkdirTemp("", "keys")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+		store := &auth.FileStore{Path: filepath.Join(dir, "keys.json")}
+		Expect(store.Save(context.Background(), keys)).To(Succeed())
+
+		noAuth := func(next http.Handler) http.Handler { return next }
+		h := auth.NewKeysHandler(store, rotator).Routes(noAuth)
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("POST", "/rotate", nil))
+		Expect(rw.Code).To(Equal(200))
+
+		saved, err := store.Load(context.Background())
+		Expect(err).To(BeNil())
+		Expect(saved.Keys).To(HaveLen(2))
+		var infos []auth.KeyInfo
+		Expect(json.Unmarshal(rw.Body.Bytes(), &infos)).To(Succeed())
+		Expect(infos).To(HaveLen(2))
+		Expect(infos[1].ID).To(Equal(saved.Keys[1].ID))
+		Expect(rw.Body.String()).NotTo(ContainSubstring(saved.Keys[1].Value))
+		Expect(rw.Body.String()).NotTo(ContainSubstring(`"value"`))
+	})
+})
@@ -0,0 +1,236 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+// Signature headers. The signed message is utils.CanonicalRequest, with the
+// timestamp and nonce sent in the same headers as hmac v2.
+const (
+	SignatureHeader      = "X-SIGNATURE"
+	SignatureAlgHeader   = "X-SIGNATURE-ALG"
+	SignatureKeyIDHeader = "X-SIGNATURE-KEY-ID"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrMissingNonce     = errors.New("missing signature nonce")
+)
+
+// Signer signs requests with a private key. Receivers only need the public
+// key, so unlike an hmac secret it can't be used to forge requests.
+type Signer struct {
+	KeyID string
+	Alg   string
+	Key   crypto.Signer
+}
+
+func NewSigner(keyID string, key crypto.Signer) (*Signer, error) {
+	alg, err := algFor(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{KeyID: keyID, Alg: alg, Key: key}, nil
+}
+
+// LoadSigner reads a PKCS8 PEM Ed25519 or ECDSA private key.
+func LoadSigner(keyID, path string) (*Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing private key: %v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return NewSigner(keyID, signer)
+}
+
+func (s *Signer) PublicKey() *PublicKey {
+	return &PublicKey{ID: s.KeyID, Alg: s.Alg, Key: s.Key.Public()}
+}
+
+// SignRequest adds the signature headers to r.
+func (s *Signer) SignRequest(r *http.Request) error {
+	nonce, err := kit_utils.NewNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(kit_utils.HmacTimestampHeader, timestamp)
+	r.Header.Set(kit_utils.HmacNonceHeader, nonce)
+	r.Header.Set(SignatureAlgHeader, s.Alg)
+	r.Header.Set(SignatureKeyIDHeader, s.KeyID)
+
+	msg, err := kit_utils.CanonicalRequest(r, timestamp, nonce)
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	if s.Alg == AlgEdDSA {
+		sig, err = s.Key.Sign(rand.Reader, []byte(msg), crypto.Hash(0))
+	} else {
+		hash := hashFor(s.Alg)
+		sig, err = s.Key.Sign(rand.Reader, digest(hash, msg), hash)
+	}
+	if err != nil {
+		return fmt.Errorf("error signing request: %v", err)
+	}
+	r.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// VerifyRequest checks the signature of r against the key named by its key
+// id header. The algorithm header must match the key's algorithm, and the
+// request must carry a nonce.
+func VerifyRequest(r *http.Request, keys KeyLookup) error {
+	key, err := keys.PublicKey(r.Context(), r.Header.Get(SignatureKeyIDHeader))
+	if err != nil {
+		return err
+	}
+	if alg := r.Header.Get(SignatureAlgHeader); alg != key.Alg {
+		return fmt.Errorf("algorithm %q doesn't match key %s", alg, key.ID)
+	}
+	timestamp := r.Header.Get(kit_utils.HmacTimestampHeader)
+	if err := kit_utils.CheckHmacTimestamp(timestamp, kit_utils.HmacClockSkew()); err != nil {
+		return err
+	}
+	nonce := r.Header.Get(kit_utils.HmacNonceHeader)
+	if nonce == "" {
+		return ErrMissingNonce
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Header.Get(SignatureHeader))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	msg, err := kit_utils.CanonicalRequest(r, timestamp, nonce)
+	if err != nil {
+		return err
+	}
+
+	var valid bool
+	switch pub := key.Key.(type) {
+	case ed25519.PublicKey:
+		valid = key.Alg == AlgEdDSA && ed25519.Verify(pub, []byte(msg), sig)
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(pub, digest(hashFor(key.Alg), msg), sig)
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SignatureHash is middleware.HmacHash with a private key.
+func SignatureHash(s *Signer) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			logger := kit_logger.GetLogEntry(r)
+			reqId := middleware.GetReqID(r.Context())
+
+			if err := s.SignRequest(r); err != nil {
+				logger.Error("error signing request: ", err)
+				logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// ValidateSignature is middleware.ValidateHmac for signatures. Nonces are
+// recorded in nonces, defaulting to middleware.HmacNonceStore.
+func ValidateSignature(keys KeyLookup, nonces kit_middleware.NonceStore) func(next http.Handler) http.Handler {
+	if nonces == nil {
+		nonces = kit_middleware.HmacNonceStore
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			logger := kit_logger.GetLogEntry(r)
+			reqId := middleware.GetReqID(r.Context())
+
+			if r.Header.Get(SignatureHeader) == "" {
+				logger.Error("no signature. Forbidden request")
+				logger.Debug(render.Render(rw, r, kit_errors.ErrFobiddenRequest(reqId)))
+				return
+			}
+			err := VerifyRequest(r, keys)
+			if err == kit_utils.ErrBodyTooLarge {
+				logger.Error("request body too large to verify signature")
+				logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusRequestEntityTooLarge, "request entity too large")))
+				return
+			}
+			if err != nil {
+				logger.Error("signature did not verify: ", err, ". Forbidden request")
+				logger.Debug(render.Render(rw, r, kit_errors.ErrFobiddenRequest(reqId)))
+				return
+			}
+
+			if nonces != nil {
+				nonce, timestamp := r.Header.Get(kit_utils.HmacNonceHeader), r.Header.Get(kit_utils.HmacTimestampHeader)
+				if status, err := kit_middleware.UseNonce(r, nonces, nonce, timestamp); err != nil {
+					kit_middleware.RenderHmacFailure(rw, r, status, err)
+					return
+				}
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func algFor(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return AlgEdDSA, nil
+	case *ecdsa.PublicKey:
+		if _, alg := curveAlg(k.Curve.Params().Name); alg != "" {
+			return alg, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %T", pub)
+}
+
+func hashFor(alg string) crypto.Hash {
+	if alg == AlgES384 {
+		return crypto.SHA384
+	}
+	return crypto.SHA256
+}
+
+func digest(hash crypto.Hash, msg string) []byte {
+	if hash == crypto.SHA384 {
+		sum := sha512.Sum384([]byte(msg))
+		return sum[:]
+	}
+	sum := sha256.Sum256([]byte(msg))
+	return sum[:]
+}
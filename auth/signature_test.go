@@ -0,0 +1,166 @@
+package auth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/auth"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Signature Tests", func() {
+
+	var edSigner, ecSigner *auth.Signer
+	var keys *auth.PublicKeySet
+	var nonces kit_middleware.NonceStore
+	var handler http.Handler
+
+	serve := func(r *http.Request) int {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	BeforeEach(func() {
+		_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		var err error
+		edSigner, err = auth.NewSigner("ed", edKey)
+		Expect(err).To(BeNil())
+		ecSigner, err = auth.NewSigner("ec", ecKey)
+		Expect(err).To(BeNil())
+
+		// round trip through the jwks served by the gateway.
+		b, err := json.Marshal(auth.NewPublicKeySet(edSigner.PublicKey(), ecSigner.PublicKey()))
+		Expect(err).To(BeNil())
+		keys, err = auth.ParseJWKS(b)
+		Expect(err).To(BeNil())
+		Expect(keys.Keys).To(HaveLen(2))
+
+		nonces = kit_middleware.NewMemoryNonceStore(100)
+		handler = auth.ValidateSignature(keys, nonces)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	})
+
+	It("should accept requests signed with either algorithm", func() {
+		for _, s := range []*auth.Signer{edSigner, ecSigner} {
+			r := httptest.NewRequest("POST", "/items?a=1", strings.NewReader(`[1, 2]`))
+			Expect(s.SignRequest(r)).To(Succeed())
+			Expect(serve(r)).To(Equal(200))
+		}
+	})
+
+	It("should reject a tampered body", func() {
+		r := httptest.NewRequest("POST", "/items", strings.NewReader(`[1, 2]`))
+		Expect(edSigner.SignRequest(r)).To(Succeed())
+		r.Body = http.NoBody
+		Expect(serve(r)).To(Equal(401))
+	})
+
+	It("should reject an algorithm that doesn't match the key", func() {
+		r := httptest.NewRequest("GET", "/items", nil)
+		Expect(ecSigner.SignRequest(r)).To(Succeed())
+		r.Header.Set(auth.SignatureAlgHeader, auth.AlgEdDSA)
+		Expect(serve(r)).To(Equal(401))
+	})
+
+	It("should reject unknown keys", func() {
+		_, other, _ := ed25519.GenerateKey(rand.Reader)
+		s, _ := auth.NewSigner("other", crypto.Signer(other))
+		r := httptest.NewRequest("GET", "/items", nil)
+		Expect(s.SignRequest(r)).To(Succeed())
+		Expect(serve(r)).To(Equal(401))
+	})
+
+	It("should fetch keys from a jwks endpoint", func() {
+		server := httptest.NewServer(auth.JWKSHandler(auth.NewPublicKeySet(edSigner.PublicKey())))
+		defer server.Close()
+		remote := auth.NewRemoteKeySet(server.URL)
+		handler = auth.ValidateSignature(remote, nonces)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+		r := httptest.NewRequest("GET", "/items", nil)
+		Expect(edSigner.SignRequest(r)).To(Succeed())
+		Expect(serve(r)).To(Equal(200))
+	})
+
+	It("should reject a missing nonce", func() {
+		r := httptest.NewRequest("GET", "/items", nil)
+		Expect(edSigner.SignRequest(r)).To(Succeed())
+		r.Header.Del(kit_utils.HmacNonceHeader)
+		Expect(serve(r)).To(Equal(401))
+	})
+
+	It("should reject a replayed request", func() {
+		r := httptest.NewRequest("GET", "/items", nil)
+		Expect(edSigner.SignRequest(r)).To(Succeed())
+		Expect(serve(r)).To(Equal(200))
+		Expect(serve(r)).To(Equal(401))
+	})
+
+	It("should refuse requests with a 503 when the nonce store is full", func() {
+		handler = auth.ValidateSignature(keys, kit_middleware.NewMemoryNonceStore(1))(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+		r := httptest.NewRequest("GET", "/items", nil)
+		Expect(edSigner.SignRequest(r)).To(Succeed())
+		Expect(serve(r)).To(Equal(200))
+		r = httptest.NewRequest("GET", "/items", nil)
+		Expect(edSigner.SignRequest(r)).To(Succeed())
+		Expect(serve(r)).To(Equal(503))
+	})
+
+	It("should share a single jwks fetch between concurrent callers", func() {
+		var fetches int32
+		release := make(chan struct{})
+		jwks := auth.JWKSHandler(auth.NewPublicKeySet(edSigner.PublicKey()))
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			<-release
+			jwks(rw, r)
+		}))
+		defer server.Close()
+		remote := auth.NewRemoteKeySet(server.URL)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				k, err := remote.PublicKey(context.Background(), "ed")
+				Expect(err).To(BeNil())
+				Expect(k.ID).To(Equal("ed"))
+			}()
+		}
+		Eventually(func() int32 { return atomic.LoadInt32(&fetches) }).Should(Equal(int32(1)))
+		close(release)
+		wg.Wait()
+		Expect(atomic.LoadInt32(&fetches)).To(Equal(int32(1)))
+	})
+
+	It("should give up waiting for a fetch when the caller's context ends", func() {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+		remote := auth.NewRemoteKeySet(server.URL)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := remote.PublicKey(ctx, "ed")
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+// KeyStore is where a keyset lives between rotation steps.
+type KeyStore interface {
+	Load(ctx context.Context) (*models.HmacKeys, error)
+	Save(ctx context.Context, keys *models.HmacKeys) error
+}
+
+// FileStore keeps the keyset as HmacKeys JSON in a file.
+type FileStore struct {
+	Path string
+}
+
+func (s *FileStore) Load(ctx context.Context) (*models.HmacKeys, error) {
+	b, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var keys models.HmacKeys
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", s.Path, err)
+	}
+	return &keys, nil
+}
+
+// Save writes through a temp file so readers never see a partial keyset.
+func (s *FileStore) Save(ctx context.Context, keys *models.HmacKeys) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".hmac-keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// HerokuStore keeps the keyset in a config var of a Heroku app, HMAC_SECRETS
+// by default. Saving restarts the app's dynos with the new keys.
+type HerokuStore struct {
+	App    string
+	Token  string
+	Var    string
+	Client *http.Client
+	// defaults to https://api.heroku.com.
+	BaseURL string
+}
+
+func NewHerokuStore(app, token string) *HerokuStore {
+	return &HerokuStore{
+		App:     app,
+		Token:   token,
+		Var:     "HMAC_SECRETS",
+		Client:  httpclient.Default(),
+		BaseURL: "https://api.heroku.com",
+	}
+}
+
+func (s *HerokuStore) Load(ctx context.Context) (*models.HmacKeys, error) {
+	var vars map[string]string
+	if err := s.do(ctx, "GET", nil, &vars); err != nil {
+		return nil, err
+	}
+	keys := &models.HmacKeys{}
+	if raw := vars[s.Var]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), keys); err != nil {
+			return nil, fmt.Errorf("error decoding %s of %s: %v", s.Var, s.App, err)
+		}
+	}
+	return keys, nil
+}
+
+func (s *HerokuStore) Save(ctx context.Context, keys *models.HmacKeys) error {
+	raw, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return s.do(ctx, "PATCH", map[string]string{s.Var: string(raw)}, nil)
+}
+
+func (s *HerokuStore) do(ctx context.Context, method string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.BaseURL+"/apps/"+s.App+"/config-vars", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+
+	// setting the same config vars twice is harmless, so retries are safe.
+	resp, err := s.Client.Do(httpclient.Idempotent(req))
+	if err != nil {
+		return fmt.Errorf("error calling heroku: %v", err)
+	}
+	defer resp.Body.Close()
+	if err := httpclient.CheckResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
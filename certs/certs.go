@@ -0,0 +1,169 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves a certificate loaded from cert and key files and reloads
+// it when either file changes, so rotated certs are picked up without a
+// restart.
+type Reloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("error loading key pair: %v", err)
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+// Watch checks the files every interval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime, err := r.latestModTime()
+			if err != nil {
+				log.Printf("certs: error checking %s: %v", r.CertFile, err)
+				continue
+			}
+			r.mu.RLock()
+			changed := modTime.After(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			// keep serving the old cert if the new files are half written.
+			if err := r.Reload(); err != nil {
+				log.Printf("certs: error reloading %s: %v", r.CertFile, err)
+				continue
+			}
+			log.Printf("certs: reloaded %s", r.CertFile)
+		}
+	}
+}
+
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ca file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in ca file")
+	}
+	return pool, nil
+}
+
+// ServerConfig serves the reloader's certificate. With a clientCAFile client
+// certificates are verified against it using clientAuth, i.e.
+// tls.RequireAndVerifyClientCert for mTLS.
+func ServerConfig(r *Reloader, clientCAFile string, clientAuth tls.ClientAuthType) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = clientAuth
+	}
+	return cfg, nil
+}
+
+// ClientConfig trusts caFile, or the system roots when empty, and presents
+// the reloader's certificate when the server asks for one. r can be nil.
+func ClientConfig(r *Reloader, caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if r != nil {
+		cfg.GetClientCertificate = r.GetClientCertificate
+	}
+	return cfg, nil
+}
+
+func ParseClientAuth(s string) tls.ClientAuthType {
+	switch s {
+	case "request":
+		return tls.RequestClientCert
+	case "require":
+		return tls.RequireAnyClientCert
+	case "verify":
+		return tls.VerifyClientCertIfGiven
+	case "require_and_verify":
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
@@ -0,0 +1,187 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate for cn signed by parent, or self signed when
+// parent is nil, and writes it to dir as cn.crt and cn.key.
+func issue(dir, cn string, parent *testCert, serial int64) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+	Expect(os.WriteFile(filepath.Join(dir, cn+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, cn+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)).To(Succeed())
+	return &testCert{cert: cert, key: key}
+}
+
+var _ = Describe("Certs Tests", func() {
+
+	var dir string
+	var ca *testCert
+
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "certs")
+		Expect(err).To(BeNil())
+		ca = issue(dir, "ca", nil, 1)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load and reload a key pair when the files change", func() {
+		issue(dir, "server", ca, 2)
+		r, err := NewReloader(path("server.crt"), path("server.key"))
+		Expect(err).To(BeNil())
+		Expect(r.Certificate().Certificate).To(HaveLen(1))
+		first, _ := x509.ParseCertificate(r.Certificate().Certificate[0])
+		Expect(first.SerialNumber.Int64()).To(Equal(int64(2)))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go r.Watch(ctx, 10*time.Millisecond)
+
+		issue(dir, "server", ca, 3)
+		later := time.Now().Add(time.Second)
+		Expect(os.Chtimes(path("server.crt"), later, later)).To(Succeed())
+		Eventually(func() int64 {
+			cert, _ := x509.ParseCertificate(r.Certificate().Certificate[0])
+			return cert.SerialNumber.Int64()
+		}).Should(Equal(int64(3)))
+	})
+
+	It("should fail on missing files", func() {
+		_, err := NewReloader(path("missing.crt"), path("missing.key"))
+		Expect(err).NotTo(BeNil())
+		_, err = LoadCertPool(path("missing.crt"))
+		Expect(err).NotTo(BeNil())
+		Expect(os.WriteFile(path("empty.crt"), []byte("nothing"), 0600)).To(Succeed())
+		_, err = LoadCertPool(path("empty.crt"))
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should parse client auth modes", func() {
+		Expect(ParseClientAuth("require_and_verify")).To(Equal(tls.RequireAndVerifyClientCert))
+		Expect(ParseClientAuth("verify")).To(Equal(tls.VerifyClientCertIfGiven))
+		Expect(ParseClientAuth("request")).To(Equal(tls.RequestClientCert))
+		Expect(ParseClientAuth("require")).To(Equal(tls.RequireAnyClientCert))
+		Expect(ParseClientAuth("unknown")).To(Equal(tls.NoClientCert))
+	})
+
+	Describe("mTLS", func() {
+
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			issue(dir, "server", ca, 2)
+			issue(dir, "client", ca, 3)
+			r, err := NewReloader(path("server.crt"), path("server.key"))
+			Expect(err).To(BeNil())
+			cfg, err := ServerConfig(r, path("ca.crt"), tls.RequireAndVerifyClientCert)
+			Expect(err).To(BeNil())
+
+			server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				io.WriteString(rw, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+			}))
+			server.TLS = cfg
+			server.StartTLS()
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		get := func(cfg *tls.Config) (string, error) {
+			// without sni the test server would present its own certificate.
+			cfg.ServerName = "server"
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				return "", err
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			return string(b), err
+		}
+
+		It("should present the client certificate", func() {
+			r, err := NewReloader(path("client.crt"), path("client.key"))
+			Expect(err).To(BeNil())
+			cfg, err := ClientConfig(r, path("ca.crt"))
+			Expect(err).To(BeNil())
+			body, err := get(cfg)
+			Expect(err).To(BeNil())
+			Expect(body).To(Equal("client"))
+		})
+
+		It("should be rejected without a client certificate", func() {
+			cfg, err := ClientConfig(nil, path("ca.crt"))
+			Expect(err).To(BeNil())
+			_, err = get(cfg)
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("should reject servers outside the trusted roots", func() {
+			other, err := os.MkdirTemp("", "certs")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(other)
+			issue(other, "ca", nil, 1)
+			cfg, err := ClientConfig(nil, filepath.Join(other, "ca.crt"))
+			Expect(err).To(BeNil())
+			_, err = get(cfg)
+			Expect(err).NotTo(BeNil())
+		})
+	})
+})
@@ -0,0 +1,228 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/newrelic/go-agent/v3/newrelic"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+// Resolver finds the pool of instances for a service name. gateway.Registry
+// satisfies it.
+type Resolver interface {
+	Pool(name string) *models.ServicePool
+}
+
+var ErrNoPeer = errors.New("no online instance available")
+
+type versionCtxKey struct{}
+
+type peerCtxKey struct{}
+
+type selectedPeer struct {
+	pool    *models.ServicePool
+	service *models.Service
+}
+
+// WithVersion pins calls made with ctx to a version of the service, like the
+// version header does for requests through the gateway.
+func WithVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionCtxKey{}, version)
+}
+
+// ServiceClient calls another kit service by name. Requests are routed to an
+// instance from the resolver, signed with the latest hmac key and carry the
+// request id and trace headers of the calling request.
+type ServiceClient struct {
+	ServiceName string
+	Resolver    Resolver
+	// signs requests with HmacKeys when built by NewServiceClient.
+	HTTP     *http.Client
+	HmacKeys *models.HmacKeys
+}
+
+// NewServiceClient returns a client signing with keys, or not signing if
+// keys is nil.
+func NewServiceClient(serviceName string, resolver Resolver, keys *models.HmacKeys) *ServiceClient {
+	opts := httpclient.DefaultOptions()
+	if keys != nil {
+		opts.Sign = keys.SigningKey
+		opts.ClientID = keys.Name
+	}
+	return &ServiceClient{
+		ServiceName: serviceName,
+		Resolver:    resolver,
+		HTTP:        httpclient.New(opts),
+		HmacKeys:    keys,
+	}
+}
+
+// NewRequest builds a request for a named route of the service, i.e. "health".
+// A non nil body is encoded as json. The instance is picked with the pool's
+// traffic policy, honoring a version pinned with WithVersion.
+func (c *ServiceClient) NewRequest(ctx context.Context, method, route string, query url.Values, body interface{}) (*http.Request, error) {
+	pool := c.Resolver.Pool(c.ServiceName)
+	if pool == nil {
+		return nil, fmt.Errorf("service %s is not registered", c.ServiceName)
+	}
+	peer := pickPeer(ctx, pool)
+	if peer == nil {
+		return nil, fmt.Errorf("service %s: %w", c.ServiceName, ErrNoPeer)
+	}
+
+	var routes map[string]string
+	if err := json.Unmarshal(peer.Routes, &routes); err != nil {
+		return nil, fmt.Errorf("error parsing routes of %s: %v", c.ServiceName, err)
+	}
+	path, ok := routes[route]
+	if !ok {
+		return nil, fmt.Errorf("service %s has no route %s", c.ServiceName, route)
+	}
+	u := fmt.Sprintf("%s://%s/%s%s", peer.ServiceProtocol, peer.BaseURL, peer.ServiceVersion, path)
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling request body: %v", err)
+		}
+		bodyReader = bytes.NewReader(b)
+	}
+	ctx = context.WithValue(ctx, peerCtxKey{}, &selectedPeer{pool: pool, service: peer})
+	req, err := http.NewRequestWithContext(ctx, method, u, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	return req, nil
+}
+
+// Do forwards request id and trace headers and sends the request.
+// Non 2xx responses are returned as an error, a *kit_errors.ErrResponse when
+// the body can be decoded as one. The outcome of requests built by
+// NewRequest is reported to the pool's outlier detector.
+func (c *ServiceClient) Do(req *http.Request) (*http.Response, error) {
+	propagate(req)
+
+	resp, err := c.HTTP.Do(req)
+	report(req, resp, err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var errResp kit_errors.ErrResponse
+	if err := json.NewDecoder(resp.Body).Decode(&errResp); err == nil && errResp.HttpStatusCode != 0 {
+		return nil, &errResp
+	}
+	return nil, httpclient.CheckResponse(resp)
+}
+
+// DoJSON sends in as the json body and decodes the response into out. Either
+// can be nil.
+func (c *ServiceClient) DoJSON(ctx context.Context, method, route string, query url.Values, in, out interface{}) error {
+	req, err := c.NewRequest(ctx, method, route, query, in)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding response: %v", err)
+	}
+	return nil
+}
+
+func (c *ServiceClient) GetJSON(ctx context.Context, route string, query url.Values, out interface{}) error {
+	return c.DoJSON(ctx, "GET", route, query, nil, out)
+}
+
+func (c *ServiceClient) PostJSON(ctx context.Context, route string, in, out interface{}) error {
+	return c.DoJSON(ctx, "POST", route, nil, in, out)
+}
+
+func (c *ServiceClient) PutJSON(ctx context.Context, route string, in, out interface{}) error {
+	return c.DoJSON(ctx, "PUT", route, nil, in, out)
+}
+
+func (c *ServiceClient) DeleteJSON(ctx context.Context, route string, query url.Values, out interface{}) error {
+	return c.DoJSON(ctx, "DELETE", route, query, nil, out)
+}
+
+// pickPeer selects like the gateway proxy, with the pinned version passed
+// to the pool's policy through its version header.
+func pickPeer(ctx context.Context, pool *models.ServicePool) *models.Service {
+	version, _ := ctx.Value(versionCtxKey{}).(string)
+	if pool.Policy == nil {
+		if version != "" {
+			if peer := pool.GetNextPeerForVersion(version); peer != nil {
+				return peer
+			}
+		}
+		return pool.GetNextPeer()
+	}
+	r := &http.Request{Header: http.Header{}}
+	if version != "" && pool.Policy.VersionHeader != "" {
+		r.Header.Set(pool.Policy.VersionHeader, version)
+	}
+	return pool.GetPeerForRequest(nil, r)
+}
+
+func report(req *http.Request, resp *http.Response, err error) {
+	peer, ok := req.Context().Value(peerCtxKey{}).(*selectedPeer)
+	if !ok || peer.pool.Outliers == nil {
+		return
+	}
+	if err != nil {
+		// the caller giving up says nothing about the peer.
+		if req.Context().Err() == nil {
+			peer.pool.Outliers.ReportError(peer.service, err)
+		}
+		return
+	}
+	peer.pool.Outliers.ReportStatus(peer.service, resp.StatusCode)
+}
+
+func propagate(req *http.Request) {
+	ctx := req.Context()
+	if reqId := middleware.GetReqID(ctx); reqId != "" && req.Header.Get(middleware.RequestIDHeader) == "" {
+		req.Header.Set(middleware.RequestIDHeader, reqId)
+	}
+	if fwd, ok := ctx.Value(forwardCtxKey{}).(http.Header); ok {
+		for k, vv := range fwd {
+			if req.Header.Get(k) == "" {
+				for _, v := range vv {
+					req.Header.Add(k, v)
+				}
+			}
+		}
+	}
+	if txn := newrelic.FromContext(ctx); txn != nil {
+		txn.InsertDistributedTraceHeaders(req.Header)
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+type poolResolver map[string]*models.ServicePool
+
+func (r poolResolver) Pool(name string) *models.ServicePool {
+	return r[name]
+}
+
+var _ = Describe("Service Client Tests", func() {
+
+	var backend *httptest.Server
+	var pool *models.ServicePool
+	var client *ServiceClient
+	var seen *http.Request
+	status := 200
+
+	instance := func(id int, version string) *models.Service {
+		return &models.Service{
+			ID:              id,
+			ServiceName:     "items",
+			ServiceOnline:   true,
+			ServiceProtocol: "http",
+			ServiceVersion:  version,
+			BaseURL:         strings.TrimPrefix(backend.URL, "http://"),
+			Routes:          []byte(`{"get_item": "/items"}`),
+		}
+	}
+
+	BeforeEach(func() {
+		status = 200
+		backend = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			seen = r
+			if status != 200 {
+				rw.WriteHeader(status)
+				json.NewEncoder(rw).Encode(kit_errors.ErrResponse{HttpStatusCode: status, StatusText: "failed"})
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]string{"path": r.URL.Path})
+		}))
+		pool = &models.ServicePool{Services: []*models.Service{instance(1, "v1"), instance(2, "v2")}}
+		client = &ServiceClient{
+			ServiceName: "items",
+			Resolver:    poolResolver{"items": pool},
+			HTTP:        httpclient.New(httpclient.Options{Retry: httpclient.NoRetry()}),
+		}
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	get := func(ctx context.Context) (string, error) {
+		var out map[string]string
+		err := client.GetJSON(ctx, "get_item", nil, &out)
+		return out["path"], err
+	}
+
+	It("should call the named route of an instance", func() {
+		path, err := get(context.Background())
+		Expect(err).To(BeNil())
+		Expect(path).To(MatchRegexp(`^/v[12]/items$`))
+	})
+
+	It("should follow the pool's traffic policy", func() {
+		pool.Policy, _ = models.NewTrafficPolicy(map[string]int{"v2": 1})
+		for i := 0; i < 4; i++ {
+			Expect(get(context.Background())).To(Equal("/v2/items"))
+		}
+	})
+
+	It("should honor a pinned version", func() {
+		ctx := WithVersion(context.Background(), "v1")
+		for i := 0; i < 4; i++ {
+			Expect(get(ctx)).To(Equal("/v1/items"))
+		}
+		pool.Policy, _ = models.NewTrafficPolicy(map[string]int{"v2": 1})
+		Expect(get(ctx)).To(Equal("/v1/items"))
+	})
+
+	It("should report failures to the outlier detector", func() {
+		od := models.NewOutlierDetector(pool)
+		od.Consecutive5xx = 1
+		pool.Services = append(pool.Services, instance(3, "v1"))
+		status = 503
+		_, err := get(context.Background())
+		Expect(err).To(BeAssignableToTypeOf(&kit_errors.ErrResponse{}))
+		ejected := 0
+		for _, st := range od.Stats() {
+			if st.Ejected {
+				ejected++
+			}
+		}
+		Expect(ejected).To(Equal(1))
+	})
+
+	It("should propagate the request id and forwarded headers", func() {
+		ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "req-1")
+		ctx = WithForwardedHeaders(ctx, http.Header{"Traceparent": {"00-abc-def-01"}})
+		_, err := get(ctx)
+		Expect(err).To(BeNil())
+		Expect(seen.Header.Get(middleware.RequestIDHeader)).To(Equal("req-1"))
+		Expect(seen.Header.Get("traceparent")).To(Equal("00-abc-def-01"))
+	})
+
+	It("should fail without an online instance", func() {
+		for _, s := range pool.Services {
+			s.ServiceOnline = false
+		}
+		_, err := get(context.Background())
+		Expect(err).To(MatchError(ContainSubstring(ErrNoPeer.Error())))
+	})
+})
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+type forwardCtxKey struct{}
+
+// TraceHeaders are copied from the incoming request to outbound calls made
+// with its context.
+var TraceHeaders = []string{
+	"traceparent",
+	"tracestate",
+	"newrelic",
+	"X-B3-TraceId",
+	"X-B3-SpanId",
+	"X-B3-ParentSpanId",
+	"X-B3-Sampled",
+	"X-Cloud-Trace-Context",
+}
+
+// ForwardHeaders stores the incoming trace headers in the request context so
+// ServiceClient can propagate them.
+func ForwardHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fwd := http.Header{}
+		for _, h := range TraceHeaders {
+			if vv := r.Header.Values(h); len(vv) > 0 {
+				fwd[http.CanonicalHeaderKey(h)] = vv
+			}
+		}
+		if len(fwd) > 0 {
+			r = r.WithContext(WithForwardedHeaders(r.Context(), fwd))
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func WithForwardedHeaders(ctx context.Context, h http.Header) context.Context {
+	return context.WithValue(ctx, forwardCtxKey{}, h)
+}
@@ -0,0 +1,156 @@
+// Command hmackeys rotates HMAC keysets.
+//
+//	hmackeys -file keys.json -overlap 24h [-w] <command> [args]
+//
+// Commands:
+//
+//	generate            new keyset with one signing key
+//	list                keys without their values
+//	add                 add a verify-only key
+//	promote <id>        make a key the signing key
+//	retire <id>         stop accepting a key
+//	prune               remove retired and expired keys
+//	rotate              do the next due step
+//	report name=file... keys each service accepts
+//
+// The resulting HmacKeys JSON is printed, -w saves it to the store instead.
+// With -heroku-app the keyset is read from and written to the app's
+// HMAC_SECRETS config var, using HEROKU_API_KEY.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sailsforce/gomicro-kit/auth"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+func main() {
+	file := flag.String("file", "", "keyset json file")
+	herokuApp := flag.String("heroku-app", "", "heroku app holding the keyset in HMAC_SECRETS")
+	name := flag.String("name", "Hmac keys", "keyset name, for generate")
+	overlap := flag.Duration("overlap", 24*time.Hour, "time a key stays verify-only before signing, and accepted after")
+	write := flag.Bool("w", false, "save the result to the store instead of printing it")
+	flag.Parse()
+
+	if err := run(flag.Args(), *file, *herokuApp, *name, *overlap, *write); err != nil {
+		fmt.Fprintln(os.Stderr, "hmackeys:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, file, herokuApp, name string, overlap time.Duration, write bool) error {
+	if len(args) == 0 {
+		flag.Usage()
+		return fmt.Errorf("missing command")
+	}
+	ctx := context.Background()
+	rotator := auth.NewRotator(overlap)
+
+	var store auth.KeyStore
+	switch {
+	case herokuApp != "":
+		store = auth.NewHerokuStore(herokuApp, os.Getenv("HEROKU_API_KEY"))
+	case file != "":
+		store = &auth.FileStore{Path: file}
+	}
+
+	cmd := args[0]
+	if cmd == "generate" {
+		keys := &models.HmacKeys{Name: name}
+		key, err := rotator.Add(keys)
+		if err != nil {
+			return err
+		}
+		rotator.Overlap = 0
+		if err := rotator.Promote(keys, key.ID); err != nil {
+			return err
+		}
+		return output(ctx, store, keys, write)
+	}
+	if cmd == "report" {
+		return report(ctx, store, args[1:])
+	}
+
+	if store == nil {
+		return fmt.Errorf("-file or -heroku-app is required")
+	}
+	keys, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		return printJSON(auth.Describe(keys))
+	case "add":
+		_, err = rotator.Add(keys)
+	case "promote", "retire":
+		if len(args) < 2 {
+			return fmt.Errorf("%s needs a key id", cmd)
+		}
+		if cmd == "promote" {
+			err = rotator.Promote(keys, args[1])
+		} else {
+			err = rotator.Retire(keys, args[1])
+		}
+	case "prune":
+		pruned := rotator.Prune(keys)
+		fmt.Fprintln(os.Stderr, "pruned:", strings.Join(pruned, ", "))
+	case "rotate":
+		var step string
+		step, err = rotator.Rotate(keys)
+		fmt.Fprintln(os.Stderr, step)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return output(ctx, store, keys, write)
+}
+
+func report(ctx context.Context, store auth.KeyStore, args []string) error {
+	if store == nil {
+		return fmt.Errorf("-file or -heroku-app is required")
+	}
+	current, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	services := map[string]*models.HmacKeys{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected name=file, got %q", arg)
+		}
+		keys, err := (&auth.FileStore{Path: parts[1]}).Load(ctx)
+		if err != nil {
+			return err
+		}
+		services[parts[0]] = keys
+	}
+	return printJSON(auth.Report(current, services))
+}
+
+func output(ctx context.Context, store auth.KeyStore, keys *models.HmacKeys, write bool) error {
+	if !write {
+		return printJSON(keys)
+	}
+	if store == nil {
+		return fmt.Errorf("-w needs -file or -heroku-app")
+	}
+	return store.Save(ctx, keys)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
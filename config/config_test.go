@@ -1,10 +1,14 @@
 package config
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
 )
 
 var _ = Describe("Config Tests", func() {
@@ -204,6 +208,58 @@ var _ = Describe("Config Tests", func() {
 		})
 	})
 
+	Describe("HTTPClient", func() {
+		var keyID string
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			keyID = ""
+			server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				keyID = r.Header.Get(utils.HmacKeyIDHeader)
+			}))
+		})
+		AfterEach(func() {
+			server.Close()
+		})
+
+		get := func(client *http.Client) string {
+			resp, err := client.Get(server.URL)
+			Expect(err).To(BeNil())
+			resp.Body.Close()
+			return keyID
+		}
+
+		It("should sign with HMAC_SECRETS until keys are loaded", func() {
+			os.Setenv("HMAC_SECRETS", `{"name": "env", "keys": [{"id": "env", "value": "envsecret"}]}`)
+			client := c.HTTPClient()
+			Expect(get(client)).To(Equal("env"))
+
+			c.HmacKeys = &models.HmacKeys{Keys: []models.Key{{ID: "loaded", Value: "loadedsecret"}}}
+			Expect(get(client)).To(Equal("loaded"))
+		})
+
+		It("should pick up reloaded keys", func() {
+			c.HmacKeys = &models.HmacKeys{Keys: []models.Key{{ID: "first", Value: "firstsecret"}}}
+			client := c.HTTPClient()
+			Expect(get(client)).To(Equal("first"))
+
+			c.HmacKeys = &models.HmacKeys{Keys: []models.Key{{ID: "second", Value: "secondsecret"}}}
+			Expect(get(client)).To(Equal("second"))
+		})
+
+		It("should not sign without keys", func() {
+			Expect(get(c.HTTPClient())).To(BeEmpty())
+		})
+
+		It("should start signing once keys are loaded", func() {
+			client := c.HTTPClient()
+			Expect(get(client)).To(BeEmpty())
+
+			c.HmacKeys = &models.HmacKeys{Keys: []models.Key{{ID: "late", Value: "latesecret"}}}
+			Expect(get(client)).To(Equal("late"))
+		})
+	})
+
 	Describe("DefaultMicroConfig", func() {
 		err := c.DefaultMicroConfig()
 		Expect(err).To(BeNil())
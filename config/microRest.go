@@ -2,16 +2,22 @@ package config
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/go-chi/render"
 	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/sailsforce/gomicro-kit/certs"
+	"github.com/sailsforce/gomicro-kit/httpclient"
 	"github.com/sailsforce/gomicro-kit/models"
 	"github.com/sailsforce/gomicro-kit/utils"
 	"github.com/sirupsen/logrus"
@@ -35,6 +41,8 @@ type serviceInfo struct {
 	BaseURL    string
 	Routes     string
 	GatewayURL string
+	// optional path to an OpenAPI json document published at registration.
+	OpenAPIFile string
 }
 
 type MicroRestConfig struct {
@@ -47,6 +55,11 @@ type MicroRestConfig struct {
 	// only used if more than one db is needed.
 	DBList   []*gorm.DB
 	HmacKeys *models.HmacKeys
+	// server tls config, nil when the service runs plain http.
+	TLS *tls.Config
+	// used for outbound calls, i.e. registration and health probes.
+	ClientTLS    *tls.Config
+	CertReloader *certs.Reloader
 }
 
 func (c *MicroRestConfig) DefaultMicroConfig() error {
@@ -96,6 +109,7 @@ func (c *MicroRestConfig) LoadServiceInfo() {
 		os.Getenv("SERVICE_BASE_URL"),
 		os.Getenv("SERVICE_ROUTES"),
 		os.Getenv("GATEWAY_URL"),
+		os.Getenv("SERVICE_OPENAPI_FILE"),
 	}
 }
 
@@ -120,7 +134,18 @@ func (c *MicroRestConfig) RegisterAtGateway() error {
 		Routes:          routesBytes,
 	}
 
-	err = service.RegisterAtGateway(c.Service.GatewayURL)
+	if c.Service.OpenAPIFile != "" {
+		doc, err := os.ReadFile(c.Service.OpenAPIFile)
+		if err != nil {
+			return fmt.Errorf("%s %v", "error reading openapi file: ", err)
+		}
+		if !json.Valid(doc) {
+			return fmt.Errorf("%s %v", "error parsing openapi file: ", c.Service.OpenAPIFile)
+		}
+		service.OpenAPI = doc
+	}
+
+	err = service.RegisterAtGatewayWithClient(c.HTTPClient(), c.Service.GatewayURL)
 	if err != nil {
 		if strings.Contains(err.Error(), "409") {
 			c.Logger.Info("service already registered.")
@@ -133,6 +158,87 @@ func (c *MicroRestConfig) RegisterAtGateway() error {
 	return nil
 }
 
+// KeepRegistered re-registers the service every interval until ctx is done,
+// so the gateway keeps seeing it before the registration ttl expires.
+func (c *MicroRestConfig) KeepRegistered(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.RegisterAtGateway(); err != nil {
+				c.Logger.Error("error renewing registration: ", err)
+			}
+		}
+	}
+}
+
+// HTTPClient returns a kit http client using the config's client tls,
+// signing requests with HmacKeys, read on every request so reloaded keys are
+// picked up, or with the HMAC_SECRETS keyset until keys are loaded. Requests
+// are sent unsigned if neither has keys.
+func (c *MicroRestConfig) HTTPClient() *http.Client {
+	opts := httpclient.DefaultOptions()
+	opts.TLSConfig = c.ClientTLS
+
+	var env *models.HmacKeys
+	if c.HmacKeys == nil {
+		render.DecodeJSON(bytes.NewReader([]byte(os.Getenv("HMAC_SECRETS"))), &env)
+	}
+	signingKeys := func() *models.HmacKeys {
+		if c.HmacKeys != nil {
+			return c.HmacKeys
+		}
+		return env
+	}
+	opts.Sign = func() (string, string, error) {
+		keys := signingKeys()
+		if keys == nil || len(keys.Keys) == 0 {
+			return "", "", httpclient.ErrSkipSigning
+		}
+		return keys.SigningKey()
+	}
+	if keys := signingKeys(); keys != nil {
+		opts.ClientID = keys.Name
+	}
+	return httpclient.New(opts)
+}
+
+// LoadTLS builds the server and client tls configs from TLS_CERT_FILE and
+// TLS_KEY_FILE. TLS_CLIENT_CA_FILE enables client cert verification with
+// TLS_CLIENT_AUTH (request, require, verify, require_and_verify) and
+// TLS_CA_FILE sets the roots trusted for outbound calls. The cert is
+// reloaded when the files change while ctx is alive.
+func (c *MicroRestConfig) LoadTLS(ctx context.Context) error {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile != "" && keyFile != "" {
+		reloader, err := certs.NewReloader(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("error loading tls cert: %v", err)
+		}
+		go reloader.Watch(ctx, time.Minute)
+		c.CertReloader = reloader
+
+		clientAuth := tls.RequireAndVerifyClientCert
+		if v := os.Getenv("TLS_CLIENT_AUTH"); v != "" {
+			clientAuth = certs.ParseClientAuth(v)
+		}
+		c.TLS, err = certs.ServerConfig(reloader, os.Getenv("TLS_CLIENT_CA_FILE"), clientAuth)
+		if err != nil {
+			return fmt.Errorf("error creating server tls config: %v", err)
+		}
+	}
+
+	clientTLS, err := certs.ClientConfig(c.CertReloader, os.Getenv("TLS_CA_FILE"))
+	if err != nil {
+		return fmt.Errorf("error creating client tls config: %v", err)
+	}
+	c.ClientTLS = clientTLS
+	return nil
+}
+
 func (c *MicroRestConfig) AddRV(key string, val interface{}) {
 	if c.RV == nil {
 		c.RV = make(map[string]interface{})
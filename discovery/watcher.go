@@ -0,0 +1,298 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+// Watcher keeps a local ServicePool per service name in sync with the
+// gateway registry. It satisfies client.Resolver.
+type Watcher struct {
+	// the gateway discovery endpoint.
+	RegistryURL string
+	Client      *http.Client
+	// time between polls, or between retries after a failed long poll.
+	Interval time.Duration
+	// when set the gateway is long-polled for changes.
+	LongPoll time.Duration
+	// minimum time between long polls, in case the gateway answers
+	// immediately.
+	MinInterval time.Duration
+	// optional, set on every pool to probe https services.
+	TLSConfig *tls.Config
+	// optional, the last snapshot is written here and loaded at startup if
+	// the gateway can't be reached.
+	SnapshotPath string
+
+	mu       sync.RWMutex
+	pools    map[string]*models.ServicePool
+	version  uint64
+	outliers map[string]*models.OutlierDetector
+}
+
+func NewWatcher(registryUrl string) *Watcher {
+	return &Watcher{
+		RegistryURL: registryUrl,
+		// fetch sets its own deadline to allow for long polls.
+		Client:       httpclient.New(httpclient.Options{Retry: httpclient.DefaultRetryPolicy()}),
+		Interval:     15 * time.Second,
+		LongPoll:     30 * time.Second,
+		MinInterval:  time.Second,
+		SnapshotPath: os.Getenv("DISCOVERY_SNAPSHOT_PATH"),
+		pools:        make(map[string]*models.ServicePool),
+		outliers:     make(map[string]*models.OutlierDetector),
+	}
+}
+
+// NewOutlierDetector attaches an outlier detector to the named pool, now and
+// whenever the pool is replaced. Ejections are local to this watcher.
+func (w *Watcher) NewOutlierDetector(name string) *models.OutlierDetector {
+	od := models.NewOutlierDetectorFunc(func() *models.ServicePool { return w.Pool(name) })
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.outliers == nil {
+		w.outliers = make(map[string]*models.OutlierDetector)
+	}
+	w.outliers[name] = od
+	if old, ok := w.pools[name]; ok {
+		pool := w.newPool(name, old)
+		pool.Services = old.Services
+		w.pools[name] = pool
+	}
+	return od
+}
+
+// Start loads the registry once and keeps watching it in the background
+// until ctx is done. If the gateway is unreachable the last persisted
+// snapshot is used instead.
+func (w *Watcher) Start(ctx context.Context) error {
+	snapshot, err := w.fetch(ctx, false)
+	if err != nil {
+		log.Printf("discovery: gateway unreachable, loading snapshot: %v", err)
+		snapshot, err = w.loadSnapshot()
+		if err != nil {
+			return fmt.Errorf("error loading registry: %v", err)
+		}
+	} else {
+		w.saveSnapshot(snapshot)
+	}
+	w.Apply(snapshot)
+
+	go w.watch(ctx)
+	return nil
+}
+
+func (w *Watcher) watch(ctx context.Context) {
+	for {
+		started := time.Now()
+		snapshot, err := w.fetch(ctx, w.LongPoll > 0)
+		if err != nil {
+			log.Printf("discovery: error fetching registry: %v", err)
+		} else if snapshot.Version != w.Version() {
+			w.Apply(snapshot)
+			w.saveSnapshot(snapshot)
+		}
+
+		// long polls return as soon as something changes, so they only wait
+		// out what is left of MinInterval.
+		wait := w.Interval
+		if w.LongPoll > 0 && err == nil {
+			wait = w.MinInterval - time.Since(started)
+		}
+		if wait <= 0 {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (w *Watcher) fetch(ctx context.Context, longPoll bool) (*models.ServiceRegistrySnapshot, error) {
+	u, err := url.Parse(w.RegistryURL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 10 * time.Second
+	if longPoll {
+		q := u.Query()
+		q.Set("version", strconv.FormatUint(w.Version(), 10))
+		q.Set("wait", w.LongPoll.String())
+		u.RawQuery = q.Encode()
+		timeout += w.LongPoll
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := httpclient.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	var snapshot models.ServiceRegistrySnapshot
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return nil, fmt.Errorf("error decoding registry: %v", err)
+	}
+	return &snapshot, nil
+}
+
+// Apply replaces the pools whose instances changed. Changed pools are swapped
+// for new ones, so selections already holding the old pool are unaffected.
+func (w *Watcher) Apply(snapshot *models.ServiceRegistrySnapshot) {
+	byName := make(map[string][]models.Service)
+	for _, s := range snapshot.Services {
+		byName[s.ServiceName] = append(byName[s.ServiceName], s)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for name, services := range byName {
+		old := w.pools[name]
+		if old != nil && samePool(old, services) {
+			continue
+		}
+		pool := w.newPool(name, old)
+		for i := range services {
+			pool.AddService(&services[i])
+		}
+		if old != nil && pool.Outliers != nil {
+			forgetRemoved(pool.Outliers, old, services)
+		}
+		w.pools[name] = pool
+		log.Printf("discovery: %s now has %d instance(s)", name, len(services))
+	}
+	for name, pool := range w.pools {
+		if _, ok := byName[name]; !ok {
+			if pool.Outliers != nil {
+				forgetRemoved(pool.Outliers, pool, nil)
+			}
+			delete(w.pools, name)
+			log.Printf("discovery: %s removed", name)
+		}
+	}
+	w.version = snapshot.Version
+}
+
+// newPool returns an empty pool keeping the cursor, policy, outlier detector
+// and tls config of old. Must be called with the write lock held.
+func (w *Watcher) newPool(name string, old *models.ServicePool) *models.ServicePool {
+	pool := &models.ServicePool{Outliers: w.outliers[name], TLSConfig: w.TLSConfig}
+	if old != nil {
+		pool.Current = atomic.LoadUint64(&old.Current)
+		pool.Policy = old.Policy
+		if pool.Outliers == nil {
+			pool.Outliers = old.Outliers
+		}
+		if pool.TLSConfig == nil {
+			pool.TLSConfig = old.TLSConfig
+		}
+	}
+	return pool
+}
+
+func (w *Watcher) Pool(name string) *models.ServicePool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.pools[name]
+}
+
+func (w *Watcher) Version() uint64 {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.version
+}
+
+func (w *Watcher) saveSnapshot(snapshot *models.ServiceRegistrySnapshot) {
+	if w.SnapshotPath == "" {
+		return
+	}
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		log.Printf("discovery: error marshalling snapshot: %v", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(w.SnapshotPath), ".registry-*")
+	if err != nil {
+		log.Printf("discovery: error writing snapshot: %v", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		log.Printf("discovery: error writing snapshot: %v", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), w.SnapshotPath); err != nil {
+		log.Printf("discovery: error writing snapshot: %v", err)
+	}
+}
+
+func (w *Watcher) loadSnapshot() (*models.ServiceRegistrySnapshot, error) {
+	if w.SnapshotPath == "" {
+		return nil, fmt.Errorf("no snapshot path configured")
+	}
+	b, err := os.ReadFile(w.SnapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot models.ServiceRegistrySnapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// forgetRemoved drops the outlier state of instances of old that are not in
+// services.
+func forgetRemoved(od *models.OutlierDetector, old *models.ServicePool, services []models.Service) {
+	kept := make(map[string]bool, len(services))
+	for i := range services {
+		kept[services[i].InstanceKey()] = true
+	}
+	for _, s := range old.Services {
+		if !kept[s.InstanceKey()] {
+			od.Forget(s)
+		}
+	}
+}
+
+func samePool(pool *models.ServicePool, services []models.Service) bool {
+	if len(pool.Services) != len(services) {
+		return false
+	}
+	for i, s := range pool.Services {
+		n := services[i]
+		if s.BaseURL != n.BaseURL || s.ServiceVersion != n.ServiceVersion ||
+			s.ServiceOnline != n.ServiceOnline || !bytes.Equal(s.Routes, n.Routes) {
+			return false
+		}
+	}
+	return true
+}
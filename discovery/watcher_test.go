@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Watcher Tests", func() {
+
+	var w *Watcher
+
+	instance := func(baseURL string) models.Service {
+		return models.Service{ServiceName: "items", BaseURL: baseURL, ServiceVersion: "v1", ServiceOnline: true}
+	}
+
+	snapshot := func(version uint64, services ...models.Service) *models.ServiceRegistrySnapshot {
+		return &models.ServiceRegistrySnapshot{Version: version, Services: services}
+	}
+
+	BeforeEach(func() {
+		w = NewWatcher("")
+		w.Client = httpclient.New(httpclient.Options{Retry: httpclient.NoRetry()})
+		w.SnapshotPath = ""
+	})
+
+	It("should swap changed pools and drop removed ones", func() {
+		w.Apply(snapshot(1, instance("a:80"), instance("b:80")))
+		before := w.Pool("items")
+		Expect(before.Services).To(HaveLen(2))
+
+		w.Apply(snapshot(2, instance("a:80"), instance("b:80")))
+		Expect(w.Pool("items")).To(BeIdenticalTo(before))
+
+		w.Apply(snapshot(3, instance("a:80")))
+		Expect(w.Pool("items")).NotTo(BeIdenticalTo(before))
+		Expect(before.Services).To(HaveLen(2))
+
+		w.Apply(snapshot(4))
+		Expect(w.Pool("items")).To(BeNil())
+		Expect(w.Version()).To(Equal(uint64(4)))
+	})
+
+	It("should carry the policy, outlier detector and tls config into new pools", func() {
+		w.TLSConfig = &tls.Config{ServerName: "items"}
+		w.Apply(snapshot(1, instance("a:80"), instance("b:80"), instance("c:80")))
+		od := w.NewOutlierDetector("items")
+		od.Consecutive5xx = 1
+		policy, _ := models.NewTrafficPolicy(map[string]int{"v1": 1})
+		w.Pool("items").Policy = policy
+
+		pool := w.Pool("items")
+		Expect(pool.Outliers).To(BeIdenticalTo(od))
+		ejected := pool.Services[0]
+		od.ReportStatus(ejected, 500)
+		Expect(od.IsEjected(ejected)).To(BeTrue())
+
+		w.Apply(snapshot(2, instance("a:80"), instance("b:80"), instance("d:80")))
+		pool = w.Pool("items")
+		Expect(pool.Policy).To(BeIdenticalTo(policy))
+		Expect(pool.Outliers).To(BeIdenticalTo(od))
+		Expect(pool.TLSConfig).To(BeIdenticalTo(w.TLSConfig))
+		// the gateway still lists it online, the local ejection wins.
+		Expect(pool.Available(pool.Services[0])).To(BeFalse())
+		Expect(pool.Available(pool.Services[1])).To(BeTrue())
+	})
+
+	It("should forget the outlier state of removed instances", func() {
+		w.Apply(snapshot(1, instance("a:80"), instance("b:80"), instance("c:80")))
+		od := w.NewOutlierDetector("items")
+		od.Consecutive5xx = 1
+		a := w.Pool("items").Services[0]
+		od.ReportStatus(a, 500)
+
+		w.Apply(snapshot(2, instance("b:80"), instance("c:80")))
+		Expect(od.IsEjected(a)).To(BeFalse())
+		Expect(od.Stats()).To(BeEmpty())
+	})
+
+	Context("with a gateway", func() {
+
+		var gateway *httptest.Server
+		var requests int32
+		var mu sync.Mutex
+		var current *models.ServiceRegistrySnapshot
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&requests, 0)
+			current = snapshot(1, instance("a:80"))
+			gateway = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				mu.Lock()
+				defer mu.Unlock()
+				json.NewEncoder(rw).Encode(current)
+			}))
+			w.RegistryURL = gateway.URL
+		})
+
+		AfterEach(func() {
+			gateway.Close()
+		})
+
+		It("should load the registry and follow changes", func() {
+			w.MinInterval = 10 * time.Millisecond
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			Expect(w.Start(ctx)).To(Succeed())
+			Expect(w.Pool("items").Services).To(HaveLen(1))
+
+			mu.Lock()
+			current = snapshot(2, instance("a:80"), instance("b:80"))
+			mu.Unlock()
+			Eventually(func() uint64 { return w.Version() }).Should(Equal(uint64(2)))
+			Expect(w.Pool("items").Services).To(HaveLen(2))
+		})
+
+		It("should not hot loop when long polls return immediately", func() {
+			w.MinInterval = 100 * time.Millisecond
+			ctx, cancel := context.WithCancel(context.Background())
+			Expect(w.Start(ctx)).To(Succeed())
+			time.Sleep(350 * time.Millisecond)
+			cancel()
+			Expect(atomic.LoadInt32(&requests)).To(BeNumerically("<=", 6))
+		})
+
+		It("should fall back to the persisted snapshot", func() {
+			dir, err := os.MkdirTemp("", "discovery")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+			w.SnapshotPath = filepath.Join(dir, "registry.json")
+			ctx, cancel := context.WithCancel(context.Background())
+			Expect(w.Start(ctx)).To(Succeed())
+			cancel()
+
+			gateway.Close()
+			offline := NewWatcher(gateway.URL)
+			offline.Client = w.Client
+			offline.SnapshotPath = w.SnapshotPath
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			Expect(offline.Start(ctx)).To(Succeed())
+			Expect(offline.Version()).To(Equal(uint64(1)))
+			Expect(offline.Pool("items").Services).To(HaveLen(1))
+		})
+	})
+})
@@ -1,6 +1,7 @@
 package errors
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/go-chi/render"
@@ -17,6 +18,10 @@ func (e *ErrResponse) Render(rw http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+func (e *ErrResponse) Error() string {
+	return fmt.Sprintf("%d %s (request id: %s)", e.HttpStatusCode, e.StatusText, e.RequestID)
+}
+
 func NoErr(tId string) render.Renderer {
 	return &ErrResponse{
 		RequestID:      tId,
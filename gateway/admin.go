@@ -0,0 +1,291 @@
+package gateway
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+	"gorm.io/gorm"
+)
+
+// Admin serves the operator API for the registry. Changes are applied to the
+// in-memory registry and, when DB is set, persisted to the services table.
+type Admin struct {
+	Registry *Registry
+	DB       *gorm.DB
+}
+
+type AdminService struct {
+	models.Service
+	Ejected        bool `json:"ejected"`
+	Ejections      int  `json:"ejections"`
+	Consecutive5xx int  `json:"consecutive_5xx"`
+}
+
+func NewAdmin(reg *Registry, db *gorm.DB) *Admin {
+	return &Admin{Registry: reg, DB: db}
+}
+
+// Routes mounts the admin API behind auth, defaulting to
+// middleware.ValidateHmac.
+func (a *Admin) Routes(auth func(next http.Handler) http.Handler) chi.Router {
+	if auth == nil {
+		auth = kit_middleware.ValidateHmac
+	}
+	r := chi.NewRouter()
+	r.Use(auth)
+	r.Get("/services", a.ListServices)
+	r.Post("/services/{id}/drain", a.DrainService)
+	r.Post("/services/{id}/enable", a.EnableService)
+	r.Post("/services/{id}/disable", a.DisableService)
+	r.Post("/services/{id}/healthcheck", a.CheckService)
+	r.Put("/pools/{name}/weights", a.SetWeights)
+	r.Get("/events", a.ListEvents)
+	return r
+}
+
+// AdminToken authenticates with "Authorization: Bearer <token>".
+func AdminToken(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			logger := kit_logger.GetLogEntry(r)
+			reqId := middleware.GetReqID(r.Context())
+			given, ok := bearerToken(r)
+			if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				logger.Error("invalid admin token. Forbidden request")
+				logger.Debug(render.Render(rw, r, kit_errors.ErrFobiddenRequest(reqId)))
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+func (a *Admin) ListServices(rw http.ResponseWriter, r *http.Request) {
+	var services []AdminService
+	for _, name := range a.Registry.Names() {
+		pool := a.Registry.Pool(name)
+		if pool == nil {
+			continue
+		}
+		stats := make(map[string]models.OutlierStats)
+		if pool.Outliers != nil {
+			for _, st := range pool.Outliers.Stats() {
+				stats[st.Instance] = st
+			}
+		}
+		for _, s := range pool.Services {
+			st := stats[s.InstanceKey()]
+			service := *s
+			service.OpenAPI = nil
+			services = append(services, AdminService{
+				Service:        service,
+				Ejected:        st.Ejected,
+				Ejections:      st.Ejections,
+				Consecutive5xx: st.Consecutive5xx,
+			})
+		}
+	}
+	render.JSON(rw, r, services)
+}
+
+func (a *Admin) DrainService(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
+		return
+	}
+	s := a.Registry.Drain(id)
+	if s == nil {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusNotFound, "service not found")))
+		return
+	}
+	if err := a.persist(id, map[string]interface{}{"service_online": false, "drained": true}); err != nil {
+		logger.Error("error persisting service: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+		return
+	}
+	logger.Info("service drained: ", s.BaseURL)
+	render.JSON(rw, r, s)
+}
+
+// EnableService undoes a drain or disable. A drained instance is health
+// checked back into rotation, a disabled one rejoins when it next registers.
+func (a *Admin) EnableService(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
+		return
+	}
+	s, pool := a.Registry.Enable(id)
+	if s == nil {
+		// disabled before a restart, only the db knows about it.
+		found, err := a.enableDisabled(id)
+		if err != nil {
+			logger.Error("error persisting service: ", err)
+			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+			return
+		}
+		if !found {
+			logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusNotFound, "service not found")))
+			return
+		}
+		logger.Info("service enabled: ", id)
+		render.JSON(rw, r, map[string]int{"id": id})
+		return
+	}
+	if pool == nil {
+		if _, err := a.enableDisabled(id); err != nil {
+			logger.Error("error persisting service: ", err)
+			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+			return
+		}
+		logger.Info("service enabled: ", s.BaseURL)
+		render.JSON(rw, r, s)
+		return
+	}
+
+	enabled := *s
+	enabled.Drained = false
+	pool.CheckService(&enabled)
+	// a renewal in between already registered it enabled.
+	a.Registry.Replace(s, &enabled)
+	if err := a.persist(id, map[string]interface{}{"service_online": enabled.ServiceOnline, "drained": false}); err != nil {
+		logger.Error("error persisting service: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+		return
+	}
+	a.Registry.Record("enabled", &enabled, "admin")
+	logger.Info("service enabled: ", enabled.BaseURL)
+	render.JSON(rw, r, &enabled)
+}
+
+func (a *Admin) CheckService(rw http.ResponseWriter, r *http.Request) {
+	a.updateService(rw, r, "checked", func(s *models.Service, pool *models.ServicePool) error {
+		pool.CheckService(s)
+		return a.persist(s.ID, map[string]interface{}{"service_online": s.ServiceOnline})
+	})
+}
+
+func (a *Admin) DisableService(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
+		return
+	}
+	s := a.Registry.Disable(id)
+	if s == nil {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusNotFound, "service not found")))
+		return
+	}
+	if err := a.persist(id, map[string]interface{}{"service_online": false, "disabled": true, "deleted_at": s.DeletedAt}); err != nil {
+		logger.Error("error persisting service: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+		return
+	}
+	logger.Info("service disabled: ", s.BaseURL)
+	render.JSON(rw, r, s)
+}
+
+func (a *Admin) SetWeights(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	var weights map[string]int
+	if err := render.DecodeJSON(r.Body, &weights); err != nil {
+		logger.Error("error decoding weights: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
+		return
+	}
+	policy, err := a.Registry.SetWeights(chi.URLParam(r, "name"), weights)
+	if err != nil {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusBadRequest, err.Error())))
+		return
+	}
+	if policy == nil {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusNotFound, "service not found")))
+		return
+	}
+	logger.Info("weights updated for ", chi.URLParam(r, "name"), ": ", weights)
+	render.JSON(rw, r, policy.Weights())
+}
+
+func (a *Admin) ListEvents(rw http.ResponseWriter, r *http.Request) {
+	render.JSON(rw, r, a.Registry.Events())
+}
+
+func (a *Admin) updateService(rw http.ResponseWriter, r *http.Request, event string, update func(*models.Service, *models.ServicePool) error) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
+		return
+	}
+	s, pool := a.Registry.Find(id)
+	if s == nil {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusNotFound, "service not found")))
+		return
+	}
+	// the update works on a copy, probes run outside the registry lock.
+	updated := *s
+	if err := update(&updated, pool); err != nil {
+		logger.Error("error persisting service: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+		return
+	}
+	if !a.Registry.Replace(s, &updated) {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusConflict, "service changed, try again")))
+		return
+	}
+	a.Registry.Record(event, &updated, "admin")
+	logger.Info("service ", event, ": ", updated.BaseURL)
+	render.JSON(rw, r, &updated)
+}
+
+// enableDisabled clears the disabled flag of the row with id, reporting
+// whether there was one.
+func (a *Admin) enableDisabled(id int) (bool, error) {
+	if a.DB == nil {
+		return false, nil
+	}
+	res := a.DB.Model(&models.Service{}).Where("id = ? AND disabled = ?", id, true).
+		Updates(map[string]interface{}{"disabled": false, "updated_at": time.Now()})
+	return res.RowsAffected > 0, res.Error
+}
+
+func (a *Admin) persist(id int, fields map[string]interface{}) error {
+	if a.DB == nil {
+		return nil
+	}
+	fields["updated_at"] = time.Now()
+	return a.DB.Model(&models.Service{}).Where("id = ?", id).Updates(fields).Error
+}
@@ -0,0 +1,147 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Admin Tests", func() {
+
+	var reg *Registry
+	var admin http.Handler
+
+	noAuth := func(next http.Handler) http.Handler { return next }
+
+	do := func(h http.Handler, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var b []byte
+		if body != nil {
+			b, _ = json.Marshal(body)
+		}
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest(method, path, bytes.NewReader(b))
+		r.Header.Set("Content-Type", "application/json")
+		h.ServeHTTP(rw, r)
+		return rw
+	}
+
+	renew := func(baseURL string) int {
+		return do(NewRegistrationHandler(reg, nil), "POST", "/register", models.Service{
+			ServiceName:     "items",
+			ServiceProtocol: "http",
+			ServiceVersion:  "v1",
+			ServiceOnline:   true,
+			BaseURL:         baseURL,
+		}).Code
+	}
+
+	BeforeEach(func() {
+		reg = NewRegistry()
+		admin = NewAdmin(reg, nil).Routes(noAuth)
+		Expect(renew("a:80")).To(Equal(200))
+		Expect(renew("b:80")).To(Equal(200))
+	})
+
+	It("should keep a drained instance drained when it renews", func() {
+		Expect(do(admin, "POST", "/services/1/drain", nil).Code).To(Equal(200))
+		Expect(reg.Pool("items").Services[0].Drained).To(BeTrue())
+
+		Expect(renew("a:80")).To(Equal(200))
+		s := reg.Pool("items").Services[0]
+		Expect(s.Drained).To(BeTrue())
+		Expect(s.ServiceOnline).To(BeFalse())
+		for i := 0; i < 4; i++ {
+			Expect(reg.Pool("items").GetNextPeer().BaseURL).To(Equal("b:80"))
+		}
+
+		Expect(do(admin, "POST", "/services/1/enable", nil).Code).To(Equal(200))
+		Expect(reg.Pool("items").Services[0].Drained).To(BeFalse())
+		Expect(renew("a:80")).To(Equal(200))
+		Expect(reg.Pool("items").Services[0].Drained).To(BeFalse())
+		// a:80 isn't reachable, the renewal keeps the health check's verdict.
+		Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeFalse())
+	})
+
+	It("should refuse a disabled instance when it renews", func() {
+		Expect(do(admin, "POST", "/services/1/disable", nil).Code).To(Equal(200))
+		Expect(reg.Pool("items").Services).To(HaveLen(1))
+
+		Expect(renew("a:80")).To(Equal(http.StatusForbidden))
+		Expect(reg.Pool("items").Services).To(HaveLen(1))
+		Expect(do(admin, "POST", "/services/1/drain", nil).Code).To(Equal(404))
+
+		Expect(do(admin, "POST", "/services/1/enable", nil).Code).To(Equal(200))
+		Expect(renew("a:80")).To(Equal(200))
+		Expect(reg.Pool("items").Services).To(HaveLen(2))
+	})
+
+	It("should answer 404 for unknown instances and pools", func() {
+		Expect(do(admin, "POST", "/services/9/drain", nil).Code).To(Equal(404))
+		Expect(do(admin, "POST", "/services/9/enable", nil).Code).To(Equal(404))
+		Expect(do(admin, "POST", "/services/9/disable", nil).Code).To(Equal(404))
+		Expect(do(admin, "PUT", "/pools/missing/weights", map[string]int{"v1": 1}).Code).To(Equal(404))
+	})
+
+	It("should set weights while traffic is routed", func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				r := httptest.NewRequest("GET", "/", nil)
+				reg.Pool("items").GetPeerForRequest(nil, r)
+			}
+		}()
+		for i := 1; i <= 10; i++ {
+			rw := do(admin, "PUT", "/pools/items/weights", map[string]int{"v1": i})
+			Expect(rw.Code).To(Equal(200))
+			Expect(rw.Body.String()).To(MatchJSON(fmt.Sprintf(`{"v1": %d}`, i)))
+		}
+		wg.Wait()
+		Expect(reg.Pool("items").Policy.Weights()).To(Equal(map[string]int{"v1": 10}))
+		Expect(do(admin, "PUT", "/pools/items/weights", map[string]int{"v1": 0}).Code).To(Equal(400))
+	})
+
+	It("should list instances with their outlier stats", func() {
+		od := reg.NewOutlierDetector("items")
+		od.ReportStatus(reg.Pool("items").Services[0], 500)
+		var services []AdminService
+		Expect(json.Unmarshal(do(admin, "GET", "/services", nil).Body.Bytes(), &services)).To(Succeed())
+		Expect(services).To(HaveLen(2))
+		Expect(services[0].Consecutive5xx).To(Equal(1))
+
+		// a renewal replaces the instance, the stats follow its key.
+		Expect(renew("a:80")).To(Equal(200))
+		services = nil
+		Expect(json.Unmarshal(do(admin, "GET", "/services", nil).Body.Bytes(), &services)).To(Succeed())
+		Expect(services[0].Consecutive5xx).To(Equal(1))
+		Expect(services[1].Consecutive5xx).To(Equal(0))
+	})
+
+	It("should only accept the admin token as a bearer token", func() {
+		h := NewAdmin(reg, nil).Routes(AdminToken("secret"))
+		for header, code := range map[string]int{
+			"Bearer secret": 200,
+			"secret":        401,
+			"Basic secret":  401,
+			"Bearer ":       401,
+			"":              401,
+		} {
+			rw := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/services", nil)
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			h.ServeHTTP(rw, r)
+			Expect(rw.Code).To(Equal(code), header)
+		}
+		Expect(do(NewAdmin(reg, nil).Routes(AdminToken("")), "GET", "/services", nil).Code).To(Equal(401))
+	})
+})
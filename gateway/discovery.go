@@ -0,0 +1,36 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/render"
+)
+
+const maxLongPoll = 60 * time.Second
+
+// DiscoveryHandler serves the registry snapshot to discovery clients. With
+// ?version=N&wait=30s it long-polls until the registry is newer than N.
+type DiscoveryHandler struct {
+	Registry *Registry
+}
+
+func NewDiscoveryHandler(reg *Registry) *DiscoveryHandler {
+	return &DiscoveryHandler{Registry: reg}
+}
+
+func (h *DiscoveryHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if wait, err := time.ParseDuration(q.Get("wait")); err == nil && wait > 0 {
+		if wait > maxLongPoll {
+			wait = maxLongPoll
+		}
+		version, _ := strconv.ParseUint(q.Get("version"), 10, 64)
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		h.Registry.Wait(ctx, version)
+		cancel()
+	}
+	render.JSON(rw, r, h.Registry.Snapshot())
+}
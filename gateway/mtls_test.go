@@ -0,0 +1,99 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Gateway mTLS Tests", func() {
+
+	var backend *httptest.Server
+	var reg *Registry
+	var clientTLS *tls.Config
+
+	BeforeEach(func() {
+		backend = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/health" {
+				json.NewEncoder(rw).Encode(models.Heartbeat{Message: "healthy"})
+				return
+			}
+			io.WriteString(rw, r.URL.Path)
+		}))
+		backend.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+		backend.StartTLS()
+
+		// the backend's own key pair doubles as the gateway's client cert.
+		clientTLS = backend.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		clientTLS.Certificates = backend.TLS.Certificates
+
+		reg = NewRegistry()
+		reg.Register(&models.Service{
+			ServiceName:     "items",
+			ServiceProtocol: "https",
+			ServiceVersion:  "v1",
+			ServiceOnline:   true,
+			BaseURL:         strings.TrimPrefix(backend.URL, "https://"),
+			Routes:          []byte(`{"health": "/health"}`),
+		})
+		reg.SetTLSConfig(clientTLS)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	It("should proxy with the registry's client tls", func() {
+		front := httptest.NewServer(NewProxy(reg).Handler("items"))
+		defer front.Close()
+		resp, err := http.Get(front.URL + "/hello")
+		Expect(err).To(BeNil())
+		body, _ := io.ReadAll(resp.Body)
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(string(body)).To(Equal("/v1/hello"))
+	})
+
+	It("should fail without a client certificate", func() {
+		proxy := NewProxy(reg)
+		proxy.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+		front := httptest.NewServer(proxy.Handler("items"))
+		defer front.Close()
+		resp, err := http.Get(front.URL + "/hello")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+	})
+
+	It("should pick up a tls config set after the handler was built", func() {
+		reg.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+		front := httptest.NewServer(NewProxy(reg).Handler("items"))
+		defer front.Close()
+		resp, err := http.Get(front.URL + "/hello")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+
+		reg.SetTLSConfig(clientTLS)
+		resp, err = http.Get(front.URL + "/hello")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(200))
+	})
+
+	It("should collect status with the registry's client tls", func() {
+		status := NewStatusHandler(reg).Collect(context.Background(), "req-1")
+		Expect(status.Services).To(HaveLen(1))
+		Expect(status.Services[0].Message).To(Equal("healthy"))
+	})
+
+	It("should health check with the registry's client tls", func() {
+		pool := reg.Pool("items")
+		Expect(pool.TLSConfig).NotTo(BeNil())
+		Expect(pool.CheckService(pool.Services[0])).To(BeTrue())
+	})
+})
@@ -0,0 +1,262 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var componentNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// OpenAPIHandler merges the OpenAPI documents published by registered
+// services into one document. Paths are prefixed per service and version,
+// components that clash with a different definition are renamed with the
+// same prefix and their refs rewritten.
+type OpenAPIHandler struct {
+	Registry *Registry
+	Title    string
+	Version  string
+	// defaults to /{service_name}/{service_version}.
+	PathPrefix func(s *models.Service) string
+	// url of the merged document, used by the viewer.
+	SpecURL string
+	// where the viewer loads swagger-ui-dist from, i.e. a self hosted copy
+	// when the gateway can't reach the CDN.
+	AssetsURL string
+}
+
+func NewOpenAPIHandler(reg *Registry) *OpenAPIHandler {
+	return &OpenAPIHandler{
+		Registry:  reg,
+		Title:     "Gateway API",
+		Version:   "1.0.0",
+		SpecURL:   "/openapi.json",
+		AssetsURL: "https://unpkg.com/swagger-ui-dist@5",
+	}
+}
+
+func (h *OpenAPIHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	render.JSON(rw, r, h.Merge())
+}
+
+// Viewer serves a page rendering the merged document.
+func (h *OpenAPIHandler) Viewer(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		Title, SpecURL, AssetsURL string
+	}{h.Title, h.SpecURL, strings.TrimSuffix(h.AssetsURL, "/")}
+	if err := openAPIViewer.Execute(rw, data); err != nil {
+		log.Printf("error rendering openapi viewer: %v", err)
+	}
+}
+
+func (h *OpenAPIHandler) Merge() map[string]interface{} {
+	paths := map[string]interface{}{}
+	components := map[string]map[string]interface{}{}
+	var tags []interface{}
+
+	for _, s := range h.documented() {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(s.OpenAPI, &doc); err != nil {
+			log.Printf("skipping openapi document of %s %s: %v", s.ServiceName, s.ServiceVersion, err)
+			continue
+		}
+		prefix := h.prefix(s)
+		tag := s.ServiceName + " " + s.ServiceVersion
+
+		mergeComponents(components, doc, componentPrefix(s))
+
+		docPaths, _ := doc["paths"].(map[string]interface{})
+		for p, item := range docPaths {
+			tagOperations(item, tag)
+			paths[prefix+p] = item
+		}
+		tags = append(tags, map[string]interface{}{"name": tag, "description": s.ServiceSummary})
+	}
+
+	merged := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   h.Title,
+			"version": h.Version,
+		},
+		"paths": paths,
+		"tags":  tags,
+	}
+	if len(components) > 0 {
+		merged["components"] = components
+	}
+	return merged
+}
+
+// documented returns one instance per service name and version that
+// published a document, in a stable order.
+func (h *OpenAPIHandler) documented() []*models.Service {
+	seen := map[string]bool{}
+	var services []*models.Service
+	for _, s := range h.Registry.Services() {
+		key := s.ServiceName + "|" + s.ServiceVersion
+		if len(s.OpenAPI) == 0 || seen[key] {
+			continue
+		}
+		seen[key] = true
+		services = append(services, s)
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		if services[i].ServiceName == services[j].ServiceName {
+			return services[i].ServiceVersion < services[j].ServiceVersion
+		}
+		return services[i].ServiceName < services[j].ServiceName
+	})
+	return services
+}
+
+func (h *OpenAPIHandler) prefix(s *models.Service) string {
+	if h.PathPrefix != nil {
+		return strings.TrimSuffix(h.PathPrefix(s), "/")
+	}
+	prefix := "/" + s.ServiceName
+	if s.ServiceVersion != "" {
+		prefix += "/" + s.ServiceVersion
+	}
+	return prefix
+}
+
+func componentPrefix(s *models.Service) string {
+	return componentNameChars.ReplaceAllString(s.ServiceName+"_"+s.ServiceVersion+"_", "_")
+}
+
+// mergeComponents adds the doc's components to merged and rewrites the doc's
+// refs to them. Identical definitions are shared, clashing ones are renamed.
+// Definitions are compared with their refs rewritten, so renaming one
+// component can make the ones referring to it clash too; this is repeated
+// until no more renames are needed.
+func mergeComponents(merged map[string]map[string]interface{}, doc map[string]interface{}, prefix string) {
+	docComponents, _ := doc["components"].(map[string]interface{})
+	renames := map[string]string{}
+	for changed := true; changed; {
+		changed = false
+		for kind, defs := range docComponents {
+			defMap, _ := defs.(map[string]interface{})
+			for name, def := range defMap {
+				ref := fmt.Sprintf("#/components/%s/%s", kind, name)
+				existing, clash := merged[kind][name]
+				if !clash || renames[ref] != "" {
+					continue
+				}
+				rewritten := copyJSON(def)
+				rewriteRefs(rewritten, renames)
+				if !reflect.DeepEqual(existing, rewritten) {
+					renames[ref] = fmt.Sprintf("#/components/%s/%s", kind, prefix+name)
+					changed = true
+				}
+			}
+		}
+	}
+	if len(renames) > 0 {
+		rewriteRefs(doc, renames)
+	}
+
+	for kind, defs := range docComponents {
+		defMap, ok := defs.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if merged[kind] == nil {
+			merged[kind] = map[string]interface{}{}
+		}
+		for name, def := range defMap {
+			if renamed, ok := renames[fmt.Sprintf("#/components/%s/%s", kind, name)]; ok {
+				merged[kind][strings.TrimPrefix(renamed, "#/components/"+kind+"/")] = def
+				continue
+			}
+			if _, clash := merged[kind][name]; !clash {
+				merged[kind][name] = def
+			}
+		}
+	}
+}
+
+func copyJSON(node interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			copied[k] = copyJSON(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, child := range v {
+			copied[i] = copyJSON(child)
+		}
+		return copied
+	}
+	return node
+}
+
+// rewriteRefs replaces every $ref found in renames, in place.
+func rewriteRefs(node interface{}, renames map[string]string) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ref, ok := child.(string); ok && k == "$ref" {
+				if renamed, ok := renames[ref]; ok {
+					v[k] = renamed
+				}
+				continue
+			}
+			rewriteRefs(child, renames)
+		}
+	case []interface{}:
+		for _, child := range v {
+			rewriteRefs(child, renames)
+		}
+	}
+}
+
+func tagOperations(item interface{}, tag string) {
+	ops, ok := item.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for method, op := range ops {
+		switch method {
+		case "get", "put", "post", "delete", "options", "head", "patch", "trace":
+		default:
+			continue
+		}
+		if opMap, ok := op.(map[string]interface{}); ok {
+			tags, _ := opMap["tags"].([]interface{})
+			opMap["tags"] = append(tags, tag)
+		}
+	}
+}
+
+var openAPIViewer = template.Must(template.New("openapi").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<link rel="stylesheet" href="{{.AssetsURL}}/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="{{.AssetsURL}}/swagger-ui-bundle.js"></script>
+<script>
+window.onload = function() {
+  SwaggerUIBundle({ url: "{{.SpecURL}}", dom_id: "#swagger-ui" });
+};
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,95 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("OpenAPI Tests", func() {
+
+	var reg *Registry
+	var handler *OpenAPIHandler
+
+	register := func(name, version, doc string) {
+		reg.Register(&models.Service{
+			ServiceName:    name,
+			ServiceVersion: version,
+			BaseURL:        name + "-" + version + ":80",
+			OpenAPI:        []byte(doc),
+		})
+	}
+
+	schemas := func(merged map[string]interface{}) map[string]interface{} {
+		return merged["components"].(map[string]map[string]interface{})["schemas"]
+	}
+
+	ref := func(merged map[string]interface{}, path string) string {
+		op := merged["paths"].(map[string]interface{})[path].(map[string]interface{})["get"].(map[string]interface{})
+		content := op["responses"].(map[string]interface{})["200"].(map[string]interface{})["content"].(map[string]interface{})
+		return content["application/json"].(map[string]interface{})["schema"].(map[string]interface{})["$ref"].(string)
+	}
+
+	doc := func(itemType string) string {
+		return `{
+			"paths": {"/items": {"get": {"responses": {"200": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/List"}}}}}}}},
+			"components": {"schemas": {
+				"List": {"type": "array", "items": {"$ref": "#/components/schemas/Item"}},
+				"Item": {"type": "` + itemType + `"},
+				"Error": {"type": "string"}
+			}}
+		}`
+	}
+
+	BeforeEach(func() {
+		reg = NewRegistry()
+		handler = NewOpenAPIHandler(reg)
+	})
+
+	It("should prefix paths and share identical components", func() {
+		register("items", "v1", doc("object"))
+		register("orders", "v1", doc("object"))
+		merged := handler.Merge()
+		Expect(merged["paths"]).To(HaveKey("/items/v1/items"))
+		Expect(merged["paths"]).To(HaveKey("/orders/v1/items"))
+		Expect(schemas(merged)).To(HaveLen(3))
+		Expect(ref(merged, "/orders/v1/items")).To(Equal("#/components/schemas/List"))
+	})
+
+	It("should rename components whose refs point to renamed components", func() {
+		register("items", "v1", doc("object"))
+		register("orders", "v1", doc("string"))
+		merged := handler.Merge()
+		Expect(schemas(merged)).To(HaveKey("orders_v1_Item"))
+		// List is identical text but refers to a different Item.
+		Expect(schemas(merged)).To(HaveKey("orders_v1_List"))
+		Expect(schemas(merged)).NotTo(HaveKey("orders_v1_Error"))
+		Expect(ref(merged, "/items/v1/items")).To(Equal("#/components/schemas/List"))
+		Expect(ref(merged, "/orders/v1/items")).To(Equal("#/components/schemas/orders_v1_List"))
+		list := schemas(merged)["orders_v1_List"].(map[string]interface{})
+		Expect(list["items"]).To(Equal(map[string]interface{}{"$ref": "#/components/schemas/orders_v1_Item"}))
+	})
+
+	It("should serve the viewer from the configured assets", func() {
+		handler.AssetsURL = "/static/swagger-ui/"
+		rw := httptest.NewRecorder()
+		handler.Viewer(rw, httptest.NewRequest("GET", "/docs", nil))
+		Expect(rw.Body.String()).To(ContainSubstring(`src="/static/swagger-ui/swagger-ui-bundle.js"`))
+		Expect(rw.Body.String()).NotTo(ContainSubstring("unpkg.com"))
+	})
+
+	It("should keep documents out of discovery snapshots and admin listings", func() {
+		register("items", "v1", doc("object"))
+		Expect(reg.Snapshot().Services[0].OpenAPI).To(BeNil())
+		b, _ := json.Marshal(reg.Snapshot())
+		Expect(string(b)).NotTo(ContainSubstring("openapi"))
+
+		rw := httptest.NewRecorder()
+		NewAdmin(reg, nil).ListServices(rw, httptest.NewRequest("GET", "/services", nil))
+		Expect(rw.Body.String()).NotTo(ContainSubstring("openapi"))
+		Expect(reg.Pool("items").Services[0].OpenAPI).NotTo(BeNil())
+	})
+})
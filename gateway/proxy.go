@@ -0,0 +1,290 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+type peerCtxKey struct{}
+
+// Proxy forwards requests to a peer of the named service. Peers are picked
+// with the pool's traffic policy and their results feed the pool's outlier
+// detector. WebSocket upgrades, server-sent events and chunked responses are
+// passed through and flushed as they arrive.
+//
+// The path is forwarded under the peer's version, which breaks v2 hmac
+// signatures since they cover the path. For services validating hmac set
+// Sign: the caller's signature headers are dropped and the request is signed
+// again with the gateway's key, the gateway authenticates the caller itself.
+type Proxy struct {
+	Registry *Registry
+	// closes upstream connections, including upgraded ones, that see no
+	// traffic for this long.
+	IdleTimeout time.Duration
+	// optional, replaces the default transport.
+	Transport http.RoundTripper
+	// used by the default transport, i.e. for mTLS to the services.
+	// Defaults to the registry's tls config. The default transport is
+	// rebuilt when the config changes, so Registry.SetTLSConfig reaches
+	// handlers that already exist.
+	TLSConfig *tls.Config
+	// optional, signs proxied requests, see httpclient.NewSigningTransport.
+	// Read when a handler is built, like Transport.
+	Sign httpclient.SigningKeyFunc
+
+	active   int64
+	upgrades int64
+	streams  int64
+	total    int64
+}
+
+type ProxyStats struct {
+	Active   int64 `json:"active"`
+	Upgrades int64 `json:"upgrades"`
+	Streams  int64 `json:"streams"`
+	Total    int64 `json:"total"`
+}
+
+func NewProxy(reg *Registry) *Proxy {
+	return &Proxy{
+		Registry:    reg,
+		IdleTimeout: 5 * time.Minute,
+	}
+}
+
+func (p *Proxy) Stats() ProxyStats {
+	return ProxyStats{
+		Active:   atomic.LoadInt64(&p.active),
+		Upgrades: atomic.LoadInt64(&p.upgrades),
+		Streams:  atomic.LoadInt64(&p.streams),
+		Total:    atomic.LoadInt64(&p.total),
+	}
+}
+
+// Handler proxies to serviceName. The request path is forwarded relative to
+// the peer's version, like the service routes.
+func (p *Proxy) Handler(serviceName string) http.Handler {
+	rp := &httputil.ReverseProxy{
+		Director:       p.director,
+		Transport:      p.transport(),
+		FlushInterval:  -1,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.errorHandler,
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		logger := kit_logger.GetLogEntry(r)
+		reqId := middleware.GetReqID(r.Context())
+
+		pool := p.Registry.Pool(serviceName)
+		var peer *models.Service
+		if pool != nil {
+			peer = pool.GetPeerForRequest(rw, r)
+		}
+		if peer == nil {
+			logger.Error("no peer available for ", serviceName)
+			logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusServiceUnavailable, "service unavailable")))
+			return
+		}
+
+		atomic.AddInt64(&p.total, 1)
+		atomic.AddInt64(&p.active, 1)
+		defer atomic.AddInt64(&p.active, -1)
+
+		ctx := context.WithValue(r.Context(), peerCtxKey{}, &proxiedPeer{pool: pool, service: peer})
+		rp.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+type proxiedPeer struct {
+	pool    *models.ServicePool
+	service *models.Service
+}
+
+func (p *Proxy) director(r *http.Request) {
+	peer := r.Context().Value(peerCtxKey{}).(*proxiedPeer).service
+	scheme := peer.ServiceProtocol
+	if scheme == "" {
+		scheme = "http"
+	}
+	target := &url.URL{Scheme: scheme, Host: peer.BaseURL}
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	if peer.ServiceVersion != "" {
+		r.URL.Path = "/" + peer.ServiceVersion + r.URL.Path
+		r.URL.RawPath = ""
+	}
+	r.Host = target.Host
+	if p.Sign != nil {
+		for _, h := range signatureHeaders() {
+			r.Header.Del(h)
+		}
+	}
+	if reqId := middleware.GetReqID(r.Context()); reqId != "" {
+		r.Header.Set(middleware.RequestIDHeader, reqId)
+	}
+}
+
+// signatureHeaders are the hmac request headers, see utils.SignRequest.
+func signatureHeaders() []string {
+	h := utils.DefaultHmacHeaderNames()
+	return []string{h.Hash, h.Version, h.Timestamp, h.Nonce, h.KeyID, h.ClientID}
+}
+
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	peer := resp.Request.Context().Value(peerCtxKey{}).(*proxiedPeer)
+	if peer.pool.Outliers != nil {
+		peer.pool.Outliers.ReportStatus(peer.service, resp.StatusCode)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+			atomic.AddInt64(&p.upgrades, 1)
+			resp.Body = &countedConn{ReadWriteCloser: rwc, counter: &p.upgrades}
+		}
+	case isStream(resp):
+		atomic.AddInt64(&p.streams, 1)
+		resp.Body = &countedBody{ReadCloser: resp.Body, counter: &p.streams}
+	}
+	return nil
+}
+
+func (p *Proxy) errorHandler(rw http.ResponseWriter, r *http.Request, err error) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	if peer, ok := r.Context().Value(peerCtxKey{}).(*proxiedPeer); ok && peer.pool.Outliers != nil && r.Context().Err() == nil {
+		peer.pool.Outliers.ReportError(peer.service, err)
+	}
+	logger.Error("error proxying request: ", err)
+	logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusBadGateway, "bad gateway")))
+}
+
+func (p *Proxy) transport() http.RoundTripper {
+	t := p.Transport
+	if t == nil {
+		t = &tlsTransport{proxy: p}
+	}
+	if p.Sign != nil {
+		t = httpclient.NewSigningTransport(t, p.Sign)
+	}
+	return t
+}
+
+func (p *Proxy) tlsConfig() *tls.Config {
+	if p.TLSConfig == nil && p.Registry != nil {
+		return p.Registry.TLSConfig()
+	}
+	return p.TLSConfig
+}
+
+func (p *Proxy) newTransport(cfg *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || p.IdleTimeout == 0 {
+			return conn, err
+		}
+		return &idleConn{Conn: conn, timeout: p.IdleTimeout}, nil
+	}
+	return t
+}
+
+// tlsTransport is the default transport. It looks up the tls config on
+// every request and switches to a new transport when it changed, closing
+// the idle connections made with the old one.
+type tlsTransport struct {
+	proxy *Proxy
+
+	mu  sync.Mutex
+	cfg *tls.Config
+	t   *http.Transport
+}
+
+func (tt *tlsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return tt.current().RoundTrip(r)
+}
+
+func (tt *tlsTransport) current() *http.Transport {
+	cfg := tt.proxy.tlsConfig()
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if tt.t == nil || cfg != tt.cfg {
+		if tt.t != nil {
+			tt.t.CloseIdleConnections()
+		}
+		tt.cfg = cfg
+		tt.t = tt.proxy.newTransport(cfg)
+	}
+	return tt.t
+}
+
+func isStream(resp *http.Response) bool {
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return true
+	}
+	return resp.ContentLength == -1 && len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+}
+
+// idleConn pushes its deadline forward on every read and write, so only
+// connections without traffic time out.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+type countedBody struct {
+	io.ReadCloser
+	counter *int64
+	closed  int32
+}
+
+func (b *countedBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		atomic.AddInt64(b.counter, -1)
+	}
+	return b.ReadCloser.Close()
+}
+
+type countedConn struct {
+	io.ReadWriteCloser
+	counter *int64
+	closed  int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.counter, -1)
+	}
+	return c.ReadWriteCloser.Close()
+}
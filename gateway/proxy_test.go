@@ -0,0 +1,146 @@
+package gateway
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Proxy Tests", func() {
+
+	var backend, front *httptest.Server
+	var proxy *Proxy
+
+	BeforeEach(func() {
+		backend = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/v1/ws":
+				conn, buf, _ := rw.(http.Hijacker).Hijack()
+				defer conn.Close()
+				fmt.Fprint(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+				buf.Flush()
+				line, _ := buf.ReadString('\n')
+				fmt.Fprint(buf, line)
+				buf.Flush()
+			case "/v1/events":
+				rw.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(rw, "data: one\n\n")
+				rw.(http.Flusher).Flush()
+			default:
+				fmt.Fprint(rw, r.URL.Path)
+			}
+		}))
+
+		reg := NewRegistry()
+		reg.Register(&models.Service{
+			ServiceName:     "echo",
+			ServiceProtocol: "http",
+			ServiceVersion:  "v1",
+			ServiceOnline:   true,
+			BaseURL:         strings.TrimPrefix(backend.URL, "http://"),
+		})
+		proxy = NewProxy(reg)
+		front = httptest.NewServer(proxy.Handler("echo"))
+	})
+
+	AfterEach(func() {
+		front.Close()
+		backend.Close()
+	})
+
+	It("should forward relative to the peer version", func() {
+		resp, err := http.Get(front.URL + "/hello")
+		Expect(err).To(BeNil())
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(Equal("/v1/hello"))
+	})
+
+	It("should pass server-sent events through", func() {
+		resp, err := http.Get(front.URL + "/events")
+		Expect(err).To(BeNil())
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(Equal("data: one\n\n"))
+		Expect(proxy.Stats().Total).To(Equal(int64(1)))
+	})
+
+	It("should pass upgraded connections through", func() {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(front.URL, "http://"))
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: front\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(101))
+		Expect(proxy.Stats().Upgrades).To(Equal(int64(1)))
+
+		fmt.Fprint(conn, "ping\n")
+		line, err := reader.ReadString('\n')
+		Expect(err).To(BeNil())
+		Expect(line).To(Equal("ping\n"))
+	})
+
+	It("should return 503 without peers", func() {
+		rw := httptest.NewRecorder()
+		proxy.Handler("missing").ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		Expect(rw.Code).To(Equal(503))
+	})
+
+	Context("with a service validating hmac", func() {
+
+		var signed *httptest.Server
+
+		BeforeEach(func() {
+			validator := kit_middleware.NewHmacValidator(kit_middleware.HmacOptions{
+				Keys:   kit_middleware.StaticKeys(&models.HmacKeys{Name: "default", Keys: []models.Key{{ID: "gw", Value: "gatewaysecretvalue"}}}),
+				Nonces: kit_middleware.NewMemoryNonceStore(10),
+			})
+			signed = httptest.NewServer(validator.Validate(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				fmt.Fprint(rw, r.URL.Path, " ", string(body))
+			})))
+			proxy.Registry.Register(&models.Service{
+				ServiceName:     "signed",
+				ServiceProtocol: "http",
+				ServiceVersion:  "v1",
+				ServiceOnline:   true,
+				BaseURL:         strings.TrimPrefix(signed.URL, "http://"),
+			})
+		})
+
+		AfterEach(func() {
+			signed.Close()
+		})
+
+		post := func(h http.Handler) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("POST", "/items", strings.NewReader(`{"id": 7}`))
+			Expect(utils.SignRequestWithKeyID(r, "gw", "gatewaysecretvalue")).To(Succeed())
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, r)
+			return rw
+		}
+
+		It("should fail the caller's signature, the path gains the version", func() {
+			Expect(post(proxy.Handler("signed")).Code).To(Equal(401))
+		})
+
+		It("should sign again with the gateway's key", func() {
+			proxy.Sign = func() (string, string, error) { return "gw", "gatewaysecretvalue", nil }
+			rw := post(proxy.Handler("signed"))
+			Expect(rw.Code).To(Equal(200))
+			Expect(rw.Body.String()).To(Equal(`/v1/items {"id": 7}`))
+		})
+	})
+})
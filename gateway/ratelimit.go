@@ -0,0 +1,388 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+)
+
+type Algorithm int
+
+const (
+	TokenBucket Algorithm = iota
+	SlidingWindow
+)
+
+// Limit allows Requests per Window. A token bucket refills continuously and
+// allows bursts up to Burst, a sliding window is better suited to quotas
+// like 10000 a day.
+type Limit struct {
+	Algorithm Algorithm
+	Requests  int
+	Window    time.Duration
+	// token bucket capacity, defaults to Requests.
+	Burst int
+}
+
+type LimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// LimitStore keeps limit state. MemoryLimitStore works for a single gateway,
+// a shared store is needed to enforce limits across replicas. Refund gives
+// back a request Allow counted, used when a later rule rejects the request.
+type LimitStore interface {
+	Allow(ctx context.Context, key string, limit Limit) (LimitResult, error)
+	Refund(ctx context.Context, key string, limit Limit) error
+}
+
+// ClientKey identifies the caller a limit applies to.
+type ClientKey func(r *http.Request) string
+
+// ByIP uses the address of the peer. Behind a load balancer use
+// ByForwardedIP, X-Forwarded-For is set by the client otherwise.
+func ByIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ByForwardedIP uses X-Forwarded-For when the peer is one of the trusted
+// proxies, given as CIDRs or addresses. The header is read right to left,
+// skipping trusted proxies, so a client can't pick its own key by sending
+// the header itself.
+func ByForwardedIP(trusted ...string) (ClientKey, error) {
+	var nets []*net.IPNet
+	for _, t := range trusted {
+		if !strings.Contains(t, "/") {
+			if ip := net.ParseIP(t); ip != nil && ip.To4() != nil {
+				t += "/32"
+			} else {
+				t += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(t)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing trusted proxy: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	isTrusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(r *http.Request) string {
+		client := ByIP(r)
+		if !isTrusted(client) {
+			return client
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			client = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+		return client
+	}, nil
+}
+
+// ByCaller uses the keyset a request was validated with, see
+// middleware.GetCaller. Requests validated with the default keyset share
+// the "" key.
+func ByCaller(r *http.Request) string {
+	return kit_middleware.GetCaller(r.Context())
+}
+
+func ByHeader(header string) ClientKey {
+	return func(r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+var ByAPIKey = ByHeader("X-API-KEY")
+
+// RateRule applies a limit per client to a service route. Empty Service or
+// Route match everything.
+type RateRule struct {
+	Service string
+	Route   string
+	Limit   Limit
+	Key     ClientKey
+}
+
+type RateLimiter struct {
+	Store LimitStore
+	Rules []RateRule
+}
+
+func NewRateLimiter(store LimitStore, rules ...RateRule) *RateLimiter {
+	if store == nil {
+		store = NewMemoryLimitStore()
+	}
+	return &RateLimiter{Store: store, Rules: rules}
+}
+
+// Middleware enforces the rules matching service and route. Every matching
+// rule must allow the request; the most restrictive one sets the headers.
+// When a rule rejects the request, the rules that already counted it are
+// refunded, a rejected request doesn't use up another rule's quota.
+func (rl *RateLimiter) Middleware(service, route string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			logger := kit_logger.GetLogEntry(r)
+			reqId := middleware.GetReqID(r.Context())
+
+			type counted struct {
+				key   string
+				limit Limit
+			}
+			var taken []counted
+			var tightest *LimitResult
+			for i, rule := range rl.Rules {
+				if !rule.matches(service, route) {
+					continue
+				}
+				client := "all"
+				if rule.Key != nil {
+					client = rule.Key(r)
+				}
+				key := strings.Join([]string{strconv.Itoa(i), service, route, client}, "|")
+				res, err := rl.Store.Allow(r.Context(), key, rule.Limit)
+				if err != nil {
+					// fail open, the limiter shouldn't take down the gateway.
+					logger.Error("error checking rate limit: ", err)
+					continue
+				}
+				if tightest == nil || !res.Allowed || (tightest.Allowed && res.Remaining < tightest.Remaining) {
+					tightest = &res
+				}
+				if !res.Allowed {
+					logger.Info("rate limit exceeded for ", client, " on ", service, " ", route)
+					break
+				}
+				taken = append(taken, counted{key: key, limit: rule.Limit})
+			}
+
+			if tightest == nil {
+				next.ServeHTTP(rw, r)
+				return
+			}
+			setRateLimitHeaders(rw, tightest)
+			if !tightest.Allowed {
+				for _, t := range taken {
+					if err := rl.Store.Refund(r.Context(), t.key, t.limit); err != nil {
+						logger.Error("error refunding rate limit: ", err)
+					}
+				}
+				rw.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+				logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusTooManyRequests, "too many requests")))
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func (rule RateRule) matches(service, route string) bool {
+	return (rule.Service == "" || rule.Service == service) && (rule.Route == "" || rule.Route == route)
+}
+
+func setRateLimitHeaders(rw http.ResponseWriter, res *LimitResult) {
+	rw.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	rw.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	rw.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+var ErrInvalidLimit = errors.New("rate limit needs positive requests and window")
+
+// MemoryLimitStore keeps state per client key. Keys that have gone idle long
+// enough to be back at a fresh state are swept every SweepInterval.
+type MemoryLimitStore struct {
+	SweepInterval time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	windows   map[string]*slidingWindow
+	nextSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// when the bucket is full again.
+	expires time.Time
+}
+
+type slidingWindow struct {
+	start    time.Time
+	previous int
+	current  int
+	// when both windows are empty again.
+	expires time.Time
+}
+
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{
+		SweepInterval: time.Minute,
+		buckets:       make(map[string]*tokenBucket),
+		windows:       make(map[string]*slidingWindow),
+	}
+}
+
+func (m *MemoryLimitStore) Allow(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+	if limit.Requests <= 0 || limit.Window <= 0 {
+		return LimitResult{}, ErrInvalidLimit
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.After(m.nextSweep) {
+		m.sweep(now)
+		m.nextSweep = now.Add(m.SweepInterval)
+	}
+	if limit.Algorithm == SlidingWindow {
+		return m.allowWindow(now, key, limit), nil
+	}
+	return m.allowBucket(now, key, limit), nil
+}
+
+func (m *MemoryLimitStore) Refund(ctx context.Context, key string, limit Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit.Algorithm == SlidingWindow {
+		if w, ok := m.windows[key]; ok && w.current > 0 {
+			w.current--
+		}
+		return nil
+	}
+	if b, ok := m.buckets[key]; ok {
+		capacity := float64(limit.Burst)
+		if capacity == 0 {
+			capacity = float64(limit.Requests)
+		}
+		b.tokens = math.Min(capacity, b.tokens+1)
+	}
+	return nil
+}
+
+// Len returns the number of keys tracked.
+func (m *MemoryLimitStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.buckets) + len(m.windows)
+}
+
+// must be called with the lock held.
+func (m *MemoryLimitStore) sweep(now time.Time) {
+	for key, b := range m.buckets {
+		if now.After(b.expires) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, w := range m.windows {
+		if now.After(w.expires) {
+			delete(m.windows, key)
+		}
+	}
+}
+
+func (m *MemoryLimitStore) allowBucket(now time.Time, key string, limit Limit) LimitResult {
+	capacity := float64(limit.Burst)
+	if capacity == 0 {
+		capacity = float64(limit.Requests)
+	}
+	rate := float64(limit.Requests) / limit.Window.Seconds()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	res := LimitResult{Limit: int(capacity)}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	b.expires = now.Add(res.Reset)
+	return res
+}
+
+// allowWindow uses a sliding window counter: the previous window's count is
+// weighted by how much of it still overlaps the sliding window.
+func (m *MemoryLimitStore) allowWindow(now time.Time, key string, limit Limit) LimitResult {
+	w, ok := m.windows[key]
+	if !ok {
+		w = &slidingWindow{start: now.Truncate(limit.Window)}
+		m.windows[key] = w
+	}
+	start := now.Truncate(limit.Window)
+	switch elapsed := start.Sub(w.start); {
+	case elapsed >= 2*limit.Window:
+		w.previous, w.current = 0, 0
+	case elapsed >= limit.Window:
+		w.previous, w.current = w.current, 0
+	}
+	w.start = start
+	w.expires = start.Add(2 * limit.Window)
+
+	overlap := 1 - float64(now.Sub(start))/float64(limit.Window)
+	used := float64(w.previous)*overlap + float64(w.current)
+	reset := start.Add(limit.Window).Sub(now)
+
+	res := LimitResult{Limit: limit.Requests, Reset: reset}
+	if used+1 <= float64(limit.Requests) {
+		w.current++
+		res.Allowed = true
+		used++
+	} else {
+		res.RetryAfter = reset
+	}
+	res.Remaining = limit.Requests - int(math.Ceil(used))
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	return res
+}
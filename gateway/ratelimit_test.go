@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	kit_models "github.com/sailsforce/gomicro-kit/models"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Rate Limit Tests", func() {
+
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(200)
+	})
+
+	send := func(h http.Handler, apiKey string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-API-KEY", apiKey)
+		h.ServeHTTP(rw, r)
+		return rw
+	}
+
+	Describe("token bucket", func() {
+		It("should allow the burst then reject with 429", func() {
+			rl := NewRateLimiter(nil, RateRule{
+				Limit: Limit{Requests: 2, Window: time.Minute},
+				Key:   ByAPIKey,
+			})
+			h := rl.Middleware("orders", "list")(ok)
+
+			first := send(h, "a")
+			Expect(first.Code).To(Equal(200))
+			Expect(first.Header().Get("RateLimit-Limit")).To(Equal("2"))
+			Expect(first.Header().Get("RateLimit-Remaining")).To(Equal("1"))
+			Expect(send(h, "a").Code).To(Equal(200))
+
+			limited := send(h, "a")
+			Expect(limited.Code).To(Equal(429))
+			Expect(limited.Header().Get("Retry-After")).ToNot(BeEmpty())
+			Expect(limited.Body.String()).To(ContainSubstring("too many requests"))
+
+			Expect(send(h, "b").Code).To(Equal(200))
+		})
+	})
+
+	Describe("sliding window", func() {
+		It("should enforce the quota", func() {
+			rl := NewRateLimiter(nil, RateRule{
+				Service: "orders",
+				Limit:   Limit{Algorithm: SlidingWindow, Requests: 3, Window: time.Hour},
+			})
+			h := rl.Middleware("orders", "list")(ok)
+			for i := 0; i < 3; i++ {
+				Expect(send(h, "a").Code).To(Equal(200))
+			}
+			Expect(send(h, "a").Code).To(Equal(429))
+		})
+		It("should ignore rules for other services", func() {
+			rl := NewRateLimiter(nil, RateRule{
+				Service: "orders",
+				Limit:   Limit{Algorithm: SlidingWindow, Requests: 1, Window: time.Hour},
+			})
+			h := rl.Middleware("users", "list")(ok)
+			Expect(send(h, "a").Code).To(Equal(200))
+			Expect(send(h, "a").Code).To(Equal(200))
+		})
+	})
+
+	Describe("several rules", func() {
+		It("should refund the rules that counted a rejected request", func() {
+			store := NewMemoryLimitStore()
+			perClient := RateRule{Limit: Limit{Requests: 2, Window: time.Hour}, Key: ByAPIKey}
+			perRoute := RateRule{Limit: Limit{Algorithm: SlidingWindow, Requests: 1, Window: time.Hour}}
+			h := NewRateLimiter(store, perClient, perRoute).Middleware("orders", "list")(ok)
+
+			Expect(send(h, "a").Code).To(Equal(200))
+			Expect(send(h, "a").Code).To(Equal(429))
+			Expect(send(h, "a").Code).To(Equal(429))
+
+			// same store and rule index, so it shares the per client key.
+			only := NewRateLimiter(store, perClient).Middleware("orders", "list")(ok)
+			res := send(only, "a")
+			Expect(res.Code).To(Equal(200))
+			Expect(res.Header().Get("RateLimit-Remaining")).To(Equal("0"))
+		})
+	})
+
+	Describe("client keys", func() {
+		request := func(remote string, forwarded ...string) *http.Request {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = remote
+			for _, f := range forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			return r
+		}
+
+		It("should use the peer address by ip", func() {
+			Expect(ByIP(request("10.0.0.1:1234", "1.2.3.4"))).To(Equal("10.0.0.1"))
+		})
+
+		It("should only trust X-Forwarded-For from trusted proxies", func() {
+			key, err := ByForwardedIP("10.0.0.0/8", "192.168.1.1")
+			Expect(err).To(BeNil())
+			Expect(key(request("8.8.8.8:1234", "1.2.3.4"))).To(Equal("8.8.8.8"))
+			Expect(key(request("10.0.0.1:1234", "1.2.3.4"))).To(Equal("1.2.3.4"))
+			// the client prepended a fake address, the proxies appended the real one.
+			Expect(key(request("10.0.0.1:1234", "6.6.6.6, 1.2.3.4", "192.168.1.1"))).To(Equal("1.2.3.4"))
+			Expect(key(request("10.0.0.1:1234"))).To(Equal("10.0.0.1"))
+
+			_, err = ByForwardedIP("not a cidr")
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("should key by the validated caller", func() {
+			secret := "supersecretkeyvalue"
+			billing := &kit_models.HmacKeys{Name: "billing", Keys: []kit_models.Key{{ID: "k1", Value: secret}}}
+			validator := kit_middleware.NewHmacValidator(kit_middleware.HmacOptions{
+				Keys: kit_middleware.StaticKeys(&kit_models.HmacKeys{Name: "default", Keys: []kit_models.Key{{ID: "d1", Value: "defaultsecretvalue"}}}),
+				ClientKeys: func(ctx context.Context) ([]*kit_models.HmacKeys, error) {
+					return []*kit_models.HmacKeys{billing}, nil
+				},
+				Nonces: kit_middleware.NewMemoryNonceStore(10),
+			})
+			var key string
+			h := validator.Validate(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				key = ByCaller(r)
+			}))
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(kit_utils.HmacClientIDHeader, "billing")
+			Expect(kit_utils.SignRequestWithKeyID(r, "k1", secret)).To(Succeed())
+			h.ServeHTTP(httptest.NewRecorder(), r)
+			Expect(key).To(Equal("billing"))
+		})
+	})
+
+	Describe("memory store", func() {
+		It("should reject limits without a window", func() {
+			store := NewMemoryLimitStore()
+			_, err := store.Allow(context.Background(), "a", Limit{Requests: 1})
+			Expect(err).To(Equal(ErrInvalidLimit))
+
+			rl := NewRateLimiter(store, RateRule{Limit: Limit{Requests: 1}})
+			Expect(send(rl.Middleware("orders", "list")(ok), "a").Code).To(Equal(200))
+		})
+
+		It("should give back a refunded request", func() {
+			store := NewMemoryLimitStore()
+			ctx := context.Background()
+			for _, limit := range []Limit{
+				{Requests: 1, Window: time.Hour},
+				{Algorithm: SlidingWindow, Requests: 1, Window: time.Hour},
+			} {
+				res, _ := store.Allow(ctx, "a", limit)
+				Expect(res.Allowed).To(BeTrue())
+				Expect(store.Refund(ctx, "a", limit)).To(Succeed())
+				res, _ = store.Allow(ctx, "a", limit)
+				Expect(res.Allowed).To(BeTrue())
+				res, _ = store.Allow(ctx, "a", limit)
+				Expect(res.Allowed).To(BeFalse())
+			}
+		})
+
+		It("should sweep idle keys", func() {
+			store := NewMemoryLimitStore()
+			store.SweepInterval = 0
+			bucket := Limit{Requests: 10, Window: 50 * time.Millisecond}
+			window := Limit{Algorithm: SlidingWindow, Requests: 10, Window: 20 * time.Millisecond}
+			for _, key := range []string{"a", "b", "c"} {
+				store.Allow(context.Background(), key, bucket)
+				store.Allow(context.Background(), key, window)
+			}
+			Expect(store.Len()).To(Equal(6))
+			time.Sleep(60 * time.Millisecond)
+			store.Allow(context.Background(), "d", bucket)
+			Expect(store.Len()).To(Equal(1))
+		})
+	})
+})
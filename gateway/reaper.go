@@ -0,0 +1,145 @@
+package gateway
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sailsforce/gomicro-kit/models"
+	"gorm.io/gorm"
+)
+
+// advisory lock id shared by every gateway replica running a reaper.
+const reaperLockID = 4242001
+
+// Reaper expires registrations that stopped renewing. Instances not seen
+// within TTL are marked offline, instances not seen within Grace are soft
+// deleted through DeletedAt. With a DB the work is done in a transaction
+// holding a postgres advisory lock, so only one gateway replica reaps at a
+// time and the updates are conditional, making overlapping runs harmless.
+type Reaper struct {
+	DB       *gorm.DB
+	Registry *Registry
+	TTL      time.Duration
+	Grace    time.Duration
+	Interval time.Duration
+}
+
+func NewReaper(db *gorm.DB, reg *Registry) *Reaper {
+	return &Reaper{
+		DB:       db,
+		Registry: reg,
+		TTL:      90 * time.Second,
+		Grace:    15 * time.Minute,
+		Interval: 30 * time.Second,
+	}
+}
+
+// Migrate adds the last_seen and deleted_at columns the reaper relies on,
+// and the drained and disabled admin state, to the services table.
+func (r *Reaper) Migrate() error {
+	return r.DB.AutoMigrate(&models.Service{})
+}
+
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.ReapOnce(ctx); err != nil {
+				log.Printf("reaper: error: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Reaper) ReapOnce(ctx context.Context) error {
+	if r.Registry != nil {
+		offline, removed := r.Registry.Reap(r.TTL, r.Grace)
+		if offline > 0 || removed > 0 {
+			log.Printf("reaper: registry marked %d offline, removed %d", offline, removed)
+		}
+	}
+	if r.DB == nil {
+		return nil
+	}
+
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", reaperLockID).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		now := time.Now()
+		offline := tx.Model(&models.Service{}).
+			Where("service_online = ? AND last_seen < ?", true, now.Add(-r.TTL)).
+			Where("deleted_at IS NULL OR deleted_at <= ?", time.Time{}).
+			Update("service_online", false)
+		if offline.Error != nil {
+			return offline.Error
+		}
+		deleted := tx.Model(&models.Service{}).
+			Where("last_seen < ?", now.Add(-r.Grace)).
+			Where("deleted_at IS NULL OR deleted_at <= ?", time.Time{}).
+			Updates(map[string]interface{}{"service_online": false, "deleted_at": now})
+		if deleted.Error != nil {
+			return deleted.Error
+		}
+		if offline.RowsAffected > 0 || deleted.RowsAffected > 0 {
+			log.Printf("reaper: db marked %d offline, deleted %d", offline.RowsAffected, deleted.RowsAffected)
+		}
+		return nil
+	})
+}
+
+// Renew records that an instance is still alive, i.e. when it re-registers.
+// A soft deleted instance is restored and an unknown one is created. A
+// drained instance stays drained and a disabled one is refused with
+// ErrInstanceDisabled. s.ServiceOnline is stored as given, the caller owns
+// it, see Registry.RenewedOnline. s.ID is set to the id of the row.
+func Renew(db *gorm.DB, s *models.Service) error {
+	now := time.Now()
+	var existing models.Service
+	err := db.Where("service_name = ? AND base_url = ? AND service_version = ?", s.ServiceName, s.BaseURL, s.ServiceVersion).
+		Order("id").Limit(1).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	if existing.Disabled {
+		return ErrInstanceDisabled
+	}
+	if existing.ID == 0 {
+		s.ID = 0
+		s.LastSeen = now
+		s.DeletedAt = time.Time{}
+		return db.Create(s).Error
+	}
+	s.ID = existing.ID
+	s.Drained = existing.Drained
+	if s.Drained {
+		s.ServiceOnline = false
+	}
+	return db.Model(&models.Service{}).Where("id = ?", existing.ID).
+		Updates(map[string]interface{}{
+			"service_summary":  s.ServiceSummary,
+			"service_protocol": s.ServiceProtocol,
+			"routes":           s.Routes,
+			"openapi":          s.OpenAPI,
+			"last_seen":        now,
+			"service_online":   s.ServiceOnline,
+			"deleted_at":       time.Time{},
+		}).Error
+}
+
+// ActiveServices loads every instance that hasn't been soft deleted.
+func ActiveServices(db *gorm.DB) ([]models.Service, error) {
+	var services []models.Service
+	err := db.Where("deleted_at IS NULL OR deleted_at <= ?", time.Time{}).Find(&services).Error
+	return services, err
+}
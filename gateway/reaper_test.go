@@ -0,0 +1,233 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+	"gorm.io/datatypes"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var _ = Describe("Reaper Tests", func() {
+
+	var reg *Registry
+	var reaper *Reaper
+
+	register := func(baseURL string) *http.Response {
+		body, _ := json.Marshal(models.Service{
+			ServiceName:     "items",
+			ServiceProtocol: "http",
+			ServiceVersion:  "v1",
+			BaseURL:         baseURL,
+			ServiceOnline:   true,
+		})
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		NewRegistrationHandler(reg, nil).ServeHTTP(rw, r)
+		return rw.Result()
+	}
+
+	BeforeEach(func() {
+		reg = NewRegistry()
+		reaper = NewReaper(nil, reg)
+		reaper.TTL = 50 * time.Millisecond
+		reaper.Grace = 200 * time.Millisecond
+	})
+
+	It("should expire and then remove instances that stop renewing", func() {
+		Expect(register("a:80").StatusCode).To(Equal(200))
+		Expect(register("b:80").StatusCode).To(Equal(200))
+
+		time.Sleep(100 * time.Millisecond)
+		Expect(register("b:80").StatusCode).To(Equal(200))
+		Expect(reaper.ReapOnce(context.Background())).To(Succeed())
+		services := reg.Pool("items").Services
+		Expect(services[0].ServiceOnline).To(BeFalse())
+		Expect(services[1].ServiceOnline).To(BeTrue())
+
+		time.Sleep(150 * time.Millisecond)
+		Expect(register("b:80").StatusCode).To(Equal(200))
+		Expect(reaper.ReapOnce(context.Background())).To(Succeed())
+		Expect(reg.Pool("items").Services).To(HaveLen(1))
+		Expect(reg.Pool("items").Services[0].BaseURL).To(Equal("b:80"))
+		Expect(reg.Events()[0].Type).To(Equal("reaped"))
+	})
+
+	It("should bring an expired instance back when it renews", func() {
+		register("a:80")
+		time.Sleep(100 * time.Millisecond)
+		Expect(reaper.ReapOnce(context.Background())).To(Succeed())
+		Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeFalse())
+
+		register("a:80")
+		s := reg.Pool("items").Services[0]
+		Expect(s.ID).To(Equal(1))
+		Expect(s.ServiceOnline).To(BeTrue())
+	})
+
+	It("should reap in the background until stopped", func() {
+		reaper.Interval = 10 * time.Millisecond
+		register("a:80")
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			reaper.Run(ctx)
+			close(done)
+		}()
+		Eventually(func() *models.ServicePool { return reg.Pool("items") }).Should(BeNil())
+		cancel()
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("should reject incomplete registrations", func() {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/register", bytes.NewReader([]byte(`{"service_name": "items"}`)))
+		r.Header.Set("Content-Type", "application/json")
+		NewRegistrationHandler(reg, nil).ServeHTTP(rw, r)
+		Expect(rw.Code).To(Equal(400))
+		Expect(reg.Pool("items")).To(BeNil())
+	})
+
+	Context("with a database", func() {
+
+		var db *sql.DB
+		var mock sqlmock.Sqlmock
+
+		BeforeEach(func() {
+			var err error
+			db, mock, err = sqlmock.New()
+			Expect(err).To(BeNil())
+			reaper.DB, err = gorm.Open(postgres.New(postgres.Config{Conn: db}), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			Expect(mock.ExpectationsWereMet()).To(Succeed())
+			db.Close()
+		})
+
+		It("should expire and soft delete stale rows under the advisory lock", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).WithArgs(reaperLockID).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+			mock.ExpectExec(`UPDATE "services" SET "service_online"=\$1,"updated_at"=\$2 WHERE \(service_online = \$3 AND last_seen < \$4\) AND \(deleted_at IS NULL OR deleted_at <= \$5\)`).
+				WithArgs(false, sqlmock.AnyArg(), true, sqlmock.AnyArg(), time.Time{}).
+				WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectExec(`UPDATE "services" SET "deleted_at"=\$1,"service_online"=\$2,"updated_at"=\$3 WHERE last_seen < \$4 AND \(deleted_at IS NULL OR deleted_at <= \$5\)`).
+				WithArgs(sqlmock.AnyArg(), false, sqlmock.AnyArg(), sqlmock.AnyArg(), time.Time{}).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			Expect(reaper.ReapOnce(context.Background())).To(Succeed())
+		})
+
+		It("should leave the rows alone when another replica holds the lock", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(false))
+			mock.ExpectCommit()
+
+			Expect(reaper.ReapOnce(context.Background())).To(Succeed())
+		})
+
+		It("should roll back when an update fails", func() {
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(true))
+			mock.ExpectExec(`UPDATE "services"`).WillReturnError(sqlmock.ErrCancelled)
+			mock.ExpectRollback()
+
+			Expect(reaper.ReapOnce(context.Background())).To(MatchError(sqlmock.ErrCancelled))
+		})
+
+		It("should create an unknown instance on renewal", func() {
+			mock.ExpectQuery(`SELECT \* FROM "services" WHERE service_name = \$1 AND base_url = \$2 AND service_version = \$3 ORDER BY id LIMIT 1`).
+				WithArgs("items", "a:80", "v1").
+				WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO "services"`).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+			mock.ExpectCommit()
+
+			s := models.Service{ServiceName: "items", BaseURL: "a:80", ServiceVersion: "v1", ServiceOnline: true}
+			Expect(Renew(reaper.DB, &s)).To(Succeed())
+			Expect(s.ID).To(Equal(7))
+			Expect(s.LastSeen).NotTo(BeZero())
+		})
+
+		It("should refresh an existing row and keep it drained", func() {
+			mock.ExpectQuery(`SELECT \* FROM "services"`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "drained"}).AddRow(3, true))
+			mock.ExpectBegin()
+			// columns are set in name order, a nil openapi is inlined as NULL
+			mock.ExpectExec(`UPDATE "services" SET .*"last_seen"=.*"service_online"=\$4.* WHERE id = \$8`).
+				WithArgs(time.Time{}, sqlmock.AnyArg(), sqlmock.AnyArg(), false,
+					sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 3).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			s := models.Service{ServiceName: "items", BaseURL: "a:80", ServiceVersion: "v1", ServiceOnline: true,
+				Routes: datatypes.JSON(`{"health": "/health"}`)}
+			Expect(Renew(reaper.DB, &s)).To(Succeed())
+			Expect(s.ID).To(Equal(3))
+			Expect(s.Drained).To(BeTrue())
+			Expect(s.ServiceOnline).To(BeFalse())
+		})
+
+		It("should refuse to renew a disabled instance", func() {
+			mock.ExpectQuery(`SELECT \* FROM "services"`).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "disabled"}).AddRow(3, true))
+
+			s := models.Service{ServiceName: "items", BaseURL: "a:80", ServiceVersion: "v1"}
+			Expect(Renew(reaper.DB, &s)).To(MatchError(ErrInstanceDisabled))
+		})
+
+		It("should store the health state the registry keeps on renewal", func() {
+			register("a:80")
+			old := reg.Pool("items").Services[0]
+			s := *old
+			s.ServiceOnline = false
+			Expect(reg.Replace(old, &s)).To(BeTrue())
+
+			mock.ExpectQuery(`SELECT \* FROM "services"`).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			mock.ExpectBegin()
+			mock.ExpectExec(`UPDATE "services"`).
+				WithArgs(time.Time{}, sqlmock.AnyArg(), sqlmock.AnyArg(), false,
+					sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			body, _ := json.Marshal(models.Service{ServiceName: "items", ServiceProtocol: "http", ServiceVersion: "v1", BaseURL: "a:80", ServiceOnline: true})
+			rw := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/register", bytes.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			NewRegistrationHandler(reg, reaper.DB).ServeHTTP(rw, r)
+			Expect(rw.Code).To(Equal(200))
+			Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeFalse())
+		})
+
+		It("should load the instances that aren't soft deleted", func() {
+			mock.ExpectQuery(`SELECT \* FROM "services" WHERE deleted_at IS NULL OR deleted_at <= \$1`).
+				WithArgs(time.Time{}).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "service_name", "base_url"}).
+					AddRow(1, "items", "a:80").AddRow(2, "items", "b:80"))
+
+			services, err := ActiveServices(reaper.DB)
+			Expect(err).To(BeNil())
+			Expect(services).To(HaveLen(2))
+			Expect(services[1].BaseURL).To(Equal("b:80"))
+		})
+	})
+})
@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	"github.com/sailsforce/gomicro-kit/models"
+	"gorm.io/gorm"
+)
+
+// RegistrationHandler accepts the registrations sent by
+// models.Service.RegisterAtGateway. Registering an instance again renews it,
+// which is what keeps it from being reaped. Instances disabled through the
+// admin API are refused with a 403. When DB is set the instance is persisted
+// through Renew.
+type RegistrationHandler struct {
+	Registry *Registry
+	DB       *gorm.DB
+}
+
+func NewRegistrationHandler(reg *Registry, db *gorm.DB) *RegistrationHandler {
+	return &RegistrationHandler{Registry: reg, DB: db}
+}
+
+func (h *RegistrationHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	var s models.Service
+	if err := render.DecodeJSON(r.Body, &s); err != nil {
+		logger.Error("error decoding service: ", err)
+		logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
+		return
+	}
+	if s.ServiceName == "" || s.BaseURL == "" || s.ServiceVersion == "" {
+		logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusBadRequest, "service_name, base_url and service_version are required")))
+		return
+	}
+	// the gateway owns these, whatever the instance sent. A renewal only
+	// refreshes last_seen, health and admin state are kept.
+	s.ID = 0
+	s.Drained = false
+	s.Disabled = false
+	s.DeletedAt = time.Time{}
+	s.LastSeen = time.Now()
+
+	if h.Registry.IsDisabled(&s) {
+		h.refuse(rw, r, &s)
+		return
+	}
+	s.ServiceOnline = h.Registry.RenewedOnline(&s)
+	if h.DB != nil {
+		err := Renew(h.DB.WithContext(r.Context()), &s)
+		if err == ErrInstanceDisabled {
+			h.refuse(rw, r, &s)
+			return
+		}
+		if err != nil {
+			logger.Error("error persisting service: ", err)
+			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
+			return
+		}
+	}
+	if err := h.Registry.Register(&s); err != nil {
+		h.refuse(rw, r, &s)
+		return
+	}
+	logger.Info("service registered: ", s.ServiceName, " ", s.ServiceVersion, " ", s.BaseURL)
+	render.JSON(rw, r, &s)
+}
+
+func (h *RegistrationHandler) refuse(rw http.ResponseWriter, r *http.Request, s *models.Service) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+	logger.Info("refusing registration of disabled service: ", s.ServiceName, " ", s.ServiceVersion, " ", s.BaseURL)
+	logger.Debug(render.Render(rw, r, kit_errors.GenericErr(reqId, http.StatusForbidden, "service disabled")))
+}
@@ -0,0 +1,530 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+// Registry holds a ServicePool per registered service name.
+type Registry struct {
+	mu      sync.RWMutex
+	pools   map[string]*models.ServicePool
+	version uint64
+	// closed and replaced on every change to wake up long polls.
+	changed chan struct{}
+	nextID  int
+	events  []RegistryEvent
+	// outlier detectors by service name, kept when a pool empties.
+	outliers  map[string]*models.OutlierDetector
+	tlsConfig *tls.Config
+	// drained and disabled instances by InstanceKey, so renewals keep them
+	// out.
+	admin map[string]*adminState
+	// instances taken offline for not renewing, by InstanceKey. Their next
+	// renewal brings them back.
+	expired map[string]bool
+}
+
+type adminState struct {
+	disabled bool
+	// the instance as it was disabled, so it can be found by id.
+	service *models.Service
+}
+
+var ErrInstanceDisabled = errors.New("instance disabled")
+
+const maxRegistryEvents = 200
+
+type RegistryEvent struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	ServiceID   int       `json:"service_id"`
+	ServiceName string    `json:"service_name"`
+	Version     string    `json:"service_version"`
+	BaseURL     string    `json:"base_url"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		pools:    make(map[string]*models.ServicePool),
+		changed:  make(chan struct{}),
+		outliers: make(map[string]*models.OutlierDetector),
+		admin:    make(map[string]*adminState),
+		expired:  make(map[string]bool),
+	}
+}
+
+// NewOutlierDetector attaches an outlier detector to the named pool, now
+// and whenever the pool is recreated. The detector resolves the pool
+// through the registry, so it follows every swap.
+func (reg *Registry) NewOutlierDetector(name string) *models.OutlierDetector {
+	od := models.NewOutlierDetectorFunc(func() *models.ServicePool { return reg.Pool(name) })
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.outliers[name] = od
+	if pool, ok := reg.pools[name]; ok {
+		swapped := withServices(pool, pool.Services)
+		swapped.Outliers = od
+		reg.pools[name] = swapped
+	}
+	return od
+}
+
+// SetTLSConfig sets the client tls config, i.e. MicroRestConfig.ClientTLS,
+// used to reach https services. Pools use it for health checks and the
+// proxy and status handler default to it.
+func (reg *Registry) SetTLSConfig(cfg *tls.Config) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.tlsConfig = cfg
+	for name, pool := range reg.pools {
+		swapped := withServices(pool, pool.Services)
+		swapped.TLSConfig = cfg
+		reg.pools[name] = swapped
+	}
+}
+
+func (reg *Registry) TLSConfig() *tls.Config {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.tlsConfig
+}
+
+// Register adds the service to its pool, replacing an instance with the same
+// base url and version. A renewed instance keeps the health state of the one
+// it replaces, unless it expired for not renewing. A drained instance stays
+// drained and a disabled one is refused with ErrInstanceDisabled until it is
+// enabled.
+func (reg *Registry) Register(s *models.Service) error {
+	if s.LastSeen.IsZero() {
+		s.LastSeen = time.Now()
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	state, ok := reg.admin[s.InstanceKey()]
+	switch {
+	case ok && state.disabled:
+		return ErrInstanceDisabled
+	case ok:
+		s.Drained = true
+	case s.Drained:
+		reg.admin[s.InstanceKey()] = &adminState{}
+	}
+	if s.Drained {
+		s.ServiceOnline = false
+	}
+	defer reg.bump()
+	pool, ok := reg.pools[s.ServiceName]
+	if !ok {
+		pool = &models.ServicePool{Outliers: reg.outliers[s.ServiceName], TLSConfig: reg.tlsConfig}
+	}
+	for i, existing := range pool.Services {
+		if existing.BaseURL == s.BaseURL && existing.ServiceVersion == s.ServiceVersion {
+			if s.ID == 0 {
+				s.ID = existing.ID
+			}
+			s.ServiceOnline = reg.renewedOnline(existing) && !s.Drained
+			delete(reg.expired, s.InstanceKey())
+			services := make([]*models.Service, len(pool.Services))
+			copy(services, pool.Services)
+			services[i] = s
+			reg.pools[s.ServiceName] = withServices(pool, services)
+			reg.record("renewed", s, "")
+			return nil
+		}
+	}
+	if s.ID == 0 {
+		reg.nextID++
+		s.ID = reg.nextID
+	} else if s.ID > reg.nextID {
+		reg.nextID = s.ID
+	}
+	services := make([]*models.Service, 0, len(pool.Services)+1)
+	services = append(services, pool.Services...)
+	reg.pools[s.ServiceName] = withServices(pool, append(services, s))
+	reg.record("registered", s, "")
+	return nil
+}
+
+// IsDisabled reports whether registrations of s are refused.
+func (reg *Registry) IsDisabled(s *models.Service) bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	state, ok := reg.admin[s.InstanceKey()]
+	return ok && state.disabled
+}
+
+// RenewedOnline is the online state s will have once registered: the health
+// state of the instance it renews, online if it expired for not renewing or
+// is new.
+func (reg *Registry) RenewedOnline(s *models.Service) bool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	if pool, ok := reg.pools[s.ServiceName]; ok {
+		for _, existing := range pool.Services {
+			if existing.BaseURL == s.BaseURL && existing.ServiceVersion == s.ServiceVersion {
+				return reg.renewedOnline(existing)
+			}
+		}
+	}
+	return true
+}
+
+// must be called with the lock held.
+func (reg *Registry) renewedOnline(existing *models.Service) bool {
+	return existing.ServiceOnline || reg.expired[existing.InstanceKey()]
+}
+
+// Drain takes the instance with id out of rotation until it is enabled,
+// including across renewals.
+func (reg *Registry) Drain(id int) *models.Service {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	s, pool, i := reg.find(id)
+	if s == nil {
+		return nil
+	}
+	drained := *s
+	drained.Drained = true
+	drained.ServiceOnline = false
+	reg.swap(pool, i, &drained)
+	reg.admin[s.InstanceKey()] = &adminState{}
+	reg.record("drained", &drained, "admin")
+	reg.bump()
+	return &drained
+}
+
+// Disable removes the instance with id and refuses its registrations until
+// it is enabled.
+func (reg *Registry) Disable(id int) *models.Service {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	s := reg.remove(id)
+	if s == nil {
+		return nil
+	}
+	reg.admin[s.InstanceKey()] = &adminState{disabled: true, service: s}
+	reg.record("disabled", s, "admin")
+	return s
+}
+
+// Enable clears the drained or disabled state of the instance with id. A
+// registered instance is returned with its pool, for the caller to health
+// check and Replace. A disabled one isn't in a pool, it is returned with a
+// nil pool and rejoins when it next registers.
+func (reg *Registry) Enable(id int) (*models.Service, *models.ServicePool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if s, pool, _ := reg.find(id); s != nil {
+		delete(reg.admin, s.InstanceKey())
+		return s, pool
+	}
+	for key, state := range reg.admin {
+		if state.disabled && state.service.ID == id {
+			delete(reg.admin, key)
+			reg.record("enabled", state.service, "admin")
+			return state.service, nil
+		}
+	}
+	return nil, nil
+}
+
+// SetWeights sets the traffic weights of the named pool, creating its
+// policy if needed.
+func (reg *Registry) SetWeights(name string, weights map[string]int) (*models.TrafficPolicy, error) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	pool, ok := reg.pools[name]
+	if !ok {
+		return nil, nil
+	}
+	if pool.Policy != nil {
+		return pool.Policy, pool.Policy.SetWeights(weights)
+	}
+	policy, err := models.NewTrafficPolicy(weights)
+	if err != nil {
+		return nil, err
+	}
+	swapped := withServices(pool, pool.Services)
+	swapped.Policy = policy
+	reg.pools[name] = swapped
+	reg.bump()
+	return policy, nil
+}
+
+// must be called with the lock held.
+func (reg *Registry) find(id int) (*models.Service, *models.ServicePool, int) {
+	for _, pool := range reg.pools {
+		for i, s := range pool.Services {
+			if s.ID == id {
+				return s, pool, i
+			}
+		}
+	}
+	return nil, nil, -1
+}
+
+// swap replaces the i-th instance of pool, must be called with the write
+// lock held.
+func (reg *Registry) swap(pool *models.ServicePool, i int, s *models.Service) {
+	services := make([]*models.Service, len(pool.Services))
+	copy(services, pool.Services)
+	services[i] = s
+	reg.pools[s.ServiceName] = withServices(pool, services)
+}
+
+// Find returns the instance with id and its pool.
+func (reg *Registry) Find(id int) (*models.Service, *models.ServicePool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	s, pool, _ := reg.find(id)
+	return s, pool
+}
+
+// Replace swaps old for updated if old is still registered. Instances are
+// replaced rather than modified so snapshots can copy them under the read
+// lock.
+func (reg *Registry) Replace(old, updated *models.Service) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	pool, ok := reg.pools[old.ServiceName]
+	if !ok {
+		return false
+	}
+	for i, s := range pool.Services {
+		if s == old {
+			reg.swap(pool, i, updated)
+			reg.bump()
+			return true
+		}
+	}
+	return false
+}
+
+// Remove drops the instance with id from its pool and sets its DeletedAt.
+func (reg *Registry) Remove(id int) *models.Service {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	s := reg.remove(id)
+	if s != nil {
+		reg.record("removed", s, "")
+	}
+	return s
+}
+
+// must be called with the write lock held.
+func (reg *Registry) remove(id int) *models.Service {
+	for name, pool := range reg.pools {
+		for i, s := range pool.Services {
+			if s.ID != id {
+				continue
+			}
+			kept := make([]*models.Service, 0, len(pool.Services)-1)
+			kept = append(kept, pool.Services[:i]...)
+			kept = append(kept, pool.Services[i+1:]...)
+			if len(kept) == 0 {
+				delete(reg.pools, name)
+			} else {
+				reg.pools[name] = withServices(pool, kept)
+			}
+			removed := *s
+			removed.ServiceOnline = false
+			removed.DeletedAt = time.Now()
+			if pool.Outliers != nil {
+				pool.Outliers.Forget(s)
+			}
+			delete(reg.expired, s.InstanceKey())
+			reg.bump()
+			return &removed
+		}
+	}
+	return nil
+}
+
+// Record adds an event to the registry's recent history.
+func (reg *Registry) Record(eventType string, s *models.Service, detail string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.record(eventType, s, detail)
+}
+
+// must be called with the write lock held.
+func (reg *Registry) record(eventType string, s *models.Service, detail string) {
+	reg.events = append(reg.events, RegistryEvent{
+		Time:        time.Now(),
+		Type:        eventType,
+		ServiceID:   s.ID,
+		ServiceName: s.ServiceName,
+		Version:     s.ServiceVersion,
+		BaseURL:     s.BaseURL,
+		Detail:      detail,
+	})
+	if len(reg.events) > maxRegistryEvents {
+		reg.events = reg.events[len(reg.events)-maxRegistryEvents:]
+	}
+}
+
+// Events returns the recent events, newest first.
+func (reg *Registry) Events() []RegistryEvent {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	events := make([]RegistryEvent, len(reg.events))
+	for i, e := range reg.events {
+		events[len(reg.events)-1-i] = e
+	}
+	return events
+}
+
+// Reap marks instances not seen within ttl offline and removes instances not
+// seen within grace. Instances are replaced by offline copies, not modified.
+func (reg *Registry) Reap(ttl, grace time.Duration) (offline, removed int) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	now := time.Now()
+	for name, pool := range reg.pools {
+		kept := make([]*models.Service, 0, len(pool.Services))
+		changed := false
+		for _, s := range pool.Services {
+			idle := now.Sub(s.LastSeen)
+			if idle > grace {
+				reaped := *s
+				reaped.ServiceOnline = false
+				reaped.DeletedAt = now
+				if pool.Outliers != nil {
+					pool.Outliers.Forget(s)
+				}
+				delete(reg.expired, s.InstanceKey())
+				removed++
+				changed = true
+				reg.record("reaped", &reaped, "not seen within grace period")
+				continue
+			}
+			if idle > ttl && s.ServiceOnline {
+				expired := *s
+				expired.ServiceOnline = false
+				reg.expired[s.InstanceKey()] = true
+				offline++
+				changed = true
+				reg.record("expired", &expired, "not seen within ttl")
+				s = &expired
+			}
+			kept = append(kept, s)
+		}
+		if len(kept) == 0 {
+			delete(reg.pools, name)
+		} else if changed {
+			reg.pools[name] = withServices(pool, kept)
+		}
+	}
+	if offline > 0 || removed > 0 {
+		reg.bump()
+	}
+	return offline, removed
+}
+
+// withServices copies pool with a new instance list. Pools are swapped rather
+// than modified so in-flight selections keep a consistent view.
+func withServices(pool *models.ServicePool, services []*models.Service) *models.ServicePool {
+	return &models.ServicePool{
+		Services:  services,
+		Current:   atomic.LoadUint64(&pool.Current),
+		Policy:    pool.Policy,
+		Outliers:  pool.Outliers,
+		TLSConfig: pool.TLSConfig,
+	}
+}
+
+// must be called with the write lock held.
+func (reg *Registry) bump() {
+	reg.version++
+	close(reg.changed)
+	reg.changed = make(chan struct{})
+}
+
+func (reg *Registry) Version() uint64 {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.version
+}
+
+// Wait blocks until the registry version is newer than version or ctx is done.
+func (reg *Registry) Wait(ctx context.Context, version uint64) uint64 {
+	for {
+		reg.mu.RLock()
+		current, changed := reg.version, reg.changed
+		reg.mu.RUnlock()
+		if current != version {
+			return current
+		}
+		select {
+		case <-ctx.Done():
+			return current
+		case <-changed:
+		}
+	}
+}
+
+func (reg *Registry) Pool(name string) *models.ServicePool {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.pools[name]
+}
+
+func (reg *Registry) Names() []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	names := make([]string, 0, len(reg.pools))
+	for name := range reg.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Services returns every registered instance, ordered by service name.
+func (reg *Registry) Services() []*models.Service {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	return reg.services()
+}
+
+// must be called with the lock held.
+func (reg *Registry) services() []*models.Service {
+	names := make([]string, 0, len(reg.pools))
+	for name := range reg.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var services []*models.Service
+	for _, name := range names {
+		services = append(services, reg.pools[name].Services...)
+	}
+	return services
+}
+
+// Snapshot copies the instances and the version they belong to under a
+// single lock, so the version always matches the instances.
+func (reg *Registry) Snapshot() *models.ServiceRegistrySnapshot {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	services := reg.services()
+	snapshot := &models.ServiceRegistrySnapshot{
+		Version:  reg.version,
+		Services: make([]models.Service, 0, len(services)),
+	}
+	for _, s := range services {
+		copied := *s
+		// served by the openapi handler, too large to poll.
+		copied.OpenAPI = nil
+		snapshot.Services = append(snapshot.Services, copied)
+	}
+	return snapshot
+}
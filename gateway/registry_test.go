@@ -0,0 +1,216 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Registry Tests", func() {
+
+	var reg *Registry
+
+	instance := func(baseURL, version string) *models.Service {
+		return &models.Service{ServiceName: "items", BaseURL: baseURL, ServiceVersion: version, ServiceOnline: true}
+	}
+
+	BeforeEach(func() {
+		reg = NewRegistry()
+	})
+
+	It("should assign ids and renew instances in place of the old ones", func() {
+		reg.Register(instance("a:80", "v1"))
+		reg.Register(instance("b:80", "v1"))
+		before := reg.Pool("items")
+
+		renewed := instance("a:80", "v1")
+		reg.Register(renewed)
+		Expect(renewed.ID).To(Equal(1))
+		after := reg.Pool("items")
+		Expect(after.Services).To(HaveLen(2))
+		Expect(after.Services[0]).To(BeIdenticalTo(renewed))
+		Expect(before.Services[0]).NotTo(BeIdenticalTo(renewed))
+		Expect(reg.Events()[0].Type).To(Equal("renewed"))
+	})
+
+	It("should keep versions of the same base url apart", func() {
+		reg.Register(instance("a:80", "v1"))
+		reg.Register(instance("a:80", "v2"))
+		Expect(reg.Pool("items").Versions()).To(Equal([]string{"v1", "v2"}))
+	})
+
+	It("should remove instances and empty pools", func() {
+		reg.Register(instance("a:80", "v1"))
+		s := reg.Remove(1)
+		Expect(s.IsDeleted()).To(BeTrue())
+		Expect(reg.Pool("items")).To(BeNil())
+		Expect(reg.Remove(1)).To(BeNil())
+	})
+
+	It("should wake up waiters on changes", func() {
+		version := reg.Version()
+		done := make(chan uint64)
+		go func() {
+			done <- reg.Wait(context.Background(), version)
+		}()
+		reg.Register(instance("a:80", "v1"))
+		Eventually(done).Should(Receive(Equal(version + 1)))
+	})
+
+	It("should let selections run while instances register", func() {
+		reg.Register(instance("a:80", "v1"))
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					Expect(reg.Pool("items").GetNextPeer()).NotTo(BeNil())
+				}
+			}
+		}()
+		for i := 0; i < 200; i++ {
+			reg.Register(instance("a:80", "v1"))
+			reg.Register(instance("b:80", "v1"))
+		}
+		close(stop)
+		wg.Wait()
+		Expect(reg.Pool("items").Services).To(HaveLen(2))
+	})
+
+	It("should expire and reap instances that stopped renewing", func() {
+		stale := instance("a:80", "v1")
+		stale.LastSeen = time.Now().Add(-time.Minute)
+		gone := instance("b:80", "v1")
+		gone.LastSeen = time.Now().Add(-time.Hour)
+		reg.Register(stale)
+		reg.Register(gone)
+		reg.Register(instance("c:80", "v1"))
+
+		offline, removed := reg.Reap(30*time.Second, 10*time.Minute)
+		Expect(offline).To(Equal(1))
+		Expect(removed).To(Equal(1))
+		Expect(reg.Pool("items").Services).To(HaveLen(2))
+		Expect(reg.Pool("items").Services[0].BaseURL).To(Equal("a:80"))
+		Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeFalse())
+		// the registered instances are replaced, not modified.
+		Expect(stale.ServiceOnline).To(BeTrue())
+		Expect(gone.IsDeleted()).To(BeFalse())
+		Expect(reg.Events()[0].Type).To(Equal("reaped"))
+		Expect(reg.Events()[1].Type).To(Equal("expired"))
+	})
+
+	It("should keep the health state of an instance when it renews", func() {
+		reg.Register(instance("a:80", "v1"))
+		s, _ := reg.Find(1)
+		down := *s
+		down.ServiceOnline = false
+		reg.Replace(s, &down)
+
+		Expect(reg.RenewedOnline(instance("a:80", "v1"))).To(BeFalse())
+		reg.Register(instance("a:80", "v1"))
+		Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeFalse())
+	})
+
+	It("should bring an expired instance back when it renews", func() {
+		stale := instance("a:80", "v1")
+		stale.LastSeen = time.Now().Add(-time.Minute)
+		reg.Register(stale)
+		reg.Reap(30*time.Second, 10*time.Minute)
+		Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeFalse())
+
+		Expect(reg.RenewedOnline(instance("a:80", "v1"))).To(BeTrue())
+		reg.Register(instance("a:80", "v1"))
+		Expect(reg.Pool("items").Services[0].ServiceOnline).To(BeTrue())
+	})
+
+	It("should keep ejected instances out when they renew", func() {
+		reg.Register(instance("a:80", "v1"))
+		reg.Register(instance("b:80", "v1"))
+		reg.Register(instance("c:80", "v1"))
+		od := reg.NewOutlierDetector("items")
+		od.ConsecutiveGatewayErrors = 1
+		od.ReportError(reg.Pool("items").Services[0], errors.New("connection refused"))
+		Expect(reg.Pool("items").Available(reg.Pool("items").Services[0])).To(BeFalse())
+
+		reg.Register(instance("a:80", "v1"))
+		Expect(reg.Pool("items").Outliers).To(BeIdenticalTo(od))
+		Expect(reg.Pool("items").Available(reg.Pool("items").Services[0])).To(BeFalse())
+
+		reg.Remove(1)
+		Expect(od.Stats()).To(BeEmpty())
+	})
+
+	It("should snapshot the instances with their version", func() {
+		reg.Register(instance("a:80", "v1"))
+		reg.Register(instance("b:80", "v1"))
+		snapshot := reg.Snapshot()
+		Expect(snapshot.Version).To(Equal(reg.Version()))
+		Expect(snapshot.Services).To(HaveLen(2))
+	})
+
+	It("should replace instances instead of modifying them", func() {
+		reg.Register(instance("a:80", "v1"))
+		s, _ := reg.Find(1)
+		version := reg.Version()
+		updated := *s
+		updated.ServiceOnline = false
+		Expect(reg.Replace(s, &updated)).To(BeTrue())
+		Expect(s.ServiceOnline).To(BeTrue())
+		Expect(reg.Pool("items").Services[0]).To(BeIdenticalTo(&updated))
+		Expect(reg.Version()).To(BeNumerically(">", version))
+		Expect(reg.Replace(s, &updated)).To(BeFalse())
+	})
+
+	It("should snapshot while instances are being replaced", func() {
+		reg.Register(instance("a:80", "v1"))
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s, _ := reg.Find(1)
+				updated := *s
+				updated.ServiceOnline = i%2 == 0
+				reg.Replace(s, &updated)
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			Expect(reg.Snapshot().Services).To(HaveLen(1))
+		}
+		wg.Wait()
+	})
+
+	It("should snapshot while outliers are ejected and released", func() {
+		reg.Register(instance("a:80", "v1"))
+		reg.Register(instance("b:80", "v1"))
+		reg.Register(instance("c:80", "v1"))
+		od := reg.NewOutlierDetector("items")
+		od.Consecutive5xx = 1
+		od.BaseEjection = time.Nanosecond
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				od.ReportStatus(reg.Pool("items").Services[0], 500)
+				od.Release()
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			Expect(reg.Snapshot().Services).To(HaveLen(3))
+			reg.Pool("items").GetNextPeer()
+		}
+		wg.Wait()
+	})
+})
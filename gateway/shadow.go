@@ -0,0 +1,301 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+)
+
+const ShadowHeader = "X-SHADOW-REQUEST"
+
+// Shadow mirrors a percentage of the traffic of a service to a candidate
+// version. Mirrored requests are sent asynchronously after the primary
+// response is written, carry ShadowHeader so the candidate can skip side
+// effects, and their responses are only compared against the primary and
+// discarded. When the queue is full requests are not mirrored, so the
+// primary path never waits on the candidate. The request body is copied as
+// the primary reads it. The caller's hmac headers are stripped from mirrored
+// requests, their nonce is spent on the primary and the path changes, set
+// Sign to sign them with the gateway's key instead.
+type Shadow struct {
+	Registry         *Registry
+	ServiceName      string
+	CandidateVersion string
+	// 0 to 100.
+	Percent float64
+	// requests or responses bigger than this are not mirrored.
+	MaxBodyBytes int64
+	Client       *http.Client
+	// optional, signs mirrored requests, see httpclient.NewSigningTransport.
+	Sign httpclient.SigningKeyFunc
+
+	queue chan *shadowJob
+	rnd   *rand.Rand
+	rndMu sync.Mutex
+
+	mu    sync.Mutex
+	stats ShadowStats
+}
+
+type ShadowStats struct {
+	Mirrored         int64   `json:"mirrored"`
+	Dropped          int64   `json:"dropped"`
+	Errors           int64   `json:"errors"`
+	StatusMismatches int64   `json:"status_mismatches"`
+	BodyMismatches   int64   `json:"body_mismatches"`
+	PrimaryAvgMs     float64 `json:"primary_avg_ms"`
+	CandidateAvgMs   float64 `json:"candidate_avg_ms"`
+	primaryTotal     time.Duration
+	candidateTotal   time.Duration
+}
+
+type shadowJob struct {
+	method         string
+	path           string
+	header         http.Header
+	body           []byte
+	primaryStatus  int
+	primaryBody    []byte
+	primaryLatency time.Duration
+}
+
+func NewShadow(reg *Registry, serviceName, candidateVersion string, percent float64) *Shadow {
+	return &Shadow{
+		Registry:         reg,
+		ServiceName:      serviceName,
+		CandidateVersion: candidateVersion,
+		Percent:          percent,
+		MaxBodyBytes:     1 << 20,
+		Client:           httpclient.New(httpclient.Options{Timeout: 10 * time.Second, Retry: httpclient.NoRetry()}),
+		queue:            make(chan *shadowJob, 100),
+		rnd:              rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Start runs workers sending mirrored requests until ctx is done.
+func (sh *Shadow) Start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-sh.queue:
+					sh.send(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+func (sh *Shadow) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !sh.sample(r) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		var reqBody *teeBody
+		if r.Body != nil && r.Body != http.NoBody {
+			reqBody = &teeBody{ReadCloser: r.Body, buf: limitedBuffer{max: sh.MaxBodyBytes}}
+			r.Body = reqBody
+		}
+		job := &shadowJob{
+			method: r.Method,
+			path:   r.URL.RequestURI(),
+			header: r.Header.Clone(),
+		}
+
+		respBody := &limitedBuffer{max: sh.MaxBodyBytes}
+		ww := middleware.NewWrapResponseWriter(rw, r.ProtoMajor)
+		ww.Tee(respBody)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		if respBody.overflow {
+			return
+		}
+		if reqBody != nil {
+			body, ok := reqBody.copied()
+			if !ok {
+				return
+			}
+			job.body = body
+		}
+		job.primaryLatency = time.Since(start)
+		job.primaryStatus = ww.Status()
+		job.primaryBody = respBody.Bytes()
+		select {
+		case sh.queue <- job:
+		default:
+			sh.mu.Lock()
+			sh.stats.Dropped++
+			sh.mu.Unlock()
+		}
+	})
+}
+
+func (sh *Shadow) sample(r *http.Request) bool {
+	if r.Header.Get(ShadowHeader) != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	sh.rndMu.Lock()
+	defer sh.rndMu.Unlock()
+	return sh.rnd.Float64()*100 < sh.Percent
+}
+
+func (sh *Shadow) send(ctx context.Context, job *shadowJob) {
+	pool := sh.Registry.Pool(sh.ServiceName)
+	if pool == nil {
+		return
+	}
+	peer := pool.GetNextPeerForVersion(sh.CandidateVersion)
+	if peer == nil {
+		return
+	}
+	scheme := peer.ServiceProtocol
+	if scheme == "" {
+		scheme = "http"
+	}
+	u := scheme + "://" + peer.BaseURL + job.path
+	if peer.ServiceVersion != "" {
+		u = scheme + "://" + peer.BaseURL + "/" + peer.ServiceVersion + job.path
+	}
+
+	req, err := http.NewRequestWithContext(ctx, job.method, u, bytes.NewReader(job.body))
+	if err != nil {
+		sh.recordError(err)
+		return
+	}
+	req.Header = job.header
+	for _, h := range signatureHeaders() {
+		req.Header.Del(h)
+	}
+	req.Header.Set(ShadowHeader, "true")
+
+	client := sh.Client
+	if sh.Sign != nil {
+		signing := *sh.Client
+		signing.Transport = httpclient.NewSigningTransport(sh.Client.Transport, sh.Sign)
+		client = &signing
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		sh.recordError(err)
+		return
+	}
+	defer resp.Body.Close()
+	candidateBody, err := io.ReadAll(io.LimitReader(resp.Body, sh.MaxBodyBytes))
+	latency := time.Since(start)
+	if err != nil {
+		sh.recordError(err)
+		return
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.stats.Mirrored++
+	sh.stats.primaryTotal += job.primaryLatency
+	sh.stats.candidateTotal += latency
+	if resp.StatusCode != job.primaryStatus {
+		sh.stats.StatusMismatches++
+	}
+	if !sameBody(job.primaryBody, candidateBody) {
+		sh.stats.BodyMismatches++
+	}
+}
+
+func (sh *Shadow) recordError(err error) {
+	log.Printf("shadow: error mirroring to %s %s: %v", sh.ServiceName, sh.CandidateVersion, err)
+	sh.mu.Lock()
+	sh.stats.Errors++
+	sh.mu.Unlock()
+}
+
+func (sh *Shadow) Stats() ShadowStats {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	stats := sh.stats
+	if stats.Mirrored > 0 {
+		stats.PrimaryAvgMs = float64(stats.primaryTotal.Milliseconds()) / float64(stats.Mirrored)
+		stats.CandidateAvgMs = float64(stats.candidateTotal.Milliseconds()) / float64(stats.Mirrored)
+	}
+	return stats
+}
+
+func (sh *Shadow) StatsHandler(rw http.ResponseWriter, r *http.Request) {
+	render.JSON(rw, r, sh.Stats())
+}
+
+// sameBody compares json bodies semantically and anything else byte for byte.
+func sameBody(a, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var ja, jb interface{}
+	if json.Unmarshal(a, &ja) != nil || json.Unmarshal(b, &jb) != nil {
+		return strings.TrimSpace(string(a)) == strings.TrimSpace(string(b))
+	}
+	return reflect.DeepEqual(ja, jb)
+}
+
+// teeBody copies the request body as it is read. The copy is only complete
+// if the body was read to EOF. The transport may still be reading it when
+// the handler returns, hence the lock.
+type teeBody struct {
+	io.ReadCloser
+
+	mu  sync.Mutex
+	buf limitedBuffer
+	eof bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *teeBody) copied() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.eof || b.buf.overflow {
+		return nil, false
+	}
+	return append([]byte(nil), b.buf.Bytes()...), true
+}
+
+// limitedBuffer stops buffering past max and remembers that it overflowed.
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || int64(b.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,128 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Shadow Tests", func() {
+
+	var primary, candidate *httptest.Server
+	var shadowed chan http.Header
+	var bodies chan string
+	var shadow *Shadow
+	var cancel context.CancelFunc
+
+	BeforeEach(func() {
+		shadowed = make(chan http.Header, 10)
+		bodies = make(chan string, 10)
+		primary = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(rw, `{"a": 1, "b": 2}`)
+		}))
+		candidate = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			bodies <- string(body)
+			shadowed <- r.Header
+			if r.URL.Path == "/v2/diff" {
+				rw.WriteHeader(500)
+			}
+			fmt.Fprint(rw, `{"b":2,"a":1}`)
+		}))
+
+		reg := NewRegistry()
+		reg.Register(&models.Service{ServiceName: "echo", ServiceProtocol: "http", ServiceVersion: "v1", ServiceOnline: true, BaseURL: strings.TrimPrefix(primary.URL, "http://")})
+		reg.Register(&models.Service{ServiceName: "echo", ServiceProtocol: "http", ServiceVersion: "v2", ServiceOnline: true, BaseURL: strings.TrimPrefix(candidate.URL, "http://")})
+		reg.Pool("echo").Policy, _ = models.NewTrafficPolicy(map[string]int{"v1": 100})
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		shadow = NewShadow(reg, "echo", "v2", 100)
+		shadow.Start(ctx, 1)
+	})
+
+	AfterEach(func() {
+		cancel()
+		primary.Close()
+		candidate.Close()
+	})
+
+	It("should mirror requests and compare responses", func() {
+		handler := shadow.Middleware(NewProxy(shadow.Registry).Handler("echo"))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "/same", nil))
+		Expect(rw.Body.String()).To(Equal(`{"a": 1, "b": 2}`))
+		Eventually(shadowed).Should(Receive(HaveKeyWithValue(http.CanonicalHeaderKey(ShadowHeader), []string{"true"})))
+
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/diff", nil))
+		Eventually(shadowed).Should(Receive())
+		Eventually(func() int64 { return shadow.Stats().Mirrored }, time.Second).Should(Equal(int64(2)))
+
+		stats := shadow.Stats()
+		Expect(stats.StatusMismatches).To(Equal(int64(1)))
+		Expect(stats.BodyMismatches).To(Equal(int64(0)))
+	})
+
+	It("should mirror the body the primary read", func() {
+		var read string
+		handler := shadow.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			read = string(body)
+			fmt.Fprint(rw, `{"a": 1, "b": 2}`)
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/same", strings.NewReader(`{"id": 7}`)))
+		Expect(read).To(Equal(`{"id": 7}`))
+		Eventually(bodies).Should(Receive(Equal(`{"id": 7}`)))
+	})
+
+	It("should not mirror a body the primary didn't read", func() {
+		handler := shadow.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader(`{"id": 7}`)))
+		Consistently(shadowed, 100*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("should strip the caller's signature and sign with the gateway key", func() {
+		handler := shadow.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+		signed := func() *http.Request {
+			req := httptest.NewRequest("GET", "/same", nil)
+			Expect(utils.SignRequestWithKeyID(req, "caller", "caller-secret")).To(Succeed())
+			req.Header.Set(utils.HmacClientIDHeader, "billing")
+			return req
+		}
+
+		req := signed()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		var header http.Header
+		Eventually(shadowed).Should(Receive(&header))
+		for _, h := range []string{utils.HmacHeader, utils.HmacNonceHeader, utils.HmacTimestampHeader, utils.HmacKeyIDHeader, utils.HmacClientIDHeader} {
+			Expect(header.Get(h)).To(BeEmpty(), h)
+		}
+
+		shadow.Sign = func() (string, string, error) { return "gateway", "gateway-secret", nil }
+		req = signed()
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		Eventually(shadowed).Should(Receive(&header))
+		Expect(header.Get(utils.HmacKeyIDHeader)).To(Equal("gateway"))
+		Expect(header.Get(utils.HmacNonceHeader)).NotTo(BeEmpty())
+		Expect(header.Get(utils.HmacNonceHeader)).NotTo(Equal(req.Header.Get(utils.HmacNonceHeader)))
+		Expect(header.Get(utils.HmacClientIDHeader)).To(BeEmpty())
+	})
+
+	It("should not mirror already shadowed requests", func() {
+		handler := shadow.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(ShadowHeader, "true")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		Consistently(shadowed, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+// StatusHandler fans out to the health route of every registered service
+// and responds with a models.ServicePoolStatus.
+type StatusHandler struct {
+	Registry *Registry
+	// defaults to a client without retries using the registry's tls config.
+	Client *http.Client
+	// per service timeout.
+	Timeout time.Duration
+
+	once sync.Once
+}
+
+func NewStatusHandler(reg *Registry) *StatusHandler {
+	return &StatusHandler{
+		Registry: reg,
+		Timeout:  5 * time.Second,
+	}
+}
+
+func (h *StatusHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	status := h.Collect(r.Context(), reqId)
+	logger.Info("collected status for ", len(status.Services), " services")
+
+	if wantsHTML(r) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(rw, status); err != nil {
+			logger.Error("error rendering status page: ", err)
+		}
+		return
+	}
+	render.JSON(rw, r, status)
+}
+
+func (h *StatusHandler) Collect(ctx context.Context, reqId string) *models.ServicePoolStatus {
+	services := h.Registry.Services()
+	heartbeats := make([]models.Heartbeat, len(services))
+
+	var wg sync.WaitGroup
+	for i, s := range services {
+		wg.Add(1)
+		go func(i int, s *models.Service) {
+			defer wg.Done()
+			heartbeats[i] = h.fetchHeartbeat(ctx, reqId, s)
+		}(i, s)
+	}
+	wg.Wait()
+
+	return &models.ServicePoolStatus{
+		RequestID: reqId,
+		Services:  heartbeats,
+	}
+}
+
+func (h *StatusHandler) fetchHeartbeat(ctx context.Context, reqId string, s *models.Service) models.Heartbeat {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	hb, err := h.getHeartbeat(ctx, reqId, s)
+	if err != nil {
+		return models.Heartbeat{
+			RequestID:      reqId,
+			AppName:        s.ServiceName,
+			ReleaseVersion: s.ServiceVersion,
+			Message:        fmt.Sprintf("unreachable: %v", err),
+		}
+	}
+	if hb.AppName == "" {
+		hb.AppName = s.ServiceName
+	}
+	return hb
+}
+
+func (h *StatusHandler) getHeartbeat(ctx context.Context, reqId string, s *models.Service) (models.Heartbeat, error) {
+	var hb models.Heartbeat
+	u, err := s.HealthURL()
+	if err != nil {
+		return hb, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return hb, err
+	}
+	req.Header.Set(middleware.RequestIDHeader, reqId)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := h.client().Do(req)
+	if err != nil {
+		return hb, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&hb); err != nil {
+		return hb, fmt.Errorf("error decoding heartbeat (status %v): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK && hb.Message == "" {
+		hb.Message = fmt.Sprintf("status %v", resp.StatusCode)
+	}
+	return hb, nil
+}
+
+func (h *StatusHandler) client() *http.Client {
+	h.once.Do(func() {
+		if h.Client == nil {
+			h.Client = httpclient.New(httpclient.Options{Retry: httpclient.NoRetry(), TLSConfig: h.Registry.TLSConfig()})
+		}
+	})
+	return h.Client
+}
+
+func wantsHTML(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "html" {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Service Pool Status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.4em 1em; border-bottom: 1px solid #ddd; text-align: left; }
+.up { color: #2a7d2a; }
+.down { color: #b22222; }
+</style>
+</head>
+<body>
+<h1>Service Pool Status</h1>
+<p>Request ID: {{.RequestID}}</p>
+<table>
+<tr><th>Service</th><th>Version</th><th>Database</th><th>Message</th></tr>
+{{range .Services}}
+<tr>
+<td>{{.AppName}}</td>
+<td>{{.ReleaseVersion}}</td>
+<td>{{if .DatabaseOnline}}<span class="up">online</span>{{else}}<span class="down">offline</span>{{end}}</td>
+<td>{{.Message}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
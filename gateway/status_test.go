@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Status Handler Tests", func() {
+
+	var backend *httptest.Server
+	var handler *StatusHandler
+
+	BeforeEach(func() {
+		backend = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v1/health" {
+				rw.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(rw).Encode(models.Heartbeat{
+				RequestID:      r.Header.Get("X-Request-Id"),
+				DatabaseOnline: true,
+				Message:        "healthy",
+			})
+		}))
+		reg := NewRegistry()
+		reg.Register(&models.Service{ServiceName: "items", ServiceProtocol: "http", ServiceVersion: "v1",
+			BaseURL: strings.TrimPrefix(backend.URL, "http://"), Routes: []byte(`{"health": "/health"}`)})
+		reg.Register(&models.Service{ServiceName: "orders", ServiceProtocol: "http", ServiceVersion: "v1",
+			BaseURL: "127.0.0.1:1", Routes: []byte(`{"health": "/health"}`)})
+		handler = NewStatusHandler(reg)
+	})
+
+	AfterEach(func() {
+		backend.Close()
+	})
+
+	It("should collect the heartbeat of every service", func() {
+		status := handler.Collect(context.Background(), "req-1")
+		Expect(status.RequestID).To(Equal("req-1"))
+		Expect(status.Services).To(HaveLen(2))
+		Expect(status.Services[0].AppName).To(Equal("items"))
+		Expect(status.Services[0].RequestID).To(Equal("req-1"))
+		Expect(status.Services[0].DatabaseOnline).To(BeTrue())
+		Expect(status.Services[1].AppName).To(Equal("orders"))
+		Expect(status.Services[1].Message).To(HavePrefix("unreachable"))
+	})
+
+	It("should render html when asked", func() {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "/status?format=html", nil))
+		Expect(rw.Header().Get("Content-Type")).To(HavePrefix("text/html"))
+		Expect(rw.Body.String()).To(ContainSubstring("<td>items</td>"))
+	})
+})
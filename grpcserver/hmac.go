@@ -0,0 +1,239 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	protov2 "google.golang.org/protobuf/proto"
+)
+
+const (
+	HmacMetadata          = "x-hmac-hash"
+	HmacKeyIDMetadata     = "x-hmac-key-id"
+	HmacTimestampMetadata = "x-hmac-timestamp"
+	HmacNonceMetadata     = "x-hmac-nonce"
+	healthService         = "grpc.health.v1.Health"
+)
+
+// CanonicalCall is utils.CanonicalRequest for grpc, one field per line:
+// version, full method, the HMAC_HEADERS metadata as "name:value", the
+// signed names, the hex sha256 of the deterministically marshalled request
+// message, timestamp and nonce. Streams have no message when they are
+// opened, their digest is of an empty body: the signature covers the call,
+// not the messages sent on it.
+func CanonicalCall(md metadata.MD, method string, msg interface{}, timestamp, nonce string) (string, error) {
+	var body []byte
+	if m, ok := msg.(proto.Message); ok {
+		// map fields are ordered randomly otherwise.
+		b, err := protov2.MarshalOptions{Deterministic: true}.Marshal(proto.MessageV2(m))
+		if err != nil {
+			return "", fmt.Errorf("error marshalling message: %v", err)
+		}
+		body = b
+	}
+	digest := sha256.Sum256(body)
+
+	var names, lines []string
+	for _, h := range strings.Split(os.Getenv("HMAC_HEADERS"), ",") {
+		if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+			names = append(names, h)
+		}
+	}
+	sort.Strings(names)
+	for _, h := range names {
+		var v string
+		if vals := md.Get(h); len(vals) > 0 {
+			v = strings.TrimSpace(vals[0])
+		}
+		lines = append(lines, h+":"+v)
+	}
+
+	return strings.Join([]string{
+		"v" + utils.HmacV2,
+		method,
+		strings.Join(lines, "\n"),
+		strings.Join(names, ";"),
+		hex.EncodeToString(digest[:]),
+		timestamp,
+		nonce,
+	}, "\n"), nil
+}
+
+func CreateHmacHash(md metadata.MD, method string, msg interface{}, secret, timestamp, nonce string) ([]byte, error) {
+	call, err := CanonicalCall(md, method, msg, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return utils.HmacSum(call, secret), nil
+}
+
+func first(md metadata.MD, key string) string {
+	if vals := md.Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+func validate(ctx context.Context, keys *models.HmacKeys, nonces kit_middleware.NonceStore, method string, msg interface{}) error {
+	logger := GetLogEntry(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	hash := first(md, HmacMetadata)
+	if hash == "" {
+		logger.Error("no hmac in metadata. Forbidden request")
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+	given, err := base64.StdEncoding.DecodeString(hash)
+	if err != nil {
+		logger.Error("error decoding hmac hash from metadata: ", err)
+		return status.Error(codes.InvalidArgument, "invalid request")
+	}
+	timestamp, nonce := first(md, HmacTimestampMetadata), first(md, HmacNonceMetadata)
+	if err := utils.CheckHmacTimestamp(timestamp, utils.HmacClockSkew()); err != nil {
+		logger.Error("rejecting hmac: ", err)
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+	if nonce == "" {
+		logger.Error("rejecting hmac: missing nonce")
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+	keyID := first(md, HmacKeyIDMetadata)
+	candidates, err := keys.VerificationKeys(keyID, utils.HmacKeyCompat())
+	if err != nil {
+		logger.Error("rejecting hmac key ", keyID, ": ", err)
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+	call, err := CanonicalCall(md, method, msg, timestamp, nonce)
+	if err != nil {
+		logger.Error("error creating hmac hash: ", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+	validated := false
+	for _, k := range candidates {
+		if hmac.Equal(given, utils.HmacSum(call, k.Value)) {
+			validated = true
+			break
+		}
+	}
+	if !validated {
+		logger.Error("hmac did not match. Forbidden request")
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+
+	// the timestamp parsed above.
+	sec, _ := strconv.ParseInt(timestamp, 10, 64)
+	fresh, err := nonces.Use(ctx, nonce, time.Unix(sec, 0).Add(utils.HmacClockSkew()))
+	if err != nil {
+		logger.Error("error checking hmac nonce: ", err)
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	if !fresh {
+		logger.WithField("nonce", nonce).Error("hmac nonce reused, replayed call. Forbidden request")
+		return status.Error(codes.Unauthenticated, "forbidden")
+	}
+	return nil
+}
+
+func exempt(method string, services []string) bool {
+	for _, s := range services {
+		if strings.HasPrefix(method, "/"+s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// UnaryValidateHmac is middleware.ValidateHmac for grpc. Nonces are recorded
+// in nonces, defaulting to middleware.HmacNonceStore. Methods of the exempt
+// services, i.e. the health service, are not validated.
+func UnaryValidateHmac(keys *models.HmacKeys, nonces kit_middleware.NonceStore, exemptServices ...string) grpc.UnaryServerInterceptor {
+	if nonces == nil {
+		nonces = kit_middleware.HmacNonceStore
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !exempt(info.FullMethod, exemptServices) {
+			if err := validate(ctx, keys, nonces, info.FullMethod, req); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+func StreamValidateHmac(keys *models.HmacKeys, nonces kit_middleware.NonceStore, exemptServices ...string) grpc.StreamServerInterceptor {
+	if nonces == nil {
+		nonces = kit_middleware.HmacNonceStore
+	}
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !exempt(info.FullMethod, exemptServices) {
+			if err := validate(ss.Context(), keys, nonces, info.FullMethod, nil); err != nil {
+				return err
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+// UnaryHmacSigner signs outbound calls with the latest key, for use with
+// grpc.WithUnaryInterceptor on the client connection.
+func UnaryHmacSigner(keys *models.HmacKeys) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, err := sign(ctx, keys, method, req)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func StreamHmacSigner(keys *models.HmacKeys) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, err := sign(ctx, keys, method, nil)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+func sign(ctx context.Context, keys *models.HmacKeys, method string, msg interface{}) (context.Context, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	key, err := keys.LatestKey()
+	if err != nil {
+		return ctx, err
+	}
+	nonce, err := utils.NewNonce()
+	if err != nil {
+		return ctx, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	hash, err := CreateHmacHash(md, method, msg, key.Value, timestamp, nonce)
+	if err != nil {
+		return ctx, err
+	}
+	kv := []string{
+		HmacTimestampMetadata, timestamp,
+		HmacNonceMetadata, nonce,
+		HmacMetadata, base64.StdEncoding.EncodeToString(hash),
+	}
+	if key.ID != "" {
+		kv = append(kv, HmacKeyIDMetadata, key.ID)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...), nil
+}
@@ -0,0 +1,139 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+type testStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *testStream) Context() context.Context {
+	return s.ctx
+}
+
+var _ = Describe("Grpc Hmac Tests", func() {
+
+	keys := &models.HmacKeys{Name: "test", Keys: []models.Key{{ID: "k1", Value: "supersecretkeyvalue"}}}
+	method := "/items.Items/Get"
+	var nonces *kit_middleware.MemoryNonceStore
+
+	message := func() *structpb.Struct {
+		fields := make(map[string]interface{})
+		for i := 0; i < 20; i++ {
+			fields[fmt.Sprintf("field%d", i)] = i
+		}
+		msg, err := structpb.NewStruct(fields)
+		Expect(err).To(BeNil())
+		return msg
+	}
+
+	// signs req with the client interceptor and returns the server side
+	// context the signed metadata arrives in.
+	signed := func(ctx context.Context, req interface{}) context.Context {
+		var out context.Context
+		invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			out = ctx
+			return nil
+		}
+		Expect(UnaryHmacSigner(keys)(ctx, method, req, nil, nil, invoker)).To(Succeed())
+		md, _ := metadata.FromOutgoingContext(out)
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+
+	call := func(ctx context.Context, req interface{}) error {
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) { return req, nil }
+		_, err := UnaryValidateHmac(keys, nonces, healthService)(ctx, req, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	BeforeEach(func() {
+		nonces = kit_middleware.NewMemoryNonceStore(100)
+	})
+
+	AfterEach(func() {
+		os.Clearenv()
+	})
+
+	It("should validate signed calls", func() {
+		req := message()
+		Expect(call(signed(context.Background(), req), req)).To(Succeed())
+	})
+
+	It("should sign messages with map fields deterministically", func() {
+		md := metadata.MD{}
+		first, err := CanonicalCall(md, method, message(), "1", "n")
+		Expect(err).To(BeNil())
+		for i := 0; i < 20; i++ {
+			Expect(CanonicalCall(md, method, message(), "1", "n")).To(Equal(first))
+		}
+	})
+
+	It("should reject a tampered message", func() {
+		req := message()
+		ctx := signed(context.Background(), req)
+		req.Fields["field0"] = structpb.NewNumberValue(100)
+		Expect(status.Code(call(ctx, req))).To(Equal(codes.Unauthenticated))
+	})
+
+	It("should reject replayed calls", func() {
+		req := message()
+		ctx := signed(context.Background(), req)
+		Expect(call(ctx, req)).To(Succeed())
+		Expect(status.Code(call(ctx, req))).To(Equal(codes.Unauthenticated))
+	})
+
+	It("should reject stale and unsigned calls", func() {
+		req := message()
+		md, _ := metadata.FromIncomingContext(signed(context.Background(), req))
+		md.Set(HmacTimestampMetadata, "1000")
+		Expect(status.Code(call(metadata.NewIncomingContext(context.Background(), md), req))).To(Equal(codes.Unauthenticated))
+		Expect(status.Code(call(context.Background(), req))).To(Equal(codes.Unauthenticated))
+	})
+
+	It("should sign the HMAC_HEADERS metadata", func() {
+		os.Setenv("HMAC_HEADERS", "x-tenant")
+		req := message()
+		md, _ := metadata.FromIncomingContext(signed(metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "a"), req))
+		md.Set("x-tenant", "b")
+		Expect(status.Code(call(metadata.NewIncomingContext(context.Background(), md), req))).To(Equal(codes.Unauthenticated))
+	})
+
+	It("should skip exempt services", func() {
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) { return req, nil }
+		info := &grpc.UnaryServerInfo{FullMethod: "/" + healthService + "/Check"}
+		_, err := UnaryValidateHmac(keys, nonces, healthService)(context.Background(), nil, info, handler)
+		Expect(err).To(BeNil())
+	})
+
+	It("should validate and protect streams against replays", func() {
+		var out context.Context
+		streamer := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			out = ctx
+			return nil, nil
+		}
+		_, err := StreamHmacSigner(keys)(context.Background(), &grpc.StreamDesc{}, nil, method, streamer)
+		Expect(err).To(BeNil())
+		md, _ := metadata.FromOutgoingContext(out)
+		ss := &testStream{ctx: metadata.NewIncomingContext(context.Background(), md)}
+
+		validator := StreamValidateHmac(keys, nonces)
+		handler := func(srv interface{}, stream grpc.ServerStream) error { return nil }
+		info := &grpc.StreamServerInfo{FullMethod: method}
+		Expect(validator(nil, ss, info, handler)).To(Succeed())
+		Expect(status.Code(validator(nil, ss, info, handler))).To(Equal(codes.Unauthenticated))
+	})
+})
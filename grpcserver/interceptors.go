@@ -0,0 +1,160 @@
+package grpcserver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const RequestIDMetadata = "x-request-id"
+
+type logEntryCtxKey struct{}
+
+// GetLogEntry returns the request scoped logger set by the logging
+// interceptors, like logger.GetLogEntry for http.
+func GetLogEntry(ctx context.Context) logrus.FieldLogger {
+	if entry, ok := ctx.Value(logEntryCtxKey{}).(logrus.FieldLogger); ok {
+		return entry
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+func GetReqID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(RequestIDMetadata); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+func newLogEntry(ctx context.Context, logger *logrus.Logger, method string) logrus.FieldLogger {
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	logFields := logrus.Fields{
+		"ts":            time.Now().UTC().Format(time.RFC1123),
+		"heroku_app_id": os.Getenv("HEROKU_APP_ID"),
+		"grpc_method":   method,
+	}
+	if reqID := GetReqID(ctx); reqID != "" {
+		logFields["req_id"] = reqID
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		logFields["remote_addr"] = p.Addr.String()
+	}
+	return logrus.NewEntry(logger).WithFields(logFields)
+}
+
+func logComplete(entry logrus.FieldLogger, start time.Time, err error) {
+	entry.WithFields(logrus.Fields{
+		"grpc_code":       status.Code(err).String(),
+		"resp_elapsed_ms": float64(time.Since(start).Nanoseconds()) / 1000000.0,
+	}).Infoln("request complete")
+}
+
+func UnaryLogger(logger *logrus.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		entry := newLogEntry(ctx, logger, info.FullMethod)
+		entry.Infoln("request started")
+		start := time.Now()
+		resp, err := handler(context.WithValue(ctx, logEntryCtxKey{}, entry), req)
+		logComplete(entry, start, err)
+		return resp, err
+	}
+}
+
+func StreamLogger(logger *logrus.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		entry := newLogEntry(ss.Context(), logger, info.FullMethod)
+		entry.Infoln("stream started")
+		start := time.Now()
+		err := handler(srv, &wrappedStream{ss, context.WithValue(ss.Context(), logEntryCtxKey{}, entry)})
+		logComplete(entry, start, err)
+		return err
+	}
+}
+
+func recovered(ctx context.Context, rec interface{}) error {
+	GetLogEntry(ctx).WithFields(logrus.Fields{
+		"stack": string(debug.Stack()),
+		"panic": fmt.Sprintf("%+v", rec),
+	}).Error("panic handling request")
+	return status.Error(codes.Internal, "internal error")
+}
+
+func UnaryRecovery() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = recovered(ctx, rec)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func StreamRecovery() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = recovered(ss.Context(), rec)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+func startTransaction(ctx context.Context, app *newrelic.Application, method string) *newrelic.Transaction {
+	txn := app.StartTransaction(method)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		hdrs := make(map[string][]string, len(md))
+		for k, v := range md {
+			hdrs[k] = v
+		}
+		txn.AcceptDistributedTraceHeaders(newrelic.TransportOther, hdrs)
+	}
+	return txn
+}
+
+func UnaryNewRelic(app *newrelic.Application) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if app == nil {
+			return handler(ctx, req)
+		}
+		txn := startTransaction(ctx, app, info.FullMethod)
+		defer txn.End()
+		resp, err := handler(newrelic.NewContext(ctx, txn), req)
+		if err != nil {
+			txn.NoticeError(err)
+		}
+		txn.AddAttribute("grpcStatusCode", status.Code(err).String())
+		return resp, err
+	}
+}
+
+func StreamNewRelic(app *newrelic.Application) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if app == nil {
+			return handler(srv, ss)
+		}
+		txn := startTransaction(ss.Context(), app, info.FullMethod)
+		defer txn.End()
+		err := handler(srv, &wrappedStream{ss, newrelic.NewContext(ss.Context(), txn)})
+		if err != nil {
+			txn.NoticeError(err)
+		}
+		txn.AddAttribute("grpcStatusCode", status.Code(err).String())
+		return err
+	}
+}
@@ -0,0 +1,82 @@
+package grpcserver
+
+import (
+	"context"
+
+	"github.com/sailsforce/gomicro-kit/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// NewServer creates a grpc server with the kit interceptors: panic recovery,
+// structured logging, NewRelic and, when the config has hmac keys, hmac
+// validation of the request metadata. The standard grpc health service is
+// registered and the returned health server can be used to change status.
+func NewServer(c *config.MicroRestConfig, opts ...grpc.ServerOption) (*grpc.Server, *health.Server) {
+	unary := []grpc.UnaryServerInterceptor{
+		UnaryRecovery(),
+		UnaryLogger(c.Logger),
+		UnaryNewRelic(c.NewRelic.App),
+	}
+	stream := []grpc.StreamServerInterceptor{
+		StreamRecovery(),
+		StreamLogger(c.Logger),
+		StreamNewRelic(c.NewRelic.App),
+	}
+	if c.HmacKeys != nil {
+		unary = append(unary, UnaryValidateHmac(c.HmacKeys, nil, healthService))
+		stream = append(stream, StreamValidateHmac(c.HmacKeys, nil, healthService))
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(ChainUnary(unary...)),
+		grpc.StreamInterceptor(ChainStream(stream...)),
+	}
+	if c.TLS != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(c.TLS)))
+	}
+	server := grpc.NewServer(append(serverOpts, opts...)...)
+
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	return server, healthServer
+}
+
+// ChainUnary runs the interceptors in order, the first one outermost.
+func ChainUnary(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, inner)
+			}
+		}
+		return next(ctx, req)
+	}
+}
+
+func ChainStream(interceptors ...grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		next := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(srv interface{}, ss grpc.ServerStream) error {
+				return interceptor(srv, ss, info, inner)
+			}
+		}
+		return next(srv, ss)
+	}
+}
+
+// wrappedStream replaces the context of a server stream.
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedStream) Context() context.Context {
+	return w.ctx
+}
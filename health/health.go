@@ -0,0 +1,291 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/sailsforce/gomicro-kit/config"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+	"gorm.io/gorm"
+)
+
+type CheckFunc func(ctx context.Context) error
+
+type Check struct {
+	Name string
+	Fn   CheckFunc
+	// critical checks fail readiness, the rest are only reported.
+	Critical bool
+	// overrides Handler.Timeout when set.
+	Timeout time.Duration
+	// database checks also drive Heartbeat.DatabaseOnline.
+	Database bool
+}
+
+// Handler runs registered checks and serves heartbeat, liveness, readiness
+// and startup endpoints.
+type Handler struct {
+	AppName        string
+	ReleaseDate    string
+	ReleaseVersion string
+	Slug           string
+	// per check timeout.
+	Timeout time.Duration
+	// how long check results are reused between probes.
+	CacheTTL time.Duration
+
+	started int32
+
+	mu       sync.Mutex
+	checks   []Check
+	cached   []models.CheckResult
+	cachedDB bool
+	cachedAt time.Time
+}
+
+// NewHandler creates a Handler with release info from the heroku dyno
+// metadata env vars and a check for every database in the config.
+func NewHandler(c *config.MicroRestConfig) *Handler {
+	h := &Handler{
+		AppName:        os.Getenv("HEROKU_APP_NAME"),
+		ReleaseDate:    os.Getenv("HEROKU_RELEASE_CREATED_AT"),
+		ReleaseVersion: os.Getenv("HEROKU_RELEASE_VERSION"),
+		Slug:           os.Getenv("HEROKU_SLUG_COMMIT"),
+		Timeout:        2 * time.Second,
+		CacheTTL:       5 * time.Second,
+	}
+	if h.AppName == "" {
+		h.AppName = c.Service.Name
+	}
+	if h.ReleaseVersion == "" {
+		h.ReleaseVersion = c.Service.Version
+	}
+	if c.DB != nil {
+		h.AddDatabase("database", c.DB)
+	}
+	for i, db := range c.DBList {
+		h.AddDatabase(fmt.Sprintf("database_%d", i), db)
+	}
+	return h
+}
+
+func (h *Handler) AddCheck(check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, check)
+	h.cached = nil
+}
+
+func (h *Handler) AddDatabase(name string, db *gorm.DB) {
+	h.AddCheck(Check{Name: name, Fn: DBCheck(db), Critical: true, Database: true})
+}
+
+func (h *Handler) AddFunc(name string, critical bool, fn CheckFunc) {
+	h.AddCheck(Check{Name: name, Fn: fn, Critical: critical})
+}
+
+// MarkStarted makes the startup probe pass. It also passes after the first
+// successful readiness check.
+func (h *Handler) MarkStarted() {
+	atomic.StoreInt32(&h.started, 1)
+}
+
+func (h *Handler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", h.Heartbeat)
+	r.Get("/live", h.Liveness)
+	r.Get("/ready", h.Readiness)
+	r.Get("/startup", h.Startup)
+	return r
+}
+
+// Heartbeat reports every check and always answers 200, it is meant for
+// dashboards such as the gateway status page rather than orchestrators.
+func (h *Handler) Heartbeat(rw http.ResponseWriter, r *http.Request) {
+	results, dbOnline := h.run()
+	h.respond(rw, r, h.heartbeat(r, results, dbOnline), true)
+}
+
+func (h *Handler) Liveness(rw http.ResponseWriter, r *http.Request) {
+	hb := h.heartbeat(r, nil, true)
+	hb.Message = "alive"
+	h.respond(rw, r, hb, true)
+}
+
+// Readiness answers 503 while a critical check fails.
+func (h *Handler) Readiness(rw http.ResponseWriter, r *http.Request) {
+	results, dbOnline := h.run()
+	h.respond(rw, r, h.heartbeat(r, results, dbOnline), healthy(results))
+}
+
+func (h *Handler) Startup(rw http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.started) == 1 {
+		hb := h.heartbeat(r, nil, true)
+		hb.Message = "started"
+		h.respond(rw, r, hb, true)
+		return
+	}
+	h.Readiness(rw, r)
+}
+
+// Run executes all checks in parallel, reusing the last results if they are
+// younger than CacheTTL. The results are shared by every caller, so checks
+// run detached from any request, bounded by their timeout only.
+func (h *Handler) Run() []models.CheckResult {
+	results, _ := h.run()
+	return results
+}
+
+func (h *Handler) run() ([]models.CheckResult, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cached != nil && time.Since(h.cachedAt) < h.CacheTTL {
+		return h.cached, h.cachedDB
+	}
+
+	results := make([]models.CheckResult, len(h.checks))
+	var wg sync.WaitGroup
+	for i, check := range h.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = h.runCheck(context.Background(), check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	dbOnline := true
+	for i, res := range results {
+		if h.checks[i].Database && !res.Healthy {
+			dbOnline = false
+		}
+	}
+	if healthy(results) {
+		h.MarkStarted()
+	}
+	h.cached, h.cachedDB = results, dbOnline
+	h.cachedAt = time.Now()
+	return results, dbOnline
+}
+
+func (h *Handler) runCheck(ctx context.Context, check Check) models.CheckResult {
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = h.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				errCh <- fmt.Errorf("check panicked: %v", rec)
+			}
+		}()
+		errCh <- check.Fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := models.CheckResult{
+		Name:      check.Name,
+		Healthy:   err == nil,
+		Critical:  check.Critical,
+		ElapsedMs: float64(time.Since(start).Nanoseconds()) / 1000000.0,
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (h *Handler) heartbeat(r *http.Request, results []models.CheckResult, dbOnline bool) *models.Heartbeat {
+	hb := &models.Heartbeat{
+		RequestID:      middleware.GetReqID(r.Context()),
+		DatabaseOnline: dbOnline,
+		AppName:        h.AppName,
+		ReleaseDate:    h.ReleaseDate,
+		ReleaseVersion: h.ReleaseVersion,
+		Slug:           h.Slug,
+		Message:        "healthy",
+		Checks:         results,
+	}
+	if !healthy(results) {
+		hb.Message = "unhealthy"
+	}
+	return hb
+}
+
+func (h *Handler) respond(rw http.ResponseWriter, r *http.Request, hb *models.Heartbeat, ok bool) {
+	if ok {
+		render.Status(r, http.StatusOK)
+	} else {
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+	render.JSON(rw, r, hb)
+}
+
+func healthy(results []models.CheckResult) bool {
+	for _, res := range results {
+		if res.Critical && !res.Healthy {
+			return false
+		}
+	}
+	return true
+}
+
+func DBCheck(db *gorm.DB) CheckFunc {
+	return func(ctx context.Context) error {
+		return utils.PingDB(db.WithContext(ctx))
+	}
+}
+
+// HTTPCheck expects a 2xx from a GET on url, i.e. a downstream health route.
+func HTTPCheck(client *http.Client, url string) CheckFunc {
+	if client == nil {
+		client = httpclient.New(httpclient.Options{Retry: httpclient.NoRetry()})
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status: %v", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// ServiceCheck checks a downstream service through its registered health route.
+func ServiceCheck(client *http.Client, s *models.Service) CheckFunc {
+	return func(ctx context.Context) error {
+		u, err := s.HealthURL()
+		if err != nil {
+			return err
+		}
+		return HTTPCheck(client, u.String())(ctx)
+	}
+}
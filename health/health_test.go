@@ -0,0 +1,135 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/models"
+)
+
+var _ = Describe("Health Handler Tests", func() {
+
+	var h *Handler
+
+	BeforeEach(func() {
+		h = &Handler{AppName: "test", Timeout: 50 * time.Millisecond, CacheTTL: time.Minute}
+	})
+
+	serve := func(handler http.HandlerFunc, r *http.Request) (int, models.Heartbeat) {
+		rw := httptest.NewRecorder()
+		handler(rw, r)
+		var hb models.Heartbeat
+		Expect(json.NewDecoder(rw.Body).Decode(&hb)).To(Succeed())
+		return rw.Code, hb
+	}
+
+	get := func() *http.Request {
+		return httptest.NewRequest("GET", "/", nil)
+	}
+
+	It("should fail readiness on a critical check only", func() {
+		h.AddFunc("cache", false, func(ctx context.Context) error { return errors.New("down") })
+		code, hb := serve(h.Readiness, get())
+		Expect(code).To(Equal(200))
+		Expect(hb.Checks).To(HaveLen(1))
+
+		h.AddDatabase("database", nil)
+		h.checks[1].Fn = func(ctx context.Context) error { return errors.New("down") }
+		code, hb = serve(h.Readiness, get())
+		Expect(code).To(Equal(503))
+		Expect(hb.Message).To(Equal("unhealthy"))
+		Expect(hb.DatabaseOnline).To(BeFalse())
+	})
+
+	It("should report failures in the heartbeat without failing it", func() {
+		h.AddFunc("database", true, func(ctx context.Context) error { return errors.New("down") })
+		code, hb := serve(h.Heartbeat, get())
+		Expect(code).To(Equal(200))
+		Expect(hb.Message).To(Equal("unhealthy"))
+	})
+
+	It("should time out slow checks", func() {
+		h.AddFunc("slow", true, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		results := h.Run()
+		Expect(results[0].Healthy).To(BeFalse())
+		Expect(results[0].Error).To(Equal(context.DeadlineExceeded.Error()))
+	})
+
+	It("should reuse results within the cache ttl", func() {
+		var runs int32
+		h.AddFunc("count", true, func(ctx context.Context) error {
+			atomic.AddInt32(&runs, 1)
+			return nil
+		})
+		h.Run()
+		h.Run()
+		Expect(atomic.LoadInt32(&runs)).To(Equal(int32(1)))
+	})
+
+	It("should not cache the cancellation of the probe that ran the checks", func() {
+		h.AddFunc("db", true, func(ctx context.Context) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Millisecond):
+				return nil
+			}
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		code, _ := serve(h.Readiness, get().WithContext(ctx))
+		Expect(code).To(Equal(200))
+		code, _ = serve(h.Readiness, get())
+		Expect(code).To(Equal(200))
+	})
+
+	It("should pass startup once ready", func() {
+		fail := int32(1)
+		h.CacheTTL = 0
+		h.AddFunc("db", true, func(ctx context.Context) error {
+			if atomic.LoadInt32(&fail) == 1 {
+				return errors.New("starting")
+			}
+			return nil
+		})
+		code, _ := serve(h.Startup, get())
+		Expect(code).To(Equal(503))
+		atomic.StoreInt32(&fail, 0)
+		code, _ = serve(h.Startup, get())
+		Expect(code).To(Equal(200))
+		atomic.StoreInt32(&fail, 1)
+		code, hb := serve(h.Startup, get())
+		Expect(code).To(Equal(200))
+		Expect(hb.Message).To(Equal("started"))
+	})
+
+	It("should allow checks to be added while probes run", func() {
+		h.CacheTTL = 0
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				h.AddFunc("noop", false, func(ctx context.Context) error { return nil })
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				serve(h.Readiness, get())
+			}()
+		}
+		wg.Wait()
+		Expect(h.Run()).To(HaveLen(10))
+	})
+})
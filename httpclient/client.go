@@ -0,0 +1,281 @@
+package httpclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+type Options struct {
+	// per attempt timeout. zero means no timeout beyond the request context.
+	Timeout time.Duration
+	Retry   RetryPolicy
+	// optional, shared between clients to cap retries across the process.
+	Budget *RetryBudget
+	// defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	// used with the default transport, i.e. for mTLS.
+	TLSConfig *tls.Config
+	// optional, signs every attempt, see NewSigningTransport.
+	Sign SigningKeyFunc
+	// sent with signed requests to select the caller's keyset, i.e.
+	// HmacKeys.Name.
+	ClientID string
+	// optional, rejects responses not signed with these keys, see
+	// NewVerifyingTransport.
+	VerifyResponses VerifyKeyFunc
+	// the headers signatures travel in, empty names take the defaults, see
+	// middleware.HmacOptions.Headers.
+	Headers utils.HmacHeaderNames
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Timeout: 10 * time.Second,
+		Retry:   DefaultRetryPolicy(),
+	}
+}
+
+// New returns an http.Client that applies a per attempt timeout and retries
+// failed requests according to opts.Retry.
+func New(opts Options) *http.Client {
+	return &http.Client{Transport: NewTransport(opts)}
+}
+
+func Default() *http.Client {
+	return New(DefaultOptions())
+}
+
+func NewTransport(opts Options) http.RoundTripper {
+	base := opts.Transport
+	if base == nil {
+		base = http.DefaultTransport
+		if opts.TLSConfig != nil {
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.TLSClientConfig = opts.TLSConfig
+			base = t
+		}
+	}
+	headers := opts.Headers.WithDefaults()
+	if opts.VerifyResponses != nil {
+		// under the signing transport, to see the nonce the response is bound to.
+		base = &verifyingTransport{base: base, keys: opts.VerifyResponses, headers: headers}
+	}
+	if opts.Sign != nil {
+		base = &signingTransport{base: base, key: opts.Sign, clientID: opts.ClientID, headers: headers}
+	}
+	return &retryTransport{
+		base:    base,
+		timeout: opts.Timeout,
+		policy:  opts.Retry,
+		budget:  opts.Budget,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+type retryTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+	policy  RetryPolicy
+	budget  *RetryBudget
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	retryable := t.policy.canRetry(req)
+	// only bodies that may be replayed are buffered, the rest are streamed.
+	if retryable {
+		if err := rewindable(req); err != nil {
+			return nil, &Error{Method: req.Method, URL: req.URL.String(), Err: err}
+		}
+	}
+	if t.budget != nil {
+		t.budget.request()
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, &Error{Method: req.Method, URL: req.URL.String(), Attempts: attempt, Err: err}
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		resp, err := t.attempt(req)
+		if !retryable || attempt >= t.policy.MaxRetries || !t.policy.shouldRetry(resp, err) {
+			if err != nil {
+				return nil, &Error{Method: req.Method, URL: req.URL.String(), Attempts: attempt + 1, Err: err}
+			}
+			return resp, nil
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				if after > t.policy.MaxDelay {
+					return resp, nil
+				}
+				if after > delay {
+					delay = after
+				}
+			}
+		}
+		if t.budget != nil && !t.budget.withdraw() {
+			if err != nil {
+				return nil, &Error{Method: req.Method, URL: req.URL.String(), Attempts: attempt + 1, Err: ErrBudgetExhausted}
+			}
+			return resp, nil
+		}
+		if resp != nil {
+			drain(resp)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, &Error{Method: req.Method, URL: req.URL.String(), Attempts: attempt + 1, Err: req.Context().Err()}
+		case <-timer.C:
+		}
+	}
+}
+
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.timeout == 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// keep the attempt context alive until the body is consumed.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoff is exponential with full jitter.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.policy.BaseDelay
+	for i := 0; i < attempt && d < t.policy.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > t.policy.MaxDelay {
+		d = t.policy.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.rnd.Int63n(int64(d)) + 1)
+}
+
+// rewindable makes sure the body can be replayed for retries, buffering it
+// in memory unless the request has a GetBody.
+func rewindable(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return nil
+	}
+	if req.GetBody != nil {
+		return nil
+	}
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(bodyBytes)), nil
+	}
+	return nil
+}
+
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, true
+	}
+	if when, err := http.ParseTime(v); err == nil {
+		return time.Until(when), true
+	}
+	return 0, false
+}
+
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// Error is returned when a request fails without a response.
+type Error struct {
+	Method   string
+	URL      string
+	Attempts int
+	Err      error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s failed after %d attempt(s): %v", e.Method, e.URL, e.Attempts, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// StatusError is a non 2xx response turned into an error by CheckResponse.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s returned status %d", e.Method, e.URL, e.StatusCode)
+}
+
+// CheckResponse returns a StatusError for non 2xx responses.
+func CheckResponse(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{
+			Method:     resp.Request.Method,
+			URL:        resp.Request.URL.String(),
+			StatusCode: resp.StatusCode,
+		}
+	}
+	return nil
+}
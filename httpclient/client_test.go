@@ -0,0 +1,116 @@
+package httpclient_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+)
+
+var _ = Describe("Client Tests", func() {
+
+	var calls int32
+	var statuses []int
+	var bodies []string
+	var server *httptest.Server
+
+	opts := httpclient.Options{
+		Timeout: time.Second,
+		Retry: httpclient.RetryPolicy{
+			MaxRetries: 2,
+			BaseDelay:  time.Millisecond,
+			MaxDelay:   10 * time.Millisecond,
+		},
+	}
+
+	BeforeEach(func() {
+		calls = 0
+		statuses = []int{503, 503, 200}
+		bodies = nil
+		server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&calls, 1)
+			b, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			rw.WriteHeader(statuses[n-1])
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should retry idempotent requests", func() {
+		resp, err := httpclient.New(opts).Get(server.URL)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(calls).To(Equal(int32(3)))
+	})
+
+	It("should stream the body of requests that won't be retried", func() {
+		got := make(chan struct{})
+		stream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			buf := make([]byte, 5)
+			io.ReadFull(r.Body, buf)
+			close(got)
+			io.ReadAll(r.Body)
+		}))
+		defer stream.Close()
+
+		pr, pw := io.Pipe()
+		streamed := make(chan bool, 1)
+		go func() {
+			pw.Write([]byte("hello"))
+			select {
+			case <-got:
+				streamed <- true
+			case <-time.After(time.Second):
+				streamed <- false
+			}
+			pw.Close()
+		}()
+		resp, err := httpclient.New(opts).Post(stream.URL, "text/plain", pr)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(<-streamed).To(BeTrue())
+	})
+
+	It("should not retry a POST by default", func() {
+		resp, err := httpclient.New(opts).Post(server.URL, "text/plain", strings.NewReader("hi"))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(503))
+		Expect(calls).To(Equal(int32(1)))
+	})
+
+	It("should replay the body for requests marked idempotent", func() {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader("hi"))
+		resp, err := httpclient.New(opts).Do(httpclient.Idempotent(req))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(bodies).To(Equal([]string{"hi", "hi", "hi"}))
+	})
+
+	It("should stop retrying when the budget is exhausted", func() {
+		o := opts
+		o.Budget = httpclient.NewRetryBudget(0, 1, time.Minute)
+		resp, err := httpclient.New(o).Get(server.URL)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(503))
+		Expect(calls).To(Equal(int32(2)))
+	})
+
+	It("should return a structured error on transport failure", func() {
+		server.Close()
+		_, err := httpclient.New(opts).Get(server.URL)
+		Expect(err).ToNot(BeNil())
+		var kitErr *httpclient.Error
+		Expect(errors.As(err, &kitErr)).To(BeTrue())
+		Expect(kitErr.Attempts).To(Equal(3))
+	})
+})
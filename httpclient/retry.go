@@ -0,0 +1,118 @@
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// by default only idempotent methods, or requests marked with
+	// Idempotent, are retried.
+	RetryNonIdempotent bool
+	// decides if an attempt should be retried. defaults to transport errors
+	// and 429, 502, 503 and 504 responses.
+	RetryOn func(resp *http.Response, err error) bool
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  100 * time.Millisecond,
+		MaxDelay:   5 * time.Second,
+	}
+}
+
+func NoRetry() RetryPolicy {
+	return RetryPolicy{}
+}
+
+func (p RetryPolicy) canRetry(req *http.Request) bool {
+	if p.MaxRetries == 0 {
+		return false
+	}
+	if p.RetryNonIdempotent {
+		return true
+	}
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	if req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	marked, _ := req.Context().Value(idempotentCtxKey{}).(bool)
+	return marked
+}
+
+func (p RetryPolicy) shouldRetry(resp *http.Response, err error) bool {
+	if p.RetryOn != nil {
+		return p.RetryOn(resp, err)
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+type idempotentCtxKey struct{}
+
+// Idempotent marks a request as safe to retry regardless of its method.
+func Idempotent(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), idempotentCtxKey{}, true))
+}
+
+// RetryBudget caps retries to a ratio of requests within a window, so a
+// failing dependency isn't hit with a multiple of its normal load.
+type RetryBudget struct {
+	// retries allowed per request, i.e. 0.2 for 20%.
+	Ratio float64
+	// retries always allowed per window.
+	MinRetries int
+	Window     time.Duration
+
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+func NewRetryBudget(ratio float64, minRetries int, window time.Duration) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, MinRetries: minRetries, Window: window}
+}
+
+func (b *RetryBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	b.requests++
+}
+
+func (b *RetryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll()
+	allowed := b.MinRetries + int(float64(b.requests)*b.Ratio)
+	if b.retries >= allowed {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *RetryBudget) roll() {
+	if time.Since(b.windowStart) > b.Window {
+		b.windowStart = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
@@ -0,0 +1,53 @@
+package httpclient
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+// SigningKeyFunc returns the id and value of the key to sign with, called for
+// every request so rotated keys are picked up, i.e. models.HmacKeys.SigningKey.
+// Returning ErrSkipSigning sends the request unsigned.
+type SigningKeyFunc func() (id, secret string, err error)
+
+// ErrSkipSigning is returned by a SigningKeyFunc that has no keys yet.
+var ErrSkipSigning = errors.New("skip signing")
+
+// NewSigningTransport signs every request with utils.SignRequestWithKeyID
+// before passing it to base. The caller's request is not modified. Used
+// through Options.Sign it runs under the retries, so every attempt gets its
+// own timestamp and nonce.
+func NewSigningTransport(base http.RoundTripper, key SigningKeyFunc) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &signingTransport{base: base, key: key, headers: utils.DefaultHmacHeaderNames()}
+}
+
+type signingTransport struct {
+	base     http.RoundTripper
+	key      SigningKeyFunc
+	clientID string
+	headers  utils.HmacHeaderNames
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	id, secret, err := t.key()
+	if err == ErrSkipSigning {
+		return t.base.RoundTrip(req)
+	}
+	if err != nil {
+		return nil, &Error{Method: req.Method, URL: req.URL.String(), Err: err}
+	}
+	if t.clientID != "" {
+		req.Header.Set(utils.HmacClientIDHeader, t.clientID)
+	}
+	if err := utils.SignRequestWithKeyID(req, id, secret); err != nil {
+		return nil, &Error{Method: req.Method, URL: req.URL.String(), Err: err}
+	}
+	t.headers.Rename(req.Header)
+	return t.base.RoundTrip(req)
+}
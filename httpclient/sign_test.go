@@ -0,0 +1,83 @@
+package httpclient_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Signing Transport Tests", func() {
+
+	var calls int32
+	var server *httptest.Server
+	keys := &models.HmacKeys{Keys: []models.Key{{ID: "k1", Value: "supersecretkeyvalue"}}}
+
+	BeforeEach(func() {
+		os.Setenv("HMAC_SECRETS", `{"keys": [{"id": "k1", "value": "supersecretkeyvalue"}]}`)
+		calls = 0
+		server = httptest.NewServer(kit_middleware.ValidateHmac(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			b, _ := io.ReadAll(r.Body)
+			if atomic.AddInt32(&calls, 1) == 1 {
+				rw.WriteHeader(503)
+				return
+			}
+			rw.Write(b)
+		})))
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.Clearenv()
+	})
+
+	It("should sign every attempt with a fresh nonce", func() {
+		c := httpclient.New(httpclient.Options{
+			Retry: httpclient.RetryPolicy{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+			Sign:  keys.SigningKey,
+		})
+		req, _ := http.NewRequest("PUT", server.URL+"/items/1", strings.NewReader("payload"))
+		resp, err := c.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(200))
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(Equal("payload"))
+		Expect(calls).To(Equal(int32(2)))
+		Expect(req.Header.Get(utils.HmacHeader)).To(BeEmpty())
+	})
+
+	It("should sign a body that can't be rewound", func() {
+		atomic.StoreInt32(&calls, 1)
+		c := &http.Client{Transport: httpclient.NewSigningTransport(nil, keys.SigningKey)}
+		req, _ := http.NewRequest("POST", server.URL+"/items", io.NopCloser(strings.NewReader("payload")))
+		resp, err := c.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(200))
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(Equal("payload"))
+	})
+
+	It("should be rejected without signing", func() {
+		resp, err := httpclient.New(httpclient.Options{Retry: httpclient.NoRetry()}).Get(server.URL)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(401))
+	})
+
+	It("should send unsigned when told to skip signing", func() {
+		skip := func() (string, string, error) { return "", "", httpclient.ErrSkipSigning }
+		c := httpclient.New(httpclient.Options{Retry: httpclient.NoRetry(), Sign: skip})
+		resp, err := c.Get(server.URL)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(401))
+	})
+})
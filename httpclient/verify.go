@@ -0,0 +1,140 @@
+package httpclient
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+var (
+	ErrResponseUnsigned  = errors.New("response is not signed")
+	ErrResponseSignature = errors.New("response signature did not verify")
+)
+
+// VerifyKeyFunc returns the secrets a response signed with key id may have
+// been signed with, i.e. models.HmacKeys.VerificationSecrets.
+type VerifyKeyFunc func(id string) ([]string, error)
+
+// NewVerifyingTransport rejects responses whose X-HMAC-RESPONSE signature
+// doesn't match, see middleware.SignResponse. Signed headers are buffered up
+// to maxBody bytes and verified before the response is returned; trailer
+// signed responses are verified as the body is read, the final Read
+// returning ErrResponseSignature on a mismatch. The timestamp is checked when
+// the headers arrive, so streams may outlast the clock skew. It expects the default
+// header names, Options.Headers renames them.
+func NewVerifyingTransport(base http.RoundTripper, keys VerifyKeyFunc, maxBody int64) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &verifyingTransport{base: base, keys: keys, maxBody: maxBody, headers: utils.DefaultHmacHeaderNames()}
+}
+
+type verifyingTransport struct {
+	base    http.RoundTripper
+	keys    VerifyKeyFunc
+	maxBody int64
+	headers utils.HmacHeaderNames
+}
+
+func (t *verifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*http.Response, error) {
+		resp.Body.Close()
+		return nil, &Error{Method: req.Method, URL: req.URL.String(), Err: err}
+	}
+
+	if _, ok := resp.Trailer[http.CanonicalHeaderKey(t.headers.Response)]; ok {
+		if err := t.checkTimestamp(resp); err != nil {
+			return fail(err)
+		}
+		resp.Body = &verifyingBody{
+			ReadCloser: resp.Body,
+			hash:       sha256.New(),
+			verify: func(digest string) error {
+				return t.verify(req, resp, resp.Trailer.Get(t.headers.Response), digest)
+			},
+		}
+		return resp, nil
+	}
+
+	sig := resp.Header.Get(t.headers.Response)
+	if sig == "" {
+		return fail(ErrResponseUnsigned)
+	}
+	if err := t.checkTimestamp(resp); err != nil {
+		return fail(err)
+	}
+	maxBody := t.maxBody
+	if maxBody <= 0 {
+		maxBody = utils.HmacMaxBodyBytes()
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	if err != nil {
+		return fail(err)
+	}
+	if int64(len(body)) > maxBody {
+		return fail(utils.ErrBodyTooLarge)
+	}
+	resp.Body.Close()
+	sum := sha256.Sum256(body)
+	if err := t.verify(req, resp, sig, hex.EncodeToString(sum[:])); err != nil {
+		return fail(err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func (t *verifyingTransport) checkTimestamp(resp *http.Response) error {
+	return utils.CheckHmacTimestamp(resp.Header.Get(t.headers.Timestamp), utils.HmacClockSkew())
+}
+
+// verify checks the signature only, the timestamp was checked with the
+// headers.
+func (t *verifyingTransport) verify(req *http.Request, resp *http.Response, sig64, digest string) error {
+	sig, err := base64.StdEncoding.DecodeString(sig64)
+	if err != nil || len(sig) == 0 {
+		return ErrResponseSignature
+	}
+	timestamp := resp.Header.Get(t.headers.Timestamp)
+	secrets, err := t.keys(resp.Header.Get(t.headers.KeyID))
+	if err != nil {
+		return err
+	}
+	msg := utils.CanonicalResponse(resp.StatusCode, resp.Header, req.Method, req.Header.Get(t.headers.Nonce), digest, timestamp)
+	for _, secret := range secrets {
+		if hmac.Equal(sig, utils.HmacSum(msg, secret)) {
+			return nil
+		}
+	}
+	return ErrResponseSignature
+}
+
+type verifyingBody struct {
+	io.ReadCloser
+	hash   hash.Hash
+	verify func(digest string) error
+	done   bool
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !b.done {
+		b.done = true
+		if verr := b.verify(hex.EncodeToString(b.hash.Sum(nil))); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,185 @@
+package httpclient_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sailsforce/gomicro-kit/httpclient"
+	kit_middleware "github.com/sailsforce/gomicro-kit/middleware"
+	"github.com/sailsforce/gomicro-kit/models"
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Verifying Transport Tests", func() {
+
+	keys := &models.HmacKeys{Keys: []models.Key{{ID: "k1", Value: "supersecretkeyvalue"}}}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(201)
+		rw.Write([]byte(`{"id":`))
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+		rw.Write([]byte(`1}`))
+	})
+
+	var client *http.Client
+
+	BeforeEach(func() {
+		os.Setenv("HMAC_SECRETS", `{"keys": [{"id": "k1", "value": "supersecretkeyvalue"}]}`)
+		client = httpclient.New(httpclient.Options{
+			Retry:           httpclient.NoRetry(),
+			Sign:            keys.SigningKey,
+			VerifyResponses: keys.VerificationSecrets,
+		})
+	})
+
+	AfterEach(func() {
+		os.Clearenv()
+	})
+
+	It("should verify a response signed in a header", func() {
+		server := httptest.NewServer(kit_middleware.SignResponse(handler))
+		defer server.Close()
+		resp, err := client.Get(server.URL)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(201))
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(Equal(`{"id":1}`))
+	})
+
+	It("should verify a response signed in a trailer", func() {
+		server := httptest.NewServer(kit_middleware.SignResponseTrailer(handler))
+		defer server.Close()
+		resp, err := client.Get(server.URL)
+		Expect(err).To(BeNil())
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(string(body)).To(Equal(`{"id":1}`))
+	})
+
+	It("should verify a stream that outlasts the clock skew", func() {
+		os.Setenv("HMAC_CLOCK_SKEW", "1s")
+		server := httptest.NewServer(kit_middleware.SignResponseTrailer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Write([]byte(`{"id":`))
+			rw.(http.Flusher).Flush()
+			time.Sleep(2100 * time.Millisecond)
+			rw.Write([]byte(`1}`))
+		})))
+		defer server.Close()
+		resp, err := client.Get(server.URL)
+		Expect(err).To(BeNil())
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(string(body)).To(Equal(`{"id":1}`))
+	})
+
+	It("should reject a stale streamed response before it is read", func() {
+		server := httptest.NewServer(stale(kit_middleware.SignResponseTrailer(handler)))
+		defer server.Close()
+		_, err := client.Get(server.URL)
+		Expect(err).To(MatchError(ContainSubstring(utils.ErrHmacTimestamp.Error())))
+	})
+
+	It("should reject a tampered response", func() {
+		server := httptest.NewServer(tamper(kit_middleware.SignResponse(handler)))
+		defer server.Close()
+		_, err := client.Get(server.URL)
+		Expect(err).To(MatchError(ContainSubstring(httpclient.ErrResponseSignature.Error())))
+	})
+
+	It("should reject a tampered streamed response when read", func() {
+		server := httptest.NewServer(tamper(kit_middleware.SignResponseTrailer(handler)))
+		defer server.Close()
+		resp, err := client.Get(server.URL)
+		Expect(err).To(BeNil())
+		_, err = io.ReadAll(resp.Body)
+		Expect(err).To(Equal(httpclient.ErrResponseSignature))
+	})
+
+	It("should reject an unsigned response", func() {
+		server := httptest.NewServer(handler)
+		defer server.Close()
+		_, err := client.Get(server.URL)
+		Expect(err).To(MatchError(ContainSubstring(httpclient.ErrResponseUnsigned.Error())))
+	})
+
+	It("should sign and verify with custom header names", func() {
+		names := utils.HmacHeaderNames{Hash: "X-Sig", Nonce: "X-Sig-Nonce", Timestamp: "X-Sig-Time", KeyID: "X-Sig-Key", Response: "X-Sig-Response"}
+		opts := kit_middleware.DefaultHmacOptions()
+		opts.Headers = names
+		server := httptest.NewServer(kit_middleware.NewHmacValidator(opts).Validate(kit_middleware.NewHmacSigner(opts).SignResponse(handler)))
+		defer server.Close()
+
+		custom := httpclient.New(httpclient.Options{
+			Retry:           httpclient.NoRetry(),
+			Sign:            keys.SigningKey,
+			VerifyResponses: keys.VerificationSecrets,
+			Headers:         names,
+		})
+		resp, err := custom.Get(server.URL)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(201))
+		Expect(resp.Header.Get("X-Sig-Response")).NotTo(BeEmpty())
+		Expect(resp.Header.Get(utils.HmacResponseHeader)).To(BeEmpty())
+
+		// the default names don't find the signature.
+		_, err = client.Get(server.URL)
+		Expect(err).NotTo(BeNil())
+	})
+})
+
+// tamper rewrites the body on its way out, after it was signed.
+func tamper(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(tamperWriter{rw}, r)
+	})
+}
+
+type tamperWriter struct {
+	http.ResponseWriter
+}
+
+func (w tamperWriter) Write(p []byte) (int, error) {
+	out := append([]byte(nil), p...)
+	for i, c := range out {
+		if c == '1' {
+			out[i] = '2'
+		}
+	}
+	return w.ResponseWriter.Write(out)
+}
+
+func (w tamperWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// stale backdates the signed timestamp as the headers are written.
+func stale(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(staleWriter{rw}, r)
+	})
+}
+
+type staleWriter struct {
+	http.ResponseWriter
+}
+
+func (w staleWriter) WriteHeader(status int) {
+	w.Header().Set(utils.HmacTimestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w staleWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
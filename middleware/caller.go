@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+)
+
+type callerCtxKey struct{}
+
+// GetCaller returns the name of the client keyset a request was validated
+// with, or "" for requests validated with the default HMAC_SECRETS keyset.
+func GetCaller(ctx context.Context) string {
+	caller, _ := ctx.Value(callerCtxKey{}).(string)
+	return caller
+}
+
+// AllowCallers rejects requests not validated by one of the named callers.
+// Use after ValidateHmac, i.e. on a route group.
+func AllowCallers(names ...string) func(next http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(names))
+	for _, n := range names {
+		allowed[n] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			logger := kit_logger.GetLogEntry(r)
+			reqId := middleware.GetReqID(r.Context())
+
+			caller := GetCaller(r.Context())
+			if !allowed[caller] {
+				logger.Error("caller ", strconv.Quote(caller), " is not allowed. Forbidden request")
+				logger.Debug(render.Render(rw, r, kit_errors.ErrFobiddenRequest(reqId)))
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func withCaller(r *http.Request, caller string) *http.Request {
+	if caller == "" {
+		return r
+	}
+	kit_logger.LogEntrySetField(r, "caller", caller)
+	return r.WithContext(context.WithValue(r.Context(), callerCtxKey{}, caller))
+}
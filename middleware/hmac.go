@@ -1,110 +1,74 @@
 package middleware
 
 import (
-	"bytes"
 	"crypto/hmac"
-	"encoding/base64"
 	"net/http"
-	"os"
+	"strconv"
+	"time"
 
-	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/render"
-	kit_errors "github.com/sailsforce/gomicro-kit/errors"
 	kit_logger "github.com/sailsforce/gomicro-kit/logger"
 	kit_models "github.com/sailsforce/gomicro-kit/models"
 	kit_utils "github.com/sailsforce/gomicro-kit/utils"
 )
 
+// HmacHash signs requests with the latest key of HMAC_SECRETS, see
+// NewHmacSigner for other key sources.
 func HmacHash(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		logger := kit_logger.GetLogEntry(r)
-		reqId := middleware.GetReqID(r.Context())
-
-		logger.Info("creating hmach hash...")
-
-		keys, err := loadHmacKeys()
-		if err != nil {
-			logger.Error("error loading hmac keys: ", err)
-			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
-			return
-		}
-
-		key := keys.GetLatestKey()
-		logger.Info("retrieved latest key.")
-		logger.Debug("key: ", key)
-
-		hmacByte := kit_utils.CreateHmacHash(r, key)
-		logger.Debug("hmac hash: ", hmacByte)
-
-		//base64 encode
-		hmac64 := base64.StdEncoding.EncodeToString(hmacByte)
-		// add to headers
-		r.Header.Add("X-HMAC-HASH", hmac64)
-		logger.Info("hmac added to header.")
-
-		next.ServeHTTP(rw, r)
-	})
+	return NewHmacSigner(DefaultHmacOptions()).Sign(next)
 }
 
+// ValidateHmac validates requests against HMAC_SECRETS and
+// HMAC_CLIENT_SECRETS, read once and cached for DefaultHmacKeyRefresh. See
+// NewHmacValidator for other key sources and options.
 func ValidateHmac(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		logger := kit_logger.GetLogEntry(r)
-		reqId := middleware.GetReqID(r.Context())
-
-		logger.Info("validating hmac...")
-
-		logger.Debug("getting hmac from header...")
-		headerValue64 := r.Header.Get("X-HMAC-HASH")
-		logger.Debug("retrieved from header.")
-
-		logger.Debug("create hash for validation.")
-		keys, err := loadHmacKeys()
-		if err != nil {
-			logger.Error("error loading hmac keys: ", err)
-			logger.Debug(render.Render(rw, r, kit_errors.ErrInternal(reqId)))
-			return
-		}
-
-		// validate
-		headerValue, err := base64.StdEncoding.DecodeString(headerValue64)
-		if err != nil {
-			logger.Error("error decoding hmac hash from header: ", err)
-			logger.Debug(render.Render(rw, r, kit_errors.ErrInvalidRequest(reqId)))
-			return
-		}
-		logger.Debug("header hmac: ", headerValue)
-
-		logger.Info("validating...")
-		validated := validateHmacKeys(keys, headerValue, r)
-		if !validated {
-			logger.Error("hmac did not match. Forbidden request")
-			logger.Debug(render.Render(rw, r, kit_errors.ErrFobiddenRequest(reqId)))
-			return
-		}
+	return NewHmacValidator(DefaultHmacOptions()).Validate(next)
+}
 
-		next.ServeHTTP(rw, r)
-	})
+// UseNonce records the nonce of a validated request until its timestamp
+// leaves the skew window, rejecting it if it was already used. On error the
+// status is the one to fail the request with.
+func UseNonce(r *http.Request, store NonceStore, nonce, timestamp string) (int, error) {
+	logger := kit_logger.GetLogEntry(r)
+
+	// the timestamp was checked before the signature, it parses.
+	sec, _ := strconv.ParseInt(timestamp, 10, 64)
+	expires := time.Unix(sec, 0).Add(kit_utils.HmacClockSkew())
+	fresh, err := store.Use(r.Context(), nonce, expires)
+	if err == ErrNonceStoreFull {
+		logger.Error("hmac nonce store full, refusing request")
+		return http.StatusServiceUnavailable, err
+	}
+	if err != nil {
+		logger.Error("error checking hmac nonce: ", err)
+		return http.StatusInternalServerError, err
+	}
+	if !fresh {
+		logger.WithField("nonce", nonce).Error("hmac nonce reused, replayed request from ", r.RemoteAddr, ". Forbidden request")
+		return http.StatusUnauthorized, ErrHmacReplayed
+	}
+	return http.StatusOK, nil
 }
 
-func validateHmacKeys(keys *kit_models.HmacKeys, headerHmac []byte, req *http.Request) bool {
+func validateHmacKeys(keys []kit_models.Key, headerHmac []byte, req *http.Request, version, timestamp, nonce string) (bool, error) {
 	logger := kit_logger.GetLogEntry(req)
-	for _, v := range keys.Keys {
-		expected := kit_utils.CreateHmacHash(req, v.Value)
+	// the message doesn't depend on the key, build it once.
+	var msg string
+	var err error
+	if version == kit_utils.HmacV2 {
+		msg, err = kit_utils.CanonicalRequest(req, timestamp, nonce)
+	} else {
+		msg, err = kit_utils.HmacV1Message(req)
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, v := range keys {
+		expected := kit_utils.HmacSum(msg, v.Value)
 		logger.Debug("Checking header against: ", expected)
 		if hmac.Equal(headerHmac, expected) {
-			return true
+			return true, nil
 		}
 	}
 	logger.Info("no keys matched.")
-	return false
-}
-
-func loadHmacKeys() (*kit_models.HmacKeys, error) {
-	var keys *kit_models.HmacKeys
-	err := render.DecodeJSON(bytes.NewReader([]byte(os.Getenv("HMAC_SECRETS"))), &keys)
-	if err != nil {
-		return nil, err
-	}
-
-	return keys, nil
+	return false, nil
 }
@@ -0,0 +1,270 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("Hmac Tests", func() {
+
+	secret := "supersecretkeyvalue"
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+
+	serve := func(r *http.Request) int {
+		rw := httptest.NewRecorder()
+		ValidateHmac(ok).ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	BeforeEach(func() {
+		os.Setenv("HMAC_SECRETS", `{"name": "test", "keys": [{"created": "2021-10-12T18:00:42Z", "value": "`+secret+`"}]}`)
+		os.Setenv("HMAC_HEADERS", "X-Client")
+	})
+
+	AfterEach(func() {
+		os.Clearenv()
+	})
+
+	Describe("v2 signatures", func() {
+		It("should accept a signed request", func() {
+			r := httptest.NewRequest("POST", "/items?b=2&a=1", strings.NewReader("a=1"))
+			r.Header.Set("X-Client", "tests")
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			Expect(serve(r)).To(Equal(200))
+		})
+
+		It("should reject a request replayed against another path", func() {
+			r := httptest.NewRequest("DELETE", "/items/1", nil)
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			r.URL.Path = "/items/2"
+			Expect(serve(r)).To(Equal(401))
+		})
+
+		It("should reject a replayed request", func() {
+			r := httptest.NewRequest("POST", "/items", strings.NewReader("a=1"))
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			replay := r.Clone(r.Context())
+			replay.Body = io.NopCloser(strings.NewReader("a=1"))
+			Expect(serve(r)).To(Equal(200))
+			Expect(serve(replay)).To(Equal(401))
+		})
+
+		It("should answer 503 when the nonce store is full", func() {
+			defer func(store NonceStore) { HmacNonceStore = store }(HmacNonceStore)
+			HmacNonceStore = NewMemoryNonceStore(1)
+			for _, code := range []int{200, 503} {
+				r := httptest.NewRequest("GET", "/items", nil)
+				Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+				Expect(serve(r)).To(Equal(code))
+			}
+		})
+
+		It("should reject a stale timestamp", func() {
+			r := httptest.NewRequest("GET", "/items", nil)
+			timestamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+			hash, err := kit_utils.CreateHmacHashV2(r, secret, timestamp, "nonce")
+			Expect(err).To(BeNil())
+			r.Header.Set(kit_utils.HmacVersionHeader, kit_utils.HmacV2)
+			r.Header.Set(kit_utils.HmacTimestampHeader, timestamp)
+			r.Header.Set(kit_utils.HmacNonceHeader, "nonce")
+			r.Header.Set(kit_utils.HmacHeader, base64.StdEncoding.EncodeToString(hash))
+			Expect(serve(r)).To(Equal(401))
+		})
+	})
+
+	Describe("bodies", func() {
+		It("should sign the raw bytes of non-json bodies", func() {
+			r := httptest.NewRequest("POST", "/upload", strings.NewReader("--b\r\nfile one\r\n--b--"))
+			r.Header.Set("Content-Type", "multipart/form-data; boundary=b")
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			r.Body = io.NopCloser(strings.NewReader("--b\r\nfile two\r\n--b--"))
+			Expect(serve(r)).To(Equal(401))
+		})
+
+		It("should pass the body through to the handler", func() {
+			var got []byte
+			handler := ValidateHmac(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				got, _ = io.ReadAll(r.Body)
+			}))
+			r := httptest.NewRequest("PUT", "/blob", strings.NewReader("\x00\x01binary"))
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			Expect(string(got)).To(Equal("\x00\x01binary"))
+		})
+
+		It("should reject bodies over the limit", func() {
+			r := httptest.NewRequest("POST", "/upload", strings.NewReader("small"))
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			os.Setenv("HMAC_MAX_BODY_BYTES", "4")
+			Expect(serve(r)).To(Equal(413))
+		})
+
+		It("should canonicalize json only when configured", func() {
+			sign := func() *http.Request {
+				r := httptest.NewRequest("POST", "/items", strings.NewReader(`{"b": [1, 2], "a": 1.50}`))
+				r.Header.Set("Content-Type", "application/json")
+				Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+				r.Body = io.NopCloser(strings.NewReader(`{"a":1.50,"b":[1,2]}`))
+				return r
+			}
+			Expect(serve(sign())).To(Equal(401))
+			os.Setenv("HMAC_CANONICAL_TYPES", "application/json")
+			Expect(serve(sign())).To(Equal(200))
+		})
+
+		It("should reject json with trailing data", func() {
+			os.Setenv("HMAC_CANONICAL_TYPES", "application/json")
+			r := httptest.NewRequest("POST", "/items", strings.NewReader(`{"a": 1}`))
+			r.Header.Set("Content-Type", "application/json")
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			r.Body = io.NopCloser(strings.NewReader(`{"a": 1} {"admin": true}`))
+			Expect(serve(r)).To(Equal(400))
+		})
+	})
+
+	Describe("key ids", func() {
+		BeforeEach(func() {
+			os.Setenv("HMAC_SECRETS", `{"name": "test", "keys": [
+				{"id": "current", "created": "2021-10-12T18:00:42Z", "value": "`+secret+`"},
+				{"id": "retired", "created": "2020-10-12T18:00:42Z", "not_after": "2021-10-13T18:00:42Z", "value": "retiredsecret"}]}`)
+		})
+
+		It("should accept a request signed with a valid key id", func() {
+			r := httptest.NewRequest("GET", "/items", nil)
+			Expect(kit_utils.SignRequestWithKeyID(r, "current", secret)).To(Succeed())
+			Expect(serve(r)).To(Equal(200))
+		})
+
+		It("should reject an expired key", func() {
+			r := httptest.NewRequest("GET", "/items", nil)
+			Expect(kit_utils.SignRequestWithKeyID(r, "retired", "retiredsecret")).To(Succeed())
+			Expect(serve(r)).To(Equal(401))
+		})
+
+		It("should require a key id outside of compat mode", func() {
+			os.Setenv("HMAC_KEY_COMPAT", "false")
+			r := httptest.NewRequest("GET", "/items", nil)
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			Expect(serve(r)).To(Equal(401))
+		})
+	})
+
+	Describe("client keysets", func() {
+		var caller string
+		var handler http.Handler
+
+		BeforeEach(func() {
+			os.Setenv("HMAC_CLIENT_SECRETS", `[{"name": "billing", "keys": [{"id": "b1", "value": "billingsecret"}]},
+				{"name": "search", "keys": [{"id": "s1", "value": "searchsecret"}]}]`)
+			caller = ""
+			handler = ValidateHmac(AllowCallers("billing")(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				caller = GetCaller(r.Context())
+			})))
+		})
+
+		request := func(client, secret string) int {
+			r := httptest.NewRequest("GET", "/invoices", nil)
+			r.Header.Set(kit_utils.HmacClientIDHeader, client)
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, r)
+			return rw.Code
+		}
+
+		It("should identify the caller by its keyset", func() {
+			Expect(request("billing", "billingsecret")).To(Equal(200))
+			Expect(caller).To(Equal("billing"))
+		})
+
+		It("should not accept another client's key", func() {
+			Expect(request("billing", "searchsecret")).To(Equal(401))
+		})
+
+		It("should reject callers not on the allowlist", func() {
+			Expect(request("search", "searchsecret")).To(Equal(401))
+			Expect(request("", secret)).To(Equal(401))
+		})
+
+		It("should fail on a null client keyset", func() {
+			os.Setenv("HMAC_CLIENT_SECRETS", `[{"name": "billing", "keys": [{"id": "b1", "value": "billingsecret"}]}, null]`)
+			Expect(request("billing", "billingsecret")).To(Equal(500))
+		})
+
+		It("should require a known client id when configured", func() {
+			os.Setenv("HMAC_REQUIRE_CLIENT_ID", "true")
+			r := httptest.NewRequest("GET", "/invoices", nil)
+			Expect(kit_utils.SignRequest(r, secret)).To(Succeed())
+			Expect(serve(r)).To(Equal(401))
+		})
+	})
+
+	Describe("v1 signatures", func() {
+		sign := func() *http.Request {
+			r := httptest.NewRequest("POST", "/items", strings.NewReader(`{"a": 1}`))
+			r.Header.Set(kit_utils.HmacHeader, base64.StdEncoding.EncodeToString(kit_utils.CreateHmacHash(r, secret)))
+			return r
+		}
+
+		It("should be rejected by default", func() {
+			Expect(serve(sign())).To(Equal(401))
+		})
+
+		It("should be accepted during the migration", func() {
+			os.Setenv("HMAC_ACCEPT_V1", "true")
+			Expect(serve(sign())).To(Equal(200))
+		})
+
+		It("should reject a body over the limit", func() {
+			os.Setenv("HMAC_ACCEPT_V1", "true")
+			r := sign()
+			os.Setenv("HMAC_MAX_BODY_BYTES", "4")
+			Expect(serve(r)).To(Equal(413))
+		})
+	})
+})
+
+var _ = Describe("MemoryNonceStore Tests", func() {
+
+	ctx := context.Background()
+
+	It("should accept a nonce again once expired", func() {
+		store := NewMemoryNonceStore(10)
+		Expect(store.Use(ctx, "a", time.Now().Add(-time.Second))).To(BeTrue())
+		Expect(store.Use(ctx, "a", time.Now().Add(time.Minute))).To(BeTrue())
+		Expect(store.Use(ctx, "a", time.Now().Add(time.Minute))).To(BeFalse())
+	})
+
+	It("should refuse new nonces when full of unexpired ones", func() {
+		store := NewMemoryNonceStore(2)
+		expires := time.Now().Add(time.Minute)
+		store.Use(ctx, "a", expires)
+		store.Use(ctx, "b", expires)
+		_, err := store.Use(ctx, "c", expires)
+		Expect(err).To(Equal(ErrNonceStoreFull))
+		Expect(store.Len()).To(Equal(2))
+		Expect(store.Use(ctx, "a", expires)).To(BeFalse())
+		Expect(store.Use(ctx, "b", expires)).To(BeFalse())
+	})
+
+	It("should make room by dropping expired nonces anywhere in the store", func() {
+		store := NewMemoryNonceStore(2)
+		// b expires first but is newer, a stays at the back.
+		store.Use(ctx, "a", time.Now().Add(time.Minute))
+		store.Use(ctx, "b", time.Now().Add(20*time.Millisecond))
+		time.Sleep(30 * time.Millisecond)
+		Expect(store.Use(ctx, "c", time.Now().Add(time.Minute))).To(BeTrue())
+		Expect(store.Len()).To(Equal(2))
+		Expect(store.Use(ctx, "a", time.Now().Add(time.Minute))).To(BeFalse())
+	})
+})
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+)
+
+type peerIdentityCtxKey struct{}
+
+// PeerIdentity is the verified client certificate of an mTLS request.
+type PeerIdentity struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	URIs         []string
+	SerialNumber string
+}
+
+// ClientCert stores the verified client certificate in the request context
+// and rejects requests without one when required is set.
+func ClientCert(required bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			logger := kit_logger.GetLogEntry(r)
+			reqId := middleware.GetReqID(r.Context())
+
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+				if required {
+					logger.Error("no verified client certificate. Forbidden request")
+					logger.Debug(render.Render(rw, r, kit_errors.ErrFobiddenRequest(reqId)))
+					return
+				}
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			cert := r.TLS.VerifiedChains[0][0]
+			peer := &PeerIdentity{
+				CommonName:   cert.Subject.CommonName,
+				Organization: cert.Subject.Organization,
+				DNSNames:     cert.DNSNames,
+				SerialNumber: cert.SerialNumber.String(),
+			}
+			for _, u := range cert.URIs {
+				peer.URIs = append(peer.URIs, u.String())
+			}
+			kit_logger.LogEntrySetField(r, "peer", peer.CommonName)
+
+			next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), peerIdentityCtxKey{}, peer)))
+		})
+	}
+}
+
+func GetPeerIdentity(ctx context.Context) *PeerIdentity {
+	peer, _ := ctx.Value(peerIdentityCtxKey{}).(*PeerIdentity)
+	return peer
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ClientCert Tests", func() {
+
+	var peer *PeerIdentity
+	capture := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		peer = GetPeerIdentity(r.Context())
+	})
+
+	verified := func() *http.Request {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).To(BeNil())
+		spiffe, _ := url.Parse("spiffe://example.org/billing")
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			Subject:      pkix.Name{CommonName: "billing", Organization: []string{"example"}},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			DNSNames:     []string{"billing.internal"},
+			URIs:         []*url.URL{spiffe},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		Expect(err).To(BeNil())
+		cert, err := x509.ParseCertificate(der)
+		Expect(err).To(BeNil())
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return r
+	}
+
+	serve := func(h http.Handler, r *http.Request) int {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	BeforeEach(func() {
+		peer = nil
+	})
+
+	It("should store the identity of a verified certificate", func() {
+		Expect(serve(ClientCert(true)(capture), verified())).To(Equal(200))
+		Expect(peer).NotTo(BeNil())
+		Expect(peer.CommonName).To(Equal("billing"))
+		Expect(peer.Organization).To(Equal([]string{"example"}))
+		Expect(peer.DNSNames).To(Equal([]string{"billing.internal"}))
+		Expect(peer.URIs).To(Equal([]string{"spiffe://example.org/billing"}))
+		Expect(peer.SerialNumber).To(Equal("42"))
+	})
+
+	It("should reject requests without a verified certificate when required", func() {
+		Expect(serve(ClientCert(true)(capture), httptest.NewRequest("GET", "/", nil))).To(Equal(401))
+		r := httptest.NewRequest("GET", "/", nil)
+		r.TLS = &tls.ConnectionState{}
+		Expect(serve(ClientCert(true)(capture), r)).To(Equal(401))
+		Expect(peer).To(BeNil())
+	})
+
+	It("should pass requests without a certificate when optional", func() {
+		Expect(serve(ClientCert(false)(capture), httptest.NewRequest("GET", "/", nil))).To(Equal(200))
+		Expect(peer).To(BeNil())
+	})
+})
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	kit_models "github.com/sailsforce/gomicro-kit/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NonceStore remembers the nonces of validated requests. Use records nonce
+// until expires and returns false if it was already used.
+// MemoryNonceStore works for a single replica, services running several
+// replicas need a shared store such as DBNonceStore.
+type NonceStore interface {
+	Use(ctx context.Context, nonce string, expires time.Time) (bool, error)
+}
+
+// HmacNonceStore is consulted by ValidateHmac for v2 signatures.
+var HmacNonceStore NonceStore = NewMemoryNonceStore(100000)
+
+// ErrNonceStoreFull is returned by MemoryNonceStore.Use when every nonce it
+// holds is still valid. Evicting one would allow its request to be replayed.
+var ErrNonceStoreFull = errors.New("nonce store full")
+
+// MemoryNonceStore holds nonces until they expire. When full and nothing has
+// expired new nonces are refused with ErrNonceStoreFull, so size it for the
+// request rate over the clock skew window.
+type MemoryNonceStore struct {
+	Size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+func NewMemoryNonceStore(size int) *MemoryNonceStore {
+	return &MemoryNonceStore{
+		Size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (s *MemoryNonceStore) Use(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := s.entries[nonce]; ok {
+		entry := el.Value.(*nonceEntry)
+		if entry.expires.After(now) {
+			s.order.MoveToFront(el)
+			return false, nil
+		}
+		s.order.Remove(el)
+		delete(s.entries, nonce)
+	}
+
+	// oldest entries are at the back, drop the expired ones.
+	for el := s.order.Back(); el != nil; el = s.order.Back() {
+		entry := el.Value.(*nonceEntry)
+		if entry.expires.After(now) {
+			break
+		}
+		s.order.Remove(el)
+		delete(s.entries, entry.nonce)
+	}
+	// expiries aren't strictly ordered, look through everything before
+	// refusing.
+	if s.order.Len() >= s.Size {
+		for el := s.order.Back(); el != nil; {
+			prev := el.Prev()
+			if entry := el.Value.(*nonceEntry); !entry.expires.After(now) {
+				s.order.Remove(el)
+				delete(s.entries, entry.nonce)
+			}
+			el = prev
+		}
+	}
+	if s.order.Len() >= s.Size {
+		return false, ErrNonceStoreFull
+	}
+
+	s.entries[nonce] = s.order.PushFront(&nonceEntry{nonce: nonce, expires: expires})
+	return true, nil
+}
+
+func (s *MemoryNonceStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// DBNonceStore keeps nonces in the hmac_nonces table, shared by every
+// replica using the same database. Expired rows are reused on insert and
+// removed by Purge.
+type DBNonceStore struct {
+	DB *gorm.DB
+}
+
+func NewDBNonceStore(db *gorm.DB) *DBNonceStore {
+	return &DBNonceStore{DB: db}
+}
+
+func (s *DBNonceStore) Migrate() error {
+	return s.DB.AutoMigrate(&kit_models.HmacNonce{})
+}
+
+func (s *DBNonceStore) Use(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	res := s.DB.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "nonce"}},
+		DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Lt{Column: clause.Column{Table: "hmac_nonces", Name: "expires_at"}, Value: time.Now()},
+		}},
+	}).Create(&kit_models.HmacNonce{Nonce: nonce, ExpiresAt: expires})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	return res.RowsAffected == 1, nil
+}
+
+// Purge deletes expired nonces.
+func (s *DBNonceStore) Purge(ctx context.Context) (int64, error) {
+	res := s.DB.WithContext(ctx).Where("expires_at < ?", time.Now()).Delete(&kit_models.HmacNonce{})
+	return res.RowsAffected, res.Error
+}
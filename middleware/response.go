@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strconv"
+	"time"
+
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	kit_models "github.com/sailsforce/gomicro-kit/models"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+// SignResponse buffers the response and signs it with the latest key of
+// HMAC_SECRETS in the X-HMAC-RESPONSE header, see utils.CanonicalResponse.
+// Clients verify it with httpclient.Options.VerifyResponses.
+func SignResponse(next http.Handler) http.Handler {
+	return NewHmacSigner(DefaultHmacOptions()).SignResponse(next)
+}
+
+// SignResponseTrailer is SignResponse for large or streamed responses: the
+// body is written through and the signature sent as a trailer.
+func SignResponseTrailer(next http.Handler) http.Handler {
+	return NewHmacSigner(DefaultHmacOptions()).SignResponseTrailer(next)
+}
+
+func (s *HmacSigner) SignResponse(next http.Handler) http.Handler {
+	return s.signResponse(next, false)
+}
+
+func (s *HmacSigner) SignResponseTrailer(next http.Handler) http.Handler {
+	return s.signResponse(next, true)
+}
+
+func (s *HmacSigner) signResponse(next http.Handler, streamed bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		logger := kit_logger.GetLogEntry(r)
+
+		_, key, err := s.latestKey(r)
+		if err != nil {
+			logger.Error(err)
+			s.opts.Fail(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		sw := &signingResponseWriter{
+			ResponseWriter: rw,
+			r:              r,
+			headers:        s.opts.Headers,
+			key:            key,
+			hash:           sha256.New(),
+			streamed:       streamed,
+		}
+		next.ServeHTTP(sw, r)
+		sw.finish()
+	})
+}
+
+type signingResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	headers  HmacHeaderNames
+	key      kit_models.Key
+	hash     hash.Hash
+	streamed bool
+
+	status      int
+	wroteHeader bool
+	sentHeader  bool
+	timestamp   string
+	signed      http.Header
+	buf         bytes.Buffer
+}
+
+func (w *signingResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+}
+
+func (w *signingResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.hash.Write(p)
+	if !w.streamed {
+		return w.buf.Write(p)
+	}
+	if !w.sentHeader {
+		w.prepareHeader(p)
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *signingResponseWriter) Flush() {
+	if !w.streamed {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.sentHeader {
+		w.prepareHeader(nil)
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// prepareHeader fixes the signed headers. Content-Type is sniffed here as
+// net/http would, so the signed value is the one sent.
+func (w *signingResponseWriter) prepareHeader(body []byte) {
+	w.sentHeader = true
+	h := w.ResponseWriter.Header()
+	if h.Get("Content-Type") == "" && len(body) > 0 {
+		h.Set("Content-Type", http.DetectContentType(body))
+	}
+	w.timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	h.Set(w.headers.Timestamp, w.timestamp)
+	if w.key.ID != "" {
+		h.Set(w.headers.KeyID, w.key.ID)
+	}
+	if w.streamed {
+		h.Add("Trailer", w.headers.Response)
+	}
+	w.signed = h.Clone()
+}
+
+func (w *signingResponseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	// nothing sent yet, even when streamed: sign in a header.
+	pending := !w.sentHeader
+	if pending {
+		w.streamed = false
+		w.prepareHeader(w.buf.Bytes())
+	}
+	msg := kit_utils.CanonicalResponse(w.status, w.signed, w.r.Method, w.r.Header.Get(w.headers.Nonce), hex.EncodeToString(w.hash.Sum(nil)), w.timestamp)
+	sig := base64.StdEncoding.EncodeToString(kit_utils.HmacSum(msg, w.key.Value))
+
+	// after the body was sent this goes out as the declared trailer.
+	w.ResponseWriter.Header().Set(w.headers.Response, sig)
+	if pending {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.buf.Bytes())
+	}
+}
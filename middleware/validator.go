@@ -0,0 +1,479 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	kit_errors "github.com/sailsforce/gomicro-kit/errors"
+	kit_logger "github.com/sailsforce/gomicro-kit/logger"
+	kit_models "github.com/sailsforce/gomicro-kit/models"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+// DefaultHmacKeyRefresh is how long loaded keys are used before their
+// source is read again.
+const DefaultHmacKeyRefresh = time.Minute
+
+var (
+	ErrUnknownHmacClient = errors.New("unknown hmac client")
+	ErrHmacVersion       = errors.New("unsupported hmac version")
+	ErrHmacMismatch      = errors.New("hmac did not match")
+	ErrHmacReplayed      = errors.New("hmac nonce reused")
+)
+
+// KeySource loads a keyset, e.g. StaticKeys(cfg.HmacKeys) or the Load
+// method of an auth.KeyStore.
+type KeySource func(ctx context.Context) (*kit_models.HmacKeys, error)
+
+// ClientKeySource loads the keysets of known callers, each named after the
+// client id it is selected by.
+type ClientKeySource func(ctx context.Context) ([]*kit_models.HmacKeys, error)
+
+// StaticKeys always returns keys, i.e. MicroRestConfig.HmacKeys.
+func StaticKeys(keys *kit_models.HmacKeys) KeySource {
+	return func(ctx context.Context) (*kit_models.HmacKeys, error) {
+		return keys, nil
+	}
+}
+
+// EnvKeys decodes the HmacKeys json in the environment variable name.
+func EnvKeys(name string) KeySource {
+	return func(ctx context.Context) (*kit_models.HmacKeys, error) {
+		var keys *kit_models.HmacKeys
+		if err := render.DecodeJSON(bytes.NewReader([]byte(os.Getenv(name))), &keys); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", name, err)
+		}
+		return keys, nil
+	}
+}
+
+// EnvClientKeys decodes a json list of HmacKeys in the environment variable
+// name, none if it isn't set.
+func EnvClientKeys(name string) ClientKeySource {
+	return func(ctx context.Context) ([]*kit_models.HmacKeys, error) {
+		raw := os.Getenv(name)
+		if raw == "" {
+			return nil, nil
+		}
+		var keysets []*kit_models.HmacKeys
+		if err := render.DecodeJSON(bytes.NewReader([]byte(raw)), &keysets); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %v", name, err)
+		}
+		return keysets, nil
+	}
+}
+
+// HmacHeaderNames are the headers the signature travels in.
+type HmacHeaderNames = kit_utils.HmacHeaderNames
+
+func DefaultHmacHeaderNames() HmacHeaderNames {
+	return kit_utils.DefaultHmacHeaderNames()
+}
+
+// HmacFailureRenderer writes the response to a request rejected with
+// status, err being the reason it was rejected for.
+type HmacFailureRenderer func(rw http.ResponseWriter, r *http.Request, status int, err error)
+
+// HmacOptions configure NewHmacValidator and NewHmacSigner. Zero fields
+// take the defaults of DefaultHmacOptions, except the key sources.
+type HmacOptions struct {
+	// the default keyset, required.
+	Keys KeySource
+	// optional, keysets selected by the client id header.
+	ClientKeys ClientKeySource
+	// reject requests without a known client id instead of validating them
+	// against Keys.
+	RequireClientID bool
+	// how long loaded keys are cached, negative to never reload them.
+	Refresh time.Duration
+	Headers HmacHeaderNames
+	// paths not validated, a trailing "*" matches any path with the prefix.
+	Exempt []string
+	Fail   HmacFailureRenderer
+	// defaults to HmacNonceStore.
+	Nonces NonceStore
+}
+
+// DefaultHmacOptions are the environment based options of HmacHash and
+// ValidateHmac: HMAC_SECRETS, HMAC_CLIENT_SECRETS and HMAC_REQUIRE_CLIENT_ID.
+func DefaultHmacOptions() HmacOptions {
+	require, _ := strconv.ParseBool(os.Getenv("HMAC_REQUIRE_CLIENT_ID"))
+	return HmacOptions{
+		Keys:            EnvKeys("HMAC_SECRETS"),
+		ClientKeys:      EnvClientKeys("HMAC_CLIENT_SECRETS"),
+		RequireClientID: require,
+		Refresh:         DefaultHmacKeyRefresh,
+		Headers:         DefaultHmacHeaderNames(),
+		Fail:            RenderHmacFailure,
+	}
+}
+
+func (o HmacOptions) withDefaults() HmacOptions {
+	defaults := DefaultHmacOptions()
+	if o.Refresh == 0 {
+		o.Refresh = defaults.Refresh
+	}
+	if o.Fail == nil {
+		o.Fail = defaults.Fail
+	}
+	o.Headers = o.Headers.WithDefaults()
+	return o
+}
+
+func (o HmacOptions) exempt(path string) bool {
+	for _, e := range o.Exempt {
+		if e == path || (strings.HasSuffix(e, "*") && strings.HasPrefix(path, strings.TrimSuffix(e, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o HmacOptions) nonces() NonceStore {
+	if o.Nonces != nil {
+		return o.Nonces
+	}
+	return HmacNonceStore
+}
+
+// RenderHmacFailure renders the kit error matching status.
+func RenderHmacFailure(rw http.ResponseWriter, r *http.Request, status int, err error) {
+	logger := kit_logger.GetLogEntry(r)
+	reqId := middleware.GetReqID(r.Context())
+
+	var resp render.Renderer
+	switch status {
+	case http.StatusUnauthorized:
+		resp = kit_errors.ErrFobiddenRequest(reqId)
+	case http.StatusBadRequest:
+		resp = kit_errors.ErrInvalidRequest(reqId)
+	case http.StatusInternalServerError:
+		resp = kit_errors.ErrInternal(reqId)
+	default:
+		resp = kit_errors.GenericErr(reqId, status, strings.ToLower(http.StatusText(status)))
+	}
+	logger.Debug(render.Render(rw, r, resp))
+}
+
+// keyCache holds the keys of a source for the refresh interval. A failed
+// reload keeps the previous keys until the next interval. Requests read the
+// keys without locking; an expired cache is reloaded once for all of them,
+// detached from any request.
+type keyCache struct {
+	keys    KeySource
+	clients ClientKeySource
+	refresh time.Duration
+
+	current atomic.Value // *cachedKeys
+
+	mu      sync.Mutex
+	loading *keyLoad
+}
+
+type cachedKeys struct {
+	keyset   *kit_models.HmacKeys
+	byClient map[string]*kit_models.HmacKeys
+	loaded   time.Time
+}
+
+type keyLoad struct {
+	done chan struct{}
+	err  error
+}
+
+func (c *keyCache) cached() *cachedKeys {
+	cached, _ := c.current.Load().(*cachedKeys)
+	return cached
+}
+
+func (c *keyCache) get(r *http.Request) (*kit_models.HmacKeys, map[string]*kit_models.HmacKeys, error) {
+	cached := c.cached()
+	if cached != nil && (c.refresh < 0 || time.Since(cached.loaded) < c.refresh) {
+		return cached.keyset, cached.byClient, nil
+	}
+	if err := c.reload(r.Context()); err != nil {
+		if cached == nil {
+			return nil, nil, err
+		}
+		kit_logger.GetLogEntry(r).Warn("error reloading hmac keys, using cached keys: ", err)
+	}
+	if latest := c.cached(); latest != nil {
+		cached = latest
+	}
+	return cached.keyset, cached.byClient, nil
+}
+
+// reload loads the keys, or waits for the load already in flight. ctx only
+// bounds the wait.
+func (c *keyCache) reload(ctx context.Context) error {
+	c.mu.Lock()
+	l := c.loading
+	if l == nil {
+		l = &keyLoad{done: make(chan struct{})}
+		c.loading = l
+		go c.run(l)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return l.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *keyCache) run(l *keyLoad) {
+	loaded, err := c.load(context.Background())
+
+	c.mu.Lock()
+	if err == nil {
+		c.current.Store(loaded)
+	} else if cached := c.cached(); cached != nil {
+		c.current.Store(&cachedKeys{keyset: cached.keyset, byClient: cached.byClient, loaded: time.Now()})
+	}
+	c.loading = nil
+	c.mu.Unlock()
+
+	l.err = err
+	close(l.done)
+}
+
+func (c *keyCache) load(ctx context.Context) (*cachedKeys, error) {
+	if c.keys == nil {
+		return nil, errors.New("no hmac key source")
+	}
+	keyset, err := c.keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if keyset == nil {
+		return nil, kit_models.ErrNoHmacKey
+	}
+	var byClient map[string]*kit_models.HmacKeys
+	if c.clients != nil {
+		keysets, err := c.clients(ctx)
+		if err != nil {
+			return nil, err
+		}
+		byClient = make(map[string]*kit_models.HmacKeys, len(keysets))
+		for i, ks := range keysets {
+			if ks == nil {
+				return nil, fmt.Errorf("client keyset %d is null", i)
+			}
+			byClient[ks.Name] = ks
+		}
+	}
+	return &cachedKeys{keyset: keyset, byClient: byClient, loaded: time.Now()}, nil
+}
+
+// HmacValidator is ValidateHmac with its own options and cached keys.
+type HmacValidator struct {
+	opts  HmacOptions
+	cache *keyCache
+}
+
+func NewHmacValidator(opts HmacOptions) *HmacValidator {
+	opts = opts.withDefaults()
+	return &HmacValidator{
+		opts:  opts,
+		cache: &keyCache{keys: opts.Keys, clients: opts.ClientKeys, refresh: opts.Refresh},
+	}
+}
+
+// Refresh reloads the keys now, e.g. after they were rotated.
+func (v *HmacValidator) Refresh(ctx context.Context) error {
+	return v.cache.reload(ctx)
+}
+
+func (v *HmacValidator) Validate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		logger := kit_logger.GetLogEntry(r)
+		headers := v.opts.Headers
+		fail := v.opts.Fail
+
+		if v.opts.exempt(r.URL.Path) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		logger.Info("validating hmac...")
+
+		logger.Debug("create hash for validation.")
+		keys, caller, err := v.callerKeys(r)
+		if err != nil {
+			logger.Error("error loading hmac keys: ", err)
+			fail(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		if keys == nil {
+			logger.Error("unknown hmac client ", r.Header.Get(headers.ClientID), ". Forbidden request")
+			fail(rw, r, http.StatusUnauthorized, ErrUnknownHmacClient)
+			return
+		}
+
+		// validate
+		headerValue, err := base64.StdEncoding.DecodeString(r.Header.Get(headers.Hash))
+		if err != nil {
+			logger.Error("error decoding hmac hash from header: ", err)
+			fail(rw, r, http.StatusBadRequest, err)
+			return
+		}
+		logger.Debug("header hmac: ", headerValue)
+
+		timestamp := r.Header.Get(headers.Timestamp)
+		nonce := r.Header.Get(headers.Nonce)
+		version := r.Header.Get(headers.Version)
+		switch version {
+		case kit_utils.HmacV2:
+			if err := kit_utils.CheckHmacTimestamp(timestamp, kit_utils.HmacClockSkew()); err != nil {
+				logger.Error("rejecting hmac: ", err)
+				fail(rw, r, http.StatusUnauthorized, err)
+				return
+			}
+			if nonce == "" {
+				logger.Error("rejecting hmac: missing nonce")
+				fail(rw, r, http.StatusUnauthorized, errors.New("missing hmac nonce"))
+				return
+			}
+		case "", kit_utils.HmacV1:
+			if !kit_utils.HmacAcceptV1() {
+				logger.Error("rejecting hmac: v1 signatures are no longer accepted")
+				fail(rw, r, http.StatusUnauthorized, ErrHmacVersion)
+				return
+			}
+			version = kit_utils.HmacV1
+		default:
+			logger.Error("unknown hmac version: ", version)
+			fail(rw, r, http.StatusBadRequest, ErrHmacVersion)
+			return
+		}
+
+		logger.Info("validating...")
+		keyID := r.Header.Get(headers.KeyID)
+		candidates, err := keys.VerificationKeys(keyID, kit_utils.HmacKeyCompat())
+		if err != nil {
+			logger.Error("rejecting hmac key ", keyID, ": ", err)
+			fail(rw, r, http.StatusUnauthorized, err)
+			return
+		}
+		validated, err := validateHmacKeys(candidates, headerValue, r, version, timestamp, nonce)
+		if err == kit_utils.ErrBodyTooLarge {
+			logger.Error("request body too large to validate hmac")
+			fail(rw, r, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		if err != nil {
+			logger.Error("error creating hmac hash: ", err)
+			fail(rw, r, http.StatusBadRequest, err)
+			return
+		}
+		if !validated {
+			logger.Error("hmac did not match. Forbidden request")
+			fail(rw, r, http.StatusUnauthorized, ErrHmacMismatch)
+			return
+		}
+
+		if store := v.opts.nonces(); version == kit_utils.HmacV2 && store != nil {
+			if status, err := UseNonce(r, store, nonce, timestamp); err != nil {
+				fail(rw, r, status, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(rw, withCaller(r, caller))
+	})
+}
+
+// callerKeys selects the keyset to validate r with. A client id naming a
+// client keyset selects it and identifies the caller, anything else is
+// validated anonymously against the default keyset, unless RequireClientID
+// is set.
+func (v *HmacValidator) callerKeys(r *http.Request) (*kit_models.HmacKeys, string, error) {
+	keys, clients, err := v.cache.get(r)
+	if err != nil {
+		return nil, "", err
+	}
+	clientID := r.Header.Get(v.opts.Headers.ClientID)
+	if ks, ok := clients[clientID]; ok && clientID != "" {
+		return ks, clientID, nil
+	}
+	if v.opts.RequireClientID {
+		return nil, "", nil
+	}
+	return keys, "", nil
+}
+
+// HmacSigner is HmacHash and SignResponse with their own options and cached
+// keys. Only the key source, refresh and header names apply to signing.
+type HmacSigner struct {
+	opts  HmacOptions
+	cache *keyCache
+}
+
+func NewHmacSigner(opts HmacOptions) *HmacSigner {
+	opts = opts.withDefaults()
+	return &HmacSigner{
+		opts:  opts,
+		cache: &keyCache{keys: opts.Keys, refresh: opts.Refresh},
+	}
+}
+
+// Refresh reloads the keys now, e.g. after they were rotated.
+func (s *HmacSigner) Refresh(ctx context.Context) error {
+	return s.cache.reload(ctx)
+}
+
+func (s *HmacSigner) latestKey(r *http.Request) (*kit_models.HmacKeys, kit_models.Key, error) {
+	keys, _, err := s.cache.get(r)
+	if err != nil {
+		return nil, kit_models.Key{}, fmt.Errorf("error loading hmac keys: %v", err)
+	}
+	key, err := keys.LatestKey()
+	if err != nil {
+		return nil, kit_models.Key{}, fmt.Errorf("error getting hmac key: %v", err)
+	}
+	return keys, key, nil
+}
+
+func (s *HmacSigner) Sign(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		logger := kit_logger.GetLogEntry(r)
+
+		logger.Info("creating hmach hash...")
+
+		keys, key, err := s.latestKey(r)
+		if err != nil {
+			logger.Error(err)
+			s.opts.Fail(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		logger.Info("retrieved latest key: ", key.ID)
+
+		if keys.Name != "" {
+			r.Header.Set(kit_utils.HmacClientIDHeader, keys.Name)
+		}
+		if err := kit_utils.SignRequestWithKeyID(r, key.ID, key.Value); err != nil {
+			logger.Error("error creating hmac hash: ", err)
+			s.opts.Fail(rw, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.opts.Headers.Rename(r.Header)
+		logger.Debug("hmac hash: ", r.Header.Get(s.opts.Headers.Hash))
+		logger.Info("hmac added to header.")
+
+		next.ServeHTTP(rw, r)
+	})
+}
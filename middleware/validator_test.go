@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	kit_models "github.com/sailsforce/gomicro-kit/models"
+	kit_utils "github.com/sailsforce/gomicro-kit/utils"
+)
+
+var _ = Describe("HmacValidator Tests", func() {
+
+	secret := "supersecretkeyvalue"
+	keys := &kit_models.HmacKeys{Name: "test", Keys: []kit_models.Key{{ID: "k1", Value: secret}}}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})
+
+	var loads int
+	var loadErr error
+	source := func(ctx context.Context) (*kit_models.HmacKeys, error) {
+		loads++
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return keys, nil
+	}
+
+	signed := func(path string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		Expect(kit_utils.SignRequestWithKeyID(r, "k1", secret)).To(Succeed())
+		return r
+	}
+
+	serve := func(h http.Handler, r *http.Request) int {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	BeforeEach(func() {
+		loads, loadErr = 0, nil
+	})
+
+	AfterEach(func() {
+		os.Clearenv()
+	})
+
+	It("should load the keys once and cache them", func() {
+		h := NewHmacValidator(HmacOptions{Keys: source}).Validate(ok)
+		Expect(serve(h, signed("/items"))).To(Equal(200))
+		Expect(serve(h, signed("/items"))).To(Equal(200))
+		Expect(loads).To(Equal(1))
+	})
+
+	It("should keep the cached keys when a reload fails", func() {
+		v := NewHmacValidator(HmacOptions{Keys: source, Refresh: time.Nanosecond})
+		h := v.Validate(ok)
+		Expect(serve(h, signed("/items"))).To(Equal(200))
+		loadErr = errors.New("unavailable")
+		Expect(serve(h, signed("/items"))).To(Equal(200))
+		Expect(v.Refresh(context.Background())).NotTo(Succeed())
+		Expect(loads).To(Equal(3))
+	})
+
+	It("should share one load between concurrent requests", func() {
+		var slowLoads int32
+		release := make(chan struct{})
+		slow := func(ctx context.Context) (*kit_models.HmacKeys, error) {
+			atomic.AddInt32(&slowLoads, 1)
+			<-release
+			return keys, nil
+		}
+		h := NewHmacValidator(HmacOptions{Keys: slow}).Validate(ok)
+
+		codes := make(chan int, 5)
+		for i := 0; i < 5; i++ {
+			go func() {
+				defer GinkgoRecover()
+				codes <- serve(h, signed("/items"))
+			}()
+		}
+		Eventually(func() int32 { return atomic.LoadInt32(&slowLoads) }).Should(Equal(int32(1)))
+		close(release)
+		for i := 0; i < 5; i++ {
+			Expect(<-codes).To(Equal(200))
+		}
+		Expect(atomic.LoadInt32(&slowLoads)).To(Equal(int32(1)))
+	})
+
+	It("should fail without keys", func() {
+		loadErr = errors.New("unavailable")
+		h := NewHmacValidator(HmacOptions{Keys: source}).Validate(ok)
+		Expect(serve(h, signed("/items"))).To(Equal(500))
+	})
+
+	It("should fail on a null client keyset", func() {
+		os.Setenv("HMAC_CLIENT_SECRETS", `[{"name": "billing", "keys": [{"id": "b1", "value": "billingsecret"}]}, null]`)
+		v := NewHmacValidator(HmacOptions{Keys: source, ClientKeys: EnvClientKeys("HMAC_CLIENT_SECRETS")})
+		Expect(v.Refresh(context.Background())).To(MatchError("client keyset 1 is null"))
+		Expect(serve(v.Validate(ok), signed("/items"))).To(Equal(500))
+	})
+
+	It("should skip exempt paths", func() {
+		h := NewHmacValidator(HmacOptions{Keys: source, Exempt: []string{"/health", "/public/*"}}).Validate(ok)
+		Expect(serve(h, httptest.NewRequest("GET", "/health", nil))).To(Equal(200))
+		Expect(serve(h, httptest.NewRequest("GET", "/public/docs", nil))).To(Equal(200))
+		Expect(serve(h, httptest.NewRequest("GET", "/items", nil))).To(Equal(401))
+	})
+
+	It("should render failures with the configured renderer", func() {
+		var failed error
+		h := NewHmacValidator(HmacOptions{
+			Keys: source,
+			Fail: func(rw http.ResponseWriter, r *http.Request, status int, err error) {
+				failed = err
+				rw.WriteHeader(http.StatusTeapot)
+			},
+		}).Validate(ok)
+		r := signed("/items")
+		r.URL.Path = "/other"
+		Expect(serve(h, r)).To(Equal(http.StatusTeapot))
+		Expect(failed).To(Equal(ErrHmacMismatch))
+	})
+
+	It("should sign and validate with custom header names", func() {
+		opts := HmacOptions{
+			Keys:    StaticKeys(keys),
+			Headers: HmacHeaderNames{Hash: "X-Sig", Nonce: "X-Sig-Nonce", Timestamp: "X-Sig-Time"},
+		}
+		var r *http.Request
+		capture := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { r = req })
+		NewHmacSigner(opts).Sign(capture).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/items", nil))
+		Expect(r.Header.Get("X-Sig")).NotTo(BeEmpty())
+		Expect(r.Header.Get(kit_utils.HmacHeader)).To(BeEmpty())
+
+		Expect(serve(NewHmacValidator(opts).Validate(ok), r)).To(Equal(200))
+	})
+
+	It("should answer 503 when the nonce store is full", func() {
+		store := NewMemoryNonceStore(1)
+		h := NewHmacValidator(HmacOptions{Keys: source, Nonces: store}).Validate(ok)
+		Expect(serve(h, signed("/items"))).To(Equal(200))
+		Expect(serve(h, signed("/items"))).To(Equal(503))
+	})
+
+	It("should use its own nonce store", func() {
+		store := NewMemoryNonceStore(10)
+		h := NewHmacValidator(HmacOptions{Keys: source, Nonces: store}).Validate(ok)
+		Expect(serve(h, signed("/items"))).To(Equal(200))
+		Expect(store.Len()).To(Equal(1))
+	})
+})
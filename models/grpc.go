@@ -0,0 +1,42 @@
+package models
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// isGrpcServiceAlive probes BaseURL with the standard grpc health protocol,
+// checking the overall server status.
+func isGrpcServiceAlive(s *Service, tlsConfig *tls.Config) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	creds := grpc.WithTransportCredentials(insecure.NewCredentials())
+	if s.ServiceProtocol == ProtocolGrpcs {
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(cfg))
+	}
+
+	log.Printf("grpc health check: %v", s.BaseURL)
+	conn, err := grpc.DialContext(ctx, s.BaseURL, creds, grpc.WithBlock())
+	if err != nil {
+		return false, nil
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return false, err
+	}
+	return resp.Status == healthpb.HealthCheckResponse_SERVING, nil
+}
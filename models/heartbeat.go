@@ -1,16 +1,25 @@
 package models
 
 type Heartbeat struct {
-	RequestID      string `json:"requestId"`
-	DatabaseOnline bool   `json:"databaseOnline"`
-	AppName        string `json:"appName"`
-	ReleaseDate    string `json:"releaseCreatedAt"`
-	ReleaseVersion string `json:"releaseVersion"`
-	Slug           string `json:"slugCommit"`
-	Message        string `json:"message"`
+	RequestID      string        `json:"requestId"`
+	DatabaseOnline bool          `json:"databaseOnline"`
+	AppName        string        `json:"appName"`
+	ReleaseDate    string        `json:"releaseCreatedAt"`
+	ReleaseVersion string        `json:"releaseVersion"`
+	Slug           string        `json:"slugCommit"`
+	Message        string        `json:"message"`
+	Checks         []CheckResult `json:"checks,omitempty"`
 }
 
 type ServicePoolStatus struct {
 	RequestID string      `json:"requestId"`
 	Services  []Heartbeat `json:"services"`
 }
+
+type CheckResult struct {
+	Name      string  `json:"name"`
+	Healthy   bool    `json:"healthy"`
+	Critical  bool    `json:"critical"`
+	Error     string  `json:"error,omitempty"`
+	ElapsedMs float64 `json:"elapsedMs"`
+}
@@ -1,8 +1,26 @@
 package models
 
 import (
-	"sort"
+	"errors"
 	"time"
+
+	"github.com/sailsforce/gomicro-kit/utils"
+)
+
+var (
+	ErrNoHmacKey       = errors.New("no valid hmac key")
+	ErrUnknownHmacKey  = errors.New("unknown hmac key id")
+	ErrExpiredHmacKey  = errors.New("hmac key is expired or not valid yet")
+	ErrHmacKeyRequired = errors.New("hmac key id required")
+)
+
+// Key statuses for rotation. A new key is verify-only until every service
+// accepts it, then promoted to signing. Keys without a status sign, for
+// keysets created before rotation.
+const (
+	KeyVerify  = "verify"
+	KeySigning = "signing"
+	KeyRetired = "retired"
 )
 
 type HmacKeys struct {
@@ -10,15 +28,128 @@ type HmacKeys struct {
 	Keys []Key  `json:"keys"`
 }
 
+// Key is valid from NotBefore until NotAfter, a zero time leaves that side
+// open. Keys without an ID can only be found by trial verification.
 type Key struct {
-	Created time.Time `json:"created"`
-	Value   string    `json:"value"`
+	ID        string    `json:"id,omitempty"`
+	Created   time.Time `json:"created"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	Status    string    `json:"status,omitempty"`
+	Value     string    `json:"value"`
 }
 
+func (k *Key) CanSign() bool {
+	return k.Status == "" || k.Status == KeySigning
+}
+
+func (k *Key) ValidAt(t time.Time) bool {
+	if k.Status == KeyRetired {
+		return false
+	}
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// GetLatestKey returns the value of the most recently created valid signing
+// key, or "" if there is none.
 func (hk *HmacKeys) GetLatestKey() string {
-	sort.Slice(hk.Keys, func(i, j int) bool {
-		return hk.Keys[i].Created.After(hk.Keys[j].Created)
-	})
+	key, err := hk.LatestKey()
+	if err != nil {
+		return ""
+	}
+	return key.Value
+}
+
+func (hk *HmacKeys) LatestKey() (Key, error) {
+	now := time.Now()
+	var latest *Key
+	for i := range hk.Keys {
+		k := &hk.Keys[i]
+		if !k.CanSign() || !k.ValidAt(now) {
+			continue
+		}
+		if latest == nil || k.Created.After(latest.Created) {
+			latest = k
+		}
+	}
+	if latest == nil {
+		return Key{}, ErrNoHmacKey
+	}
+	return *latest, nil
+}
+
+// SigningKey returns the id and value of LatestKey, for
+// httpclient.Options.Sign.
+func (hk *HmacKeys) SigningKey() (string, string, error) {
+	key, err := hk.LatestKey()
+	if err != nil {
+		return "", "", err
+	}
+	return key.ID, key.Value, nil
+}
+
+// VerificationSecrets returns the values of VerificationKeys, with compat
+// from HMAC_KEY_COMPAT, for httpclient.Options.VerifyResponses.
+func (hk *HmacKeys) VerificationSecrets(id string) ([]string, error) {
+	keys, err := hk.VerificationKeys(id, utils.HmacKeyCompat())
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]string, 0, len(keys))
+	for _, k := range keys {
+		secrets = append(secrets, k.Value)
+	}
+	return secrets, nil
+}
+
+func (hk *HmacKeys) FindKey(id string) (Key, bool) {
+	for _, k := range hk.Keys {
+		if k.ID != "" && k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// VerificationKeys returns the keys to check a signature made with key id.
+// A known id returns that key only if valid now. Without an id every valid
+// key is returned for trial verification, if compat allows it.
+func (hk *HmacKeys) VerificationKeys(id string, compat bool) ([]Key, error) {
+	now := time.Now()
+	if id != "" {
+		k, ok := hk.FindKey(id)
+		if !ok {
+			return nil, ErrUnknownHmacKey
+		}
+		if !k.ValidAt(now) {
+			return nil, ErrExpiredHmacKey
+		}
+		return []Key{k}, nil
+	}
+	if !compat {
+		return nil, ErrHmacKeyRequired
+	}
+	var keys []Key
+	for _, k := range hk.Keys {
+		if k.ValidAt(now) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoHmacKey
+	}
+	return keys, nil
+}
 
-	return hk.Keys[0].Value
+// HmacNonce is a nonce seen by ValidateHmac, kept until ExpiresAt so the
+// request can't be replayed while its timestamp is still accepted.
+type HmacNonce struct {
+	Nonce     string    `json:"nonce" gorm:"primaryKey"`
+	ExpiresAt time.Time `json:"expires_at" gorm:"index"`
 }
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hmac Keys Tests", func() {
+
+	now := time.Now()
+	var keys HmacKeys
+
+	BeforeEach(func() {
+		keys = HmacKeys{Keys: []Key{
+			{ID: "old", Created: now.Add(-48 * time.Hour), Value: "old"},
+			{ID: "expired", Created: now.Add(-24 * time.Hour), NotAfter: now.Add(-time.Hour), Value: "expired"},
+			{ID: "new", Created: now.Add(-time.Hour), Value: "new"},
+			{ID: "future", Created: now, NotBefore: now.Add(time.Hour), Value: "future"},
+		}}
+	})
+
+	Describe("GetLatestKey", func() {
+		It("should return the latest valid key without reordering", func() {
+			Expect(keys.GetLatestKey()).To(Equal("new"))
+			Expect(keys.Keys[0].ID).To(Equal("old"))
+		})
+		It("should not panic without keys", func() {
+			empty := HmacKeys{}
+			Expect(empty.GetLatestKey()).To(Equal(""))
+			_, err := empty.LatestKey()
+			Expect(err).To(Equal(ErrNoHmacKey))
+		})
+	})
+
+	Describe("VerificationKeys", func() {
+		It("should return the key by id", func() {
+			found, err := keys.VerificationKeys("old", false)
+			Expect(err).To(BeNil())
+			Expect(found).To(HaveLen(1))
+			Expect(found[0].Value).To(Equal("old"))
+		})
+		It("should reject expired and unknown keys", func() {
+			_, err := keys.VerificationKeys("expired", true)
+			Expect(err).To(Equal(ErrExpiredHmacKey))
+			_, err = keys.VerificationKeys("missing", true)
+			Expect(err).To(Equal(ErrUnknownHmacKey))
+		})
+		It("should only try every valid key in compat mode", func() {
+			_, err := keys.VerificationKeys("", false)
+			Expect(err).To(Equal(ErrHmacKeyRequired))
+			found, err := keys.VerificationKeys("", true)
+			Expect(err).To(BeNil())
+			Expect(found).To(HaveLen(2))
+		})
+	})
+})
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// OutlierDetector passively ejects peers from a ServicePool based on the
+// results of real traffic. Ejected peers are skipped by peer selection, see
+// ServicePool.Available, the instances themselves are left untouched. A peer is ejected after too many consecutive 5xx
+// responses or gateway errors (timeouts, connection failures) and returns
+// to the pool once its ejection period passes. Each repeat ejection doubles
+// the period up to MaxEjection. Peers are tracked by InstanceKey, so the
+// state survives an instance being replaced when it re-registers.
+type OutlierDetector struct {
+	// returns the pool being watched. Registries swap pools on every change,
+	// so the detector looks the current one up rather than holding it.
+	Pool                     func() *ServicePool
+	Consecutive5xx           int
+	ConsecutiveGatewayErrors int
+	BaseEjection             time.Duration
+	MaxEjection              time.Duration
+	// never eject more than this percent of the pool.
+	MaxEjectionPercent int
+	// optional, ejections are recorded as custom metrics.
+	NewRelicApp *newrelic.Application
+
+	mu    sync.Mutex
+	peers map[string]*peerStats
+}
+
+type peerStats struct {
+	serviceID         int
+	baseURL           string
+	consecutive5xx    int
+	consecutiveErrors int
+	ejections         int
+	ejected           bool
+	ejectedUntil      time.Time
+	returnedAt        time.Time
+}
+
+type OutlierStats struct {
+	// the peer's InstanceKey.
+	Instance          string    `json:"instance"`
+	ServiceID         int       `json:"service_id"`
+	BaseURL           string    `json:"base_url"`
+	Consecutive5xx    int       `json:"consecutive_5xx"`
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	Ejections         int       `json:"ejections"`
+	Ejected           bool      `json:"ejected"`
+	EjectedUntil      time.Time `json:"ejected_until"`
+}
+
+// NewOutlierDetector watches a pool that is never replaced. For pools held
+// by a registry use NewOutlierDetectorFunc with the registry lookup.
+func NewOutlierDetector(pool *ServicePool) *OutlierDetector {
+	od := NewOutlierDetectorFunc(func() *ServicePool { return pool })
+	pool.Outliers = od
+	return od
+}
+
+// NewOutlierDetectorFunc watches the pool returned by pool. The caller sets
+// the detector as the pool's Outliers.
+func NewOutlierDetectorFunc(pool func() *ServicePool) *OutlierDetector {
+	return &OutlierDetector{
+		Pool:                     pool,
+		Consecutive5xx:           5,
+		ConsecutiveGatewayErrors: 5,
+		BaseEjection:             30 * time.Second,
+		MaxEjection:              5 * time.Minute,
+		MaxEjectionPercent:       50,
+		peers:                    make(map[string]*peerStats),
+	}
+}
+
+// Observe records the outcome of a proxied request to s.
+func (od *OutlierDetector) Observe(s *Service, resp *http.Response, err error) {
+	if err != nil {
+		od.ReportError(s, err)
+		return
+	}
+	od.ReportStatus(s, resp.StatusCode)
+}
+
+func (od *OutlierDetector) ReportStatus(s *Service, status int) {
+	// resolved before locking, registries call Forget under their lock.
+	pool := od.Pool()
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	ps := od.stats(s)
+	ps.consecutiveErrors = 0
+	if status >= 500 {
+		ps.consecutive5xx++
+		if ps.consecutive5xx >= od.Consecutive5xx {
+			od.eject(pool, s, ps, "consecutive 5xx")
+		}
+		return
+	}
+	ps.consecutive5xx = 0
+}
+
+func (od *OutlierDetector) ReportError(s *Service, err error) {
+	pool := od.Pool()
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	ps := od.stats(s)
+	ps.consecutiveErrors++
+	if ps.consecutiveErrors >= od.ConsecutiveGatewayErrors {
+		reason := "consecutive connection errors"
+		if isTimeout(err) {
+			reason = "consecutive timeouts"
+		}
+		od.eject(pool, s, ps, reason)
+	}
+}
+
+func (od *OutlierDetector) IsEjected(s *Service) bool {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	ps, ok := od.peers[s.InstanceKey()]
+	return ok && ps.ejected
+}
+
+// Forget drops the state of an instance that left the pool.
+func (od *OutlierDetector) Forget(s *Service) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	delete(od.peers, s.InstanceKey())
+}
+
+// Release returns peers whose ejection period has passed to the pool.
+func (od *OutlierDetector) Release() {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	now := time.Now()
+	for _, ps := range od.peers {
+		if ps.ejected && now.After(ps.ejectedUntil) {
+			ps.ejected = false
+			ps.consecutive5xx = 0
+			ps.consecutiveErrors = 0
+			ps.returnedAt = now
+			log.Printf("outlier returned to pool: %s", ps.baseURL)
+			od.recordMetric("Custom/Gateway/Outlier/Returned")
+		}
+	}
+}
+
+// Run calls Release every interval until ctx is done.
+func (od *OutlierDetector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			od.Release()
+		}
+	}
+}
+
+func (od *OutlierDetector) Stats() []OutlierStats {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	stats := make([]OutlierStats, 0, len(od.peers))
+	for key, ps := range od.peers {
+		stats = append(stats, OutlierStats{
+			Instance:          key,
+			ServiceID:         ps.serviceID,
+			BaseURL:           ps.baseURL,
+			Consecutive5xx:    ps.consecutive5xx,
+			ConsecutiveErrors: ps.consecutiveErrors,
+			Ejections:         ps.ejections,
+			Ejected:           ps.ejected,
+			EjectedUntil:      ps.ejectedUntil,
+		})
+	}
+	return stats
+}
+
+func (od *OutlierDetector) stats(s *Service) *peerStats {
+	key := s.InstanceKey()
+	ps, ok := od.peers[key]
+	if !ok {
+		ps = &peerStats{}
+		od.peers[key] = ps
+	}
+	ps.serviceID, ps.baseURL = s.ID, s.BaseURL
+	return ps
+}
+
+func (od *OutlierDetector) eject(pool *ServicePool, s *Service, ps *peerStats, reason string) {
+	if ps.ejected {
+		return
+	}
+	if !od.canEject(pool) {
+		log.Printf("outlier not ejected, max ejection percent reached: %s (%s)", s.BaseURL, reason)
+		return
+	}
+	// forget old ejections once a peer has stayed healthy for a full max period.
+	if !ps.returnedAt.IsZero() && time.Since(ps.returnedAt) > od.MaxEjection {
+		ps.ejections = 0
+	}
+	ps.ejections++
+	d := od.BaseEjection
+	for i := 1; i < ps.ejections && d < od.MaxEjection; i++ {
+		d *= 2
+	}
+	if d > od.MaxEjection {
+		d = od.MaxEjection
+	}
+	ps.ejected = true
+	ps.ejectedUntil = time.Now().Add(d)
+	log.Printf("outlier ejected: %s for %v (%s)", s.BaseURL, d, reason)
+	od.recordMetric("Custom/Gateway/Outlier/Ejected")
+}
+
+// canEject counts the instances currently in the pool only, state of
+// instances that left it doesn't count towards the limit.
+func (od *OutlierDetector) canEject(pool *ServicePool) bool {
+	if pool == nil {
+		return false
+	}
+	total := len(pool.Services)
+	if total <= 1 {
+		return false
+	}
+	ejected := 0
+	for _, s := range pool.Services {
+		if ps, ok := od.peers[s.InstanceKey()]; ok && ps.ejected {
+			ejected++
+		}
+	}
+	if ejected+1 >= total {
+		return false
+	}
+	return (ejected+1)*100 <= total*od.MaxEjectionPercent
+}
+
+func (od *OutlierDetector) recordMetric(name string) {
+	if od.NewRelicApp != nil {
+		od.NewRelicApp.RecordCustomMetric(name, 1)
+	}
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Outlier Detector Tests", func() {
+
+	var pool *ServicePool
+	var od *OutlierDetector
+
+	BeforeEach(func() {
+		pool = &ServicePool{
+			Services: []*Service{
+				{BaseURL: "a", ServiceOnline: true},
+				{BaseURL: "b", ServiceOnline: true},
+				{BaseURL: "c", ServiceOnline: true},
+				{BaseURL: "d", ServiceOnline: true},
+			},
+		}
+		od = NewOutlierDetector(pool)
+		od.Consecutive5xx = 3
+		od.ConsecutiveGatewayErrors = 2
+	})
+
+	It("should eject after consecutive 5xx", func() {
+		peer := pool.Services[0]
+		od.ReportStatus(peer, 500)
+		od.ReportStatus(peer, 502)
+		Expect(pool.Available(peer)).To(BeTrue())
+		od.ReportStatus(peer, 503)
+		Expect(pool.Available(peer)).To(BeFalse())
+		Expect(od.IsEjected(peer)).To(BeTrue())
+		// the instance itself is left untouched.
+		Expect(peer.ServiceOnline).To(BeTrue())
+	})
+
+	It("should skip ejected peers when selecting", func() {
+		od.ConsecutiveGatewayErrors = 1
+		od.ReportError(pool.Services[0], errors.New("connection refused"))
+		for i := 0; i < 8; i++ {
+			Expect(pool.GetNextPeer()).NotTo(BeIdenticalTo(pool.Services[0]))
+		}
+	})
+
+	It("should reset the count on success", func() {
+		peer := pool.Services[0]
+		od.ReportStatus(peer, 500)
+		od.ReportStatus(peer, 500)
+		od.ReportStatus(peer, 200)
+		od.ReportStatus(peer, 500)
+		Expect(pool.Available(peer)).To(BeTrue())
+	})
+
+	It("should eject on connection errors", func() {
+		peer := pool.Services[1]
+		od.ReportError(peer, errors.New("connection refused"))
+		od.ReportError(peer, errors.New("connection refused"))
+		Expect(pool.Available(peer)).To(BeFalse())
+	})
+
+	It("should respect the max ejection percent", func() {
+		for _, peer := range pool.Services {
+			od.ReportError(peer, errors.New("connection refused"))
+			od.ReportError(peer, errors.New("connection refused"))
+		}
+		online := 0
+		for _, peer := range pool.Services {
+			if pool.Available(peer) {
+				online++
+			}
+		}
+		Expect(online).To(Equal(2))
+	})
+
+	It("should release and double the next ejection", func() {
+		od.BaseEjection = time.Millisecond
+		peer := pool.Services[2]
+		od.ReportError(peer, errors.New("boom"))
+		od.ReportError(peer, errors.New("boom"))
+		first := od.Stats()[0].EjectedUntil
+
+		time.Sleep(2 * time.Millisecond)
+		od.Release()
+		Expect(pool.Available(peer)).To(BeTrue())
+
+		od.ReportError(peer, errors.New("boom"))
+		od.ReportError(peer, errors.New("boom"))
+		stats := od.Stats()[0]
+		Expect(stats.Ejections).To(Equal(2))
+		Expect(stats.EjectedUntil.After(first)).To(BeTrue())
+	})
+
+	It("should track instances across replaced pools", func() {
+		current := pool
+		od = NewOutlierDetectorFunc(func() *ServicePool { return current })
+		od.ConsecutiveGatewayErrors = 1
+		od.ReportError(pool.Services[0], errors.New("connection refused"))
+
+		renewed := &Service{BaseURL: "a", ServiceOnline: true}
+		current = &ServicePool{Services: []*Service{renewed, pool.Services[1], pool.Services[2], pool.Services[3]}}
+		Expect(od.IsEjected(renewed)).To(BeTrue())
+
+		od.ReportError(pool.Services[1], errors.New("connection refused"))
+		Expect(od.IsEjected(current.Services[1])).To(BeTrue())
+
+		od.Forget(renewed)
+		Expect(od.IsEjected(renewed)).To(BeFalse())
+		Expect(od.Stats()).To(HaveLen(1))
+	})
+})
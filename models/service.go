@@ -2,7 +2,7 @@ package models
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,10 +15,15 @@ import (
 	"time"
 
 	"github.com/go-chi/render"
-	"github.com/sailsforce/gomicro-kit/utils"
+	"github.com/sailsforce/gomicro-kit/httpclient"
 	"gorm.io/datatypes"
 )
 
+const (
+	ProtocolGrpc  = "grpc"
+	ProtocolGrpcs = "grpcs"
+)
+
 type Service struct {
 	ID              int            `json:"id"`
 	CreatedAt       time.Time      `json:"created_at"`
@@ -31,6 +36,11 @@ type Service struct {
 	ServiceVersion  string         `json:"service_version"`
 	BaseURL         string         `json:"base_url"`
 	Routes          datatypes.JSON `json:"routes"`
+	LastSeen        time.Time      `json:"last_seen"`
+	Drained         bool           `json:"drained"`
+	// refused by the gateway until enabled, see gateway.Admin.
+	Disabled bool           `json:"disabled,omitempty"`
+	OpenAPI  datatypes.JSON `json:"openapi,omitempty"`
 }
 
 // Only used for documentation. Not used for database
@@ -42,18 +52,55 @@ type NewService struct {
 	ServiceVersion  string                 `json:"service_version"`
 	BaseURL         string                 `json:"base_url"`
 	Routes          map[string]interface{} `json:"routes"`
+	OpenAPI         map[string]interface{} `json:"openapi,omitempty"`
 }
 
 type ServicePool struct {
 	Services []*Service
 	Current  uint64
+	// optional, used by GetPeerForRequest to split traffic between versions.
+	Policy *TrafficPolicy
+	// optional, set by NewOutlierDetector.
+	Outliers *OutlierDetector
+	// optional, used by HealthCheck to probe https services.
+	TLSConfig *tls.Config
+}
+
+func (s *Service) IsGrpc() bool {
+	return s.ServiceProtocol == ProtocolGrpc || s.ServiceProtocol == ProtocolGrpcs
+}
+
+// InstanceKey identifies an instance across registrations, which replace
+// the *Service but keep its base url and version.
+func (s *Service) InstanceKey() string {
+	return s.ServiceVersion + "@" + s.BaseURL
+}
+
+func (s *Service) IsDeleted() bool {
+	return !s.DeletedAt.IsZero()
 }
 
 func (s *Service) Print() {
 	log.Printf("\nName: %v\nBaseURL: %v\nRoutes: %+v", s.ServiceName, s.BaseURL, s.Routes)
 }
 
+// RegisterAtGateway signs the registration with the latest key from
+// HMAC_SECRETS.
 func (s *Service) RegisterAtGateway(gatewayUrl string) error {
+	var keyList HmacKeys
+	err := render.DecodeJSON(bytes.NewReader([]byte(os.Getenv("HMAC_SECRETS"))), &keyList)
+	if err != nil {
+		return err
+	}
+	opts := httpclient.DefaultOptions()
+	opts.Sign = keyList.SigningKey
+	opts.ClientID = keyList.Name
+	return s.RegisterAtGatewayWithClient(httpclient.New(opts), gatewayUrl)
+}
+
+// RegisterAtGatewayWithClient registers with c, which is expected to sign
+// the request, see httpclient.Options.Sign.
+func (s *Service) RegisterAtGatewayWithClient(c *http.Client, gatewayUrl string) error {
 	body, err := json.Marshal(s)
 	if err != nil {
 		return err
@@ -63,23 +110,15 @@ func (s *Service) RegisterAtGateway(gatewayUrl string) error {
 		return err
 	}
 
-	// add hmac header for validation
-	var keyList HmacKeys
-	err = render.DecodeJSON(bytes.NewReader([]byte(os.Getenv("HMAC_SECRETS"))), &keyList)
+	// registering an instance again renews it, so retries are safe. A
+	// disabled instance is refused with a 403 and not retried.
+	resp, err := c.Do(httpclient.Idempotent(req))
 	if err != nil {
-		return err
+		return fmt.Errorf("error registering service. err: %v", err)
 	}
-	key := keyList.GetLatestKey()
-
-	hmacByte := utils.CreateHmacHash(req, key)
-	hmac64 := base64.StdEncoding.EncodeToString(hmacByte)
-	// add to request headers
-	req.Header.Add("X-HMAC-HASH", hmac64)
-
-	c := http.DefaultClient
-	resp, err := c.Do(req)
-	if err != nil || resp.StatusCode != 200 {
-		return fmt.Errorf("error registering service. Status: %v | err: %v", resp.StatusCode, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("error registering service. Status: %v", resp.StatusCode)
 	}
 
 	return nil
@@ -109,57 +148,175 @@ func (sp *ServicePool) MarkServiceStatus(serviceID int, alive bool) {
 	}
 }
 
+// Available reports whether s can take traffic: online and not ejected by
+// the pool's outlier detector. Ejections are kept by the detector rather than
+// written to the shared instance.
+func (sp *ServicePool) Available(s *Service) bool {
+	return s.ServiceOnline && (sp.Outliers == nil || !sp.Outliers.IsEjected(s))
+}
+
 func (sp *ServicePool) GetNextPeer() *Service {
+	return sp.nextPeer(func(s *Service) bool { return true })
+}
+
+func (sp *ServicePool) GetNextPeerForVersion(version string) *Service {
+	return sp.nextPeer(func(s *Service) bool { return s.ServiceVersion == version })
+}
+
+// nextPeer rotates through the pool and returns the next available instance
+// that matches.
+func (sp *ServicePool) nextPeer(match func(s *Service) bool) *Service {
+	if len(sp.Services) == 0 {
+		return nil
+	}
 	next := sp.nextIndex()
 	l := len(sp.Services) + next
 	for i := next; i < l; i++ {
 		idx := i % len(sp.Services)
-		if sp.Services[idx].ServiceOnline {
+		s := sp.Services[idx]
+		if match(s) && sp.Available(s) {
 			if i != next {
 				atomic.StoreUint64(&sp.Current, uint64(idx))
 			}
-			return sp.Services[idx]
+			return s
 		}
 	}
 	return nil
 }
 
-func (sp *ServicePool) HealthCheck() {
-	for _, s := range sp.Services {
-		status := "up"
-		alive, err := isServiceAlive(s)
-		if err != nil {
-			log.Printf("error: %v", err)
+// GetPeerForRequest selects a peer using the pool's TrafficPolicy. A version
+// pinned by header or cookie wins over the weights. If the selected version
+// has no available peer it falls back to the other versions with a weight
+// above zero, a version weighted out never takes traffic. A fallback peer
+// isn't pinned, so the client goes back to its version once it recovers. It
+// returns nil when no weighted version has an available peer.
+func (sp *ServicePool) GetPeerForRequest(rw http.ResponseWriter, r *http.Request) *Service {
+	if sp.Policy == nil {
+		return sp.GetNextPeer()
+	}
+
+	var peer *Service
+	if version := sp.Policy.PinnedVersion(r); version != "" {
+		peer = sp.GetNextPeerForVersion(version)
+	}
+	if peer == nil {
+		if version := sp.Policy.WeightedVersion(); version != "" {
+			peer = sp.GetNextPeerForVersion(version)
 		}
-		s.ServiceOnline = alive
-		if !alive {
-			status = "down"
+	}
+	if peer == nil {
+		weights := sp.Policy.Weights()
+		return sp.nextPeer(func(s *Service) bool { return weights[s.ServiceVersion] > 0 })
+	}
+
+	if sp.Policy.Sticky && rw != nil {
+		sp.Policy.Pin(rw, peer.ServiceVersion)
+	}
+	return peer
+}
+
+func (sp *ServicePool) Versions() []string {
+	seen := make(map[string]bool)
+	var versions []string
+	for _, s := range sp.Services {
+		if !seen[s.ServiceVersion] {
+			seen[s.ServiceVersion] = true
+			versions = append(versions, s.ServiceVersion)
 		}
-		log.Printf("%s [%s]\n", s.BaseURL, status)
 	}
+	return versions
+}
+
+func (sp *ServicePool) HealthCheck() {
+	for _, s := range sp.Services {
+		sp.CheckService(s)
+	}
+}
+
+// CheckService probes a single instance and updates its status. Drained and
+// ejected instances are left offline.
+func (sp *ServicePool) CheckService(s *Service) bool {
+	if s.Drained {
+		s.ServiceOnline = false
+		log.Printf("%s [drained]\n", s.BaseURL)
+		return false
+	}
+	if sp.Outliers != nil && sp.Outliers.IsEjected(s) {
+		log.Printf("%s [ejected]\n", s.BaseURL)
+		return false
+	}
+	status := "up"
+	alive, err := isServiceAlive(s, sp.TLSConfig)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	// LastSeen is left to registrations, a reachable instance that stopped
+	// renewing still expires.
+	s.ServiceOnline = alive
+	if !alive {
+		status = "down"
+	}
+	log.Printf("%s [%s]\n", s.BaseURL, status)
+	return alive
 }
 
-func isServiceAlive(s *Service) (bool, error) {
+func (s *Service) HealthURL() (*url.URL, error) {
 	var serviceRoutes map[string]string
 	err := json.Unmarshal(s.Routes, &serviceRoutes)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 	heatlhRoute, ok := serviceRoutes["health"]
 	if !ok {
-		return false, errors.New("no health route")
+		return nil, errors.New("no health route")
 	}
-	serviceURL, err := url.Parse(fmt.Sprintf("%s://%s/%s%s", s.ServiceProtocol, s.BaseURL, s.ServiceVersion, heatlhRoute))
+	return url.Parse(fmt.Sprintf("%s://%s/%s%s", s.ServiceProtocol, s.BaseURL, s.ServiceVersion, heatlhRoute))
+}
+
+func isServiceAlive(s *Service, tlsConfig *tls.Config) (bool, error) {
+	if s.IsGrpc() {
+		return isGrpcServiceAlive(s, tlsConfig)
+	}
+	serviceURL, err := s.HealthURL()
 	if err != nil {
 		return false, err
 	}
 
+	host := serviceURL.Host
+	if serviceURL.Port() == "" {
+		port := "80"
+		if serviceURL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(serviceURL.Hostname(), port)
+	}
+
 	timeout := 5 * time.Second
-	log.Printf("dial: %v", serviceURL.Host)
-	conn, err := net.DialTimeout("tcp", serviceURL.Host+":80", timeout)
+	dialer := &net.Dialer{Timeout: timeout}
+	log.Printf("dial: %v", host)
+	var conn net.Conn
+	if serviceURL.Scheme == "https" {
+		cfg := &tls.Config{}
+		if tlsConfig != nil {
+			cfg = tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = serviceURL.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, cfg)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
 	if err != nil {
 		return false, nil
 	}
 	_ = conn.Close()
 	return true, nil
 }
+
+// ServiceRegistrySnapshot is the full registry as served by the gateway to
+// discovery clients. Version changes whenever the registry does.
+type ServiceRegistrySnapshot struct {
+	Version  uint64    `json:"version"`
+	Services []Service `json:"services"`
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultVersionHeader = "X-SERVICE-VERSION"
+	DefaultVersionCookie = "service_version"
+)
+
+// TrafficPolicy splits requests across the versions of a single service.
+// A version can be requested explicitly with VersionHeader or VersionCookie,
+// otherwise one is picked by weight. Weights can be changed at runtime.
+type TrafficPolicy struct {
+	VersionHeader string
+	VersionCookie string
+	// Sticky writes the selected version back to VersionCookie so the
+	// client keeps hitting the same version on later requests.
+	Sticky bool
+	// CookieMaxAge is used for the pin cookie when Sticky is set.
+	CookieMaxAge time.Duration
+
+	mu      sync.RWMutex
+	weights map[string]int
+	total   int
+	rnd     *rand.Rand
+}
+
+func NewTrafficPolicy(weights map[string]int) (*TrafficPolicy, error) {
+	tp := &TrafficPolicy{
+		VersionHeader: DefaultVersionHeader,
+		VersionCookie: DefaultVersionCookie,
+		CookieMaxAge:  24 * time.Hour,
+		rnd:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if err := tp.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+func (tp *TrafficPolicy) SetWeights(weights map[string]int) error {
+	total := 0
+	copied := make(map[string]int, len(weights))
+	for version, w := range weights {
+		if w < 0 {
+			return errors.New("traffic weight must not be negative")
+		}
+		total += w
+		copied[version] = w
+	}
+	if total == 0 {
+		return errors.New("traffic weights must add up to more than zero")
+	}
+
+	tp.mu.Lock()
+	tp.weights = copied
+	tp.total = total
+	tp.mu.Unlock()
+	return nil
+}
+
+// ShiftWeight moves amount of weight from one version to another, i.e. to
+// step a canary from 10 to 20 percent.
+func (tp *TrafficPolicy) ShiftWeight(from, to string, amount int) error {
+	weights := tp.Weights()
+	if weights[from] < amount {
+		return errors.New("not enough weight to shift")
+	}
+	weights[from] -= amount
+	weights[to] += amount
+	return tp.SetWeights(weights)
+}
+
+func (tp *TrafficPolicy) Weights() map[string]int {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	weights := make(map[string]int, len(tp.weights))
+	for k, v := range tp.weights {
+		weights[k] = v
+	}
+	return weights
+}
+
+// PinnedVersion returns the version requested by header or cookie, if any.
+func (tp *TrafficPolicy) PinnedVersion(r *http.Request) string {
+	if tp.VersionHeader != "" {
+		if v := r.Header.Get(tp.VersionHeader); v != "" {
+			return v
+		}
+	}
+	if tp.VersionCookie != "" {
+		if c, err := r.Cookie(tp.VersionCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// WeightedVersion picks a version at random according to the weights.
+func (tp *TrafficPolicy) WeightedVersion() string {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.total == 0 {
+		return ""
+	}
+	if tp.rnd == nil {
+		tp.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	n := tp.rnd.Intn(tp.total)
+	for version, w := range tp.weights {
+		if n < w {
+			return version
+		}
+		n -= w
+	}
+	return ""
+}
+
+func (tp *TrafficPolicy) Pin(rw http.ResponseWriter, version string) {
+	if tp.VersionCookie == "" {
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{
+		Name:     tp.VersionCookie,
+		Value:    version,
+		Path:     "/",
+		MaxAge:   int(tp.CookieMaxAge.Seconds()),
+		HttpOnly: true,
+	})
+}
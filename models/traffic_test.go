@@ -0,0 +1,110 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Traffic Policy Tests", func() {
+
+	var pool ServicePool
+
+	BeforeEach(func() {
+		pool = ServicePool{
+			Services: []*Service{
+				{ID: 1, ServiceVersion: "v1", ServiceOnline: true},
+				{ID: 2, ServiceVersion: "v1", ServiceOnline: true},
+				{ID: 3, ServiceVersion: "v2", ServiceOnline: true},
+			},
+		}
+	})
+
+	Describe("NewTrafficPolicy", func() {
+		It("should reject negative weights", func() {
+			_, err := NewTrafficPolicy(map[string]int{"v1": -1, "v2": 10})
+			Expect(err).ToNot(BeNil())
+		})
+		It("should reject zero total weight", func() {
+			_, err := NewTrafficPolicy(map[string]int{"v1": 0})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Describe("ShiftWeight", func() {
+		It("should move weight between versions", func() {
+			tp, err := NewTrafficPolicy(map[string]int{"v1": 90, "v2": 10})
+			Expect(err).To(BeNil())
+			Expect(tp.ShiftWeight("v1", "v2", 40)).To(BeNil())
+			Expect(tp.Weights()).To(Equal(map[string]int{"v1": 50, "v2": 50}))
+		})
+		It("should error when shifting more than available", func() {
+			tp, _ := NewTrafficPolicy(map[string]int{"v1": 90, "v2": 10})
+			Expect(tp.ShiftWeight("v2", "v1", 20)).ToNot(BeNil())
+		})
+	})
+
+	Describe("GetPeerForRequest", func() {
+		It("should only pick weighted versions", func() {
+			pool.Policy, _ = NewTrafficPolicy(map[string]int{"v2": 1})
+			r := httptest.NewRequest("GET", "/", nil)
+			for i := 0; i < 10; i++ {
+				Expect(pool.GetPeerForRequest(nil, r).ServiceVersion).To(Equal("v2"))
+			}
+		})
+		It("should honor the version header", func() {
+			pool.Policy, _ = NewTrafficPolicy(map[string]int{"v1": 1})
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(DefaultVersionHeader, "v2")
+			Expect(pool.GetPeerForRequest(nil, r).ServiceVersion).To(Equal("v2"))
+		})
+		It("should pin the client with a cookie when sticky", func() {
+			pool.Policy, _ = NewTrafficPolicy(map[string]int{"v2": 1})
+			pool.Policy.Sticky = true
+			rw := httptest.NewRecorder()
+			pool.GetPeerForRequest(rw, httptest.NewRequest("GET", "/", nil))
+			cookies := rw.Result().Cookies()
+			Expect(cookies).To(HaveLen(1))
+			Expect(cookies[0].Name).To(Equal(DefaultVersionCookie))
+			Expect(cookies[0].Value).To(Equal("v2"))
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: DefaultVersionCookie, Value: "v1"})
+			Expect(pool.GetPeerForRequest(nil, r).ServiceVersion).To(Equal("v1"))
+		})
+		It("should rotate between the instances of a pinned version", func() {
+			pool.Services = append([]*Service{{ID: 4, ServiceVersion: "v2", ServiceOnline: true}}, pool.Services...)
+			seen := make(map[int]int)
+			for i := 0; i < 10; i++ {
+				seen[pool.GetNextPeerForVersion("v2").ID]++
+			}
+			Expect(seen).To(Equal(map[int]int{3: 5, 4: 5}))
+		})
+		It("should fall back to another weighted version when the version is offline", func() {
+			pool.Policy, _ = NewTrafficPolicy(map[string]int{"v1": 1, "v2": 1000000})
+			pool.MarkServiceStatus(3, false)
+			peer := pool.GetPeerForRequest(nil, httptest.NewRequest("GET", "/", nil))
+			Expect(peer).ToNot(BeNil())
+			Expect(peer.ServiceVersion).To(Equal("v1"))
+		})
+		It("should not fall back to a version without weight", func() {
+			pool.Policy, _ = NewTrafficPolicy(map[string]int{"v1": 0, "v2": 1})
+			pool.MarkServiceStatus(3, false)
+			Expect(pool.GetPeerForRequest(nil, httptest.NewRequest("GET", "/", nil))).To(BeNil())
+
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(DefaultVersionHeader, "v1")
+			Expect(pool.GetPeerForRequest(nil, r).ServiceVersion).To(Equal("v1"))
+		})
+		It("should not pin the client to a fallback version", func() {
+			pool.Policy, _ = NewTrafficPolicy(map[string]int{"v1": 1, "v2": 1000000})
+			pool.Policy.Sticky = true
+			pool.MarkServiceStatus(3, false)
+			rw := httptest.NewRecorder()
+			Expect(pool.GetPeerForRequest(rw, httptest.NewRequest("GET", "/", nil)).ServiceVersion).To(Equal("v1"))
+			Expect(rw.Result().Cookies()).To(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultHmacMaxBodyBytes = 10 << 20
+
+var ErrBodyTooLarge = errors.New("request body too large to sign")
+
+// BodyCanonicalizer rewrites a body before it is digested, so equivalent
+// encodings of the same content sign the same.
+type BodyCanonicalizer func(body []byte) ([]byte, error)
+
+var (
+	canonicalizersMu sync.RWMutex
+	canonicalizers   = map[string]BodyCanonicalizer{}
+	builtin          = map[string]BodyCanonicalizer{
+		"application/json": CanonicalJSON,
+	}
+)
+
+// RegisterBodyCanonicalizer canonicalizes bodies of mediaType before they are
+// digested. Bodies are signed as raw bytes unless a canonicalizer is
+// registered here or listed in HMAC_CANONICAL_TYPES; signers and validators
+// must agree on it.
+func RegisterBodyCanonicalizer(mediaType string, c BodyCanonicalizer) {
+	canonicalizersMu.Lock()
+	defer canonicalizersMu.Unlock()
+	canonicalizers[strings.ToLower(mediaType)] = c
+}
+
+// CanonicalJSON re-encodes a JSON document with sorted keys and no
+// insignificant whitespace. Numbers are kept as written. Anything after the
+// document is an error, it would otherwise go unsigned.
+func CanonicalJSON(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error canonicalizing json: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("error canonicalizing json: trailing data after document")
+	}
+	return json.Marshal(v)
+}
+
+// HmacMaxBodyBytes reads HMAC_MAX_BODY_BYTES, defaulting to
+// DefaultHmacMaxBodyBytes.
+func HmacMaxBodyBytes() int64 {
+	max, err := strconv.ParseInt(os.Getenv("HMAC_MAX_BODY_BYTES"), 10, 64)
+	if err != nil || max <= 0 {
+		return DefaultHmacMaxBodyBytes
+	}
+	return max
+}
+
+// BodyDigest returns the hex sha256 of the exact body bytes, read at most
+// maxBytes at a time. Requests with GetBody, i.e. outbound ones, are hashed
+// from a fresh copy without buffering. Otherwise the body is buffered while
+// hashed and r.Body restored, untouched even if ErrBodyTooLarge is returned.
+func BodyDigest(r *http.Request, maxBytes int64) (string, error) {
+	h := sha256.New()
+	if r.Body == nil || r.Body == http.NoBody {
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	canonicalize := canonicalizerFor(r.Header.Get("Content-Type"))
+	if canonicalize == nil && r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return "", fmt.Errorf("error reading request body: %v", err)
+		}
+		defer body.Close()
+		if err := copyLimited(h, body, maxBytes); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	if canonicalize == nil {
+		w = io.MultiWriter(h, &buf)
+	}
+	err := copyLimited(w, r.Body, maxBytes)
+	// restore the io.ReadCloser, with whatever wasn't read yet.
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf.Bytes()), r.Body), r.Body}
+	if err != nil {
+		return "", err
+	}
+	if canonicalize != nil {
+		return canonicalDigest(h, canonicalize, buf.Bytes())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readBody buffers at most maxBytes of the body and restores r.Body, even if
+// ErrBodyTooLarge is returned.
+func readBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	err := copyLimited(&buf, r.Body, maxBytes)
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf.Bytes()), r.Body), r.Body}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func canonicalDigest(h hash.Hash, canonicalize BodyCanonicalizer, body []byte) (string, error) {
+	canonical, err := canonicalize(body)
+	if err != nil {
+		return "", err
+	}
+	h.Write(canonical)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyLimited(w io.Writer, r io.Reader, maxBytes int64) error {
+	n, err := io.Copy(w, io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return fmt.Errorf("error reading request body: %v", err)
+	}
+	if n > maxBytes {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
+func canonicalizerFor(contentType string) BodyCanonicalizer {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	canonicalizersMu.RLock()
+	c, ok := canonicalizers[mediaType]
+	canonicalizersMu.RUnlock()
+	if ok {
+		return c
+	}
+	for _, t := range strings.Split(os.Getenv("HMAC_CANONICAL_TYPES"), ",") {
+		if strings.ToLower(strings.TrimSpace(t)) == mediaType {
+			return builtin[mediaType]
+		}
+	}
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -1,51 +1,308 @@
 package utils
 
 import (
-	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-func CreateHmacHash(r *http.Request, secret string) []byte {
-	headerList := strings.Split(os.Getenv("HMAC_HEADERS"), ",")
+const (
+	HmacHeader          = "X-HMAC-HASH"
+	HmacVersionHeader   = "X-HMAC-VERSION"
+	HmacTimestampHeader = "X-HMAC-TIMESTAMP"
+	HmacNonceHeader     = "X-HMAC-NONCE"
+	HmacKeyIDHeader     = "X-HMAC-KEY-ID"
+	HmacClientIDHeader  = "X-HMAC-CLIENT-ID"
+
+	HmacV1 = "1"
+	HmacV2 = "2"
+
+	DefaultHmacClockSkew = 5 * time.Minute
+)
+
+var ErrHmacTimestamp = errors.New("hmac timestamp outside of the allowed clock skew")
+
+// HmacHeaderNames are the headers the signature travels in.
+type HmacHeaderNames struct {
+	Hash      string
+	Version   string
+	Timestamp string
+	Nonce     string
+	KeyID     string
+	ClientID  string
+	Response  string
+}
+
+func DefaultHmacHeaderNames() HmacHeaderNames {
+	return HmacHeaderNames{
+		Hash:      HmacHeader,
+		Version:   HmacVersionHeader,
+		Timestamp: HmacTimestampHeader,
+		Nonce:     HmacNonceHeader,
+		KeyID:     HmacKeyIDHeader,
+		ClientID:  HmacClientIDHeader,
+		Response:  HmacResponseHeader,
+	}
+}
+
+// WithDefaults fills the empty names with the default ones.
+func (n HmacHeaderNames) WithDefaults() HmacHeaderNames {
+	d := DefaultHmacHeaderNames()
+	for _, f := range []struct {
+		v   *string
+		def string
+	}{
+		{&n.Hash, d.Hash}, {&n.Version, d.Version}, {&n.Timestamp, d.Timestamp},
+		{&n.Nonce, d.Nonce}, {&n.KeyID, d.KeyID}, {&n.ClientID, d.ClientID}, {&n.Response, d.Response},
+	} {
+		if *f.v == "" {
+			*f.v = f.def
+		}
+	}
+	return n
+}
+
+// Rename moves the headers set by SignRequest to the configured names.
+func (n HmacHeaderNames) Rename(h http.Header) {
+	defaults := DefaultHmacHeaderNames()
+	pairs := [][2]string{
+		{defaults.Hash, n.Hash},
+		{defaults.Version, n.Version},
+		{defaults.Timestamp, n.Timestamp},
+		{defaults.Nonce, n.Nonce},
+		{defaults.KeyID, n.KeyID},
+		{defaults.ClientID, n.ClientID},
+	}
+	for _, p := range pairs {
+		if v := h.Get(p[0]); v != "" && !strings.EqualFold(p[0], p[1]) {
+			h.Del(p[0])
+			h.Set(p[1], v)
+		}
+	}
+}
+
+// HmacV1Message is the legacy v1 signed message: the values of the
+// HMAC_HEADERS, the body re-encoded as a JSON object and the raw query,
+// concatenated. It is kept as is for callers not migrated yet, but only
+// signs JSON object bodies faithfully, prefer v2. Bodies over
+// HmacMaxBodyBytes return ErrBodyTooLarge.
+func HmacV1Message(r *http.Request) (string, error) {
 	var hmacMessage string
 
 	// add headers from header list
-	for _, v := range headerList {
-		h := r.Header.Get(v)
-		if os.Getenv("LOG_LEVEL") == "debug" {
-			log.Printf("%v | %v", v, h)
-		}
-		hmacMessage = fmt.Sprintf("%v%v", hmacMessage, h)
+	for _, v := range strings.Split(os.Getenv("HMAC_HEADERS"), ",") {
+		hmacMessage = fmt.Sprintf("%v%v", hmacMessage, r.Header.Get(v))
 	}
 
 	// add request body
-	bodyBytes, _ := io.ReadAll(r.Body)
-	// Restore the io.ReadCloser to its original state
-	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-	// Use the content
+	bodyBytes, err := readBody(r, HmacMaxBodyBytes())
+	if err != nil {
+		return "", err
+	}
 	data := make(map[string]interface{})
 	json.Unmarshal(bodyBytes, &data)
 	marshalReqBody, _ := json.Marshal(data)
-
 	hmacMessage = fmt.Sprintf("%v%v", hmacMessage, string(marshalReqBody))
 
 	// add request url parameters
-	hmacMessage = fmt.Sprintf("%v%v", hmacMessage, r.URL.RawQuery)
+	return fmt.Sprintf("%v%v", hmacMessage, r.URL.RawQuery), nil
+}
+
+// CreateHmacHash is the v1 signature of r, nil if its body can't be read
+// within HmacMaxBodyBytes.
+func CreateHmacHash(r *http.Request, secret string) []byte {
+	msg, err := HmacV1Message(r)
+	if err != nil {
+		log.Printf("error creating v1 hmac hash: %v", err)
+		return nil
+	}
+	return HmacSum(msg, secret)
+}
+
+// CanonicalRequest is the v2 signed message, one field per line: version,
+// method, path, sorted query, the HMAC_HEADERS as "name:value", the signed
+// header names, the BodyDigest, timestamp and nonce.
+func CanonicalRequest(r *http.Request, timestamp, nonce string) (string, error) {
+	bodyHash, err := BodyDigest(r, HmacMaxBodyBytes())
+	if err != nil {
+		return "", err
+	}
+
+	headers := signedHeaders()
+	var headerLines []string
+	for _, h := range headers {
+		headerLines = append(headerLines, h+":"+strings.TrimSpace(r.Header.Get(h)))
+	}
+
+	lines := []string{
+		"v" + HmacV2,
+		strings.ToUpper(r.Method),
+		canonicalPath(r),
+		canonicalQuery(r),
+		strings.Join(headerLines, "\n"),
+		strings.Join(headers, ";"),
+		bodyHash,
+		timestamp,
+		nonce,
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func CreateHmacHashV2(r *http.Request, secret, timestamp, nonce string) ([]byte, error) {
+	msg, err := CanonicalRequest(r, timestamp, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return HmacSum(msg, secret), nil
+}
 
+// HmacSum is the hmac sha256 of a canonical request.
+func HmacSum(msg, secret string) []byte {
 	if os.Getenv("LOG_LEVEL") == "debug" {
-		log.Printf("hmac_message: %v | %v", hmacMessage, secret)
+		log.Printf("hmac_message: %q", msg)
 	}
 	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(hmacMessage))
-	hash := mac.Sum(nil)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// SignRequest adds the hmac headers to r. It signs v2 with a fresh timestamp
+// and nonce, unless HMAC_SIGN_VERSION is "1" for receivers not migrated yet.
+func SignRequest(r *http.Request, secret string) error {
+	if os.Getenv("HMAC_SIGN_VERSION") == HmacV1 {
+		msg, err := HmacV1Message(r)
+		if err != nil {
+			return err
+		}
+		r.Header.Set(HmacHeader, base64.StdEncoding.EncodeToString(HmacSum(msg, secret)))
+		return nil
+	}
+
+	nonce, err := NewNonce()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(HmacVersionHeader, HmacV2)
+	r.Header.Set(HmacTimestampHeader, timestamp)
+	r.Header.Set(HmacNonceHeader, nonce)
+
+	hash, err := CreateHmacHashV2(r, secret, timestamp, nonce)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(HmacHeader, base64.StdEncoding.EncodeToString(hash))
+	return nil
+}
+
+// SignRequestWithKeyID is SignRequest also sending the id of the key, so
+// validators can look it up instead of trying every key.
+func SignRequestWithKeyID(r *http.Request, keyID, secret string) error {
+	if keyID != "" {
+		r.Header.Set(HmacKeyIDHeader, keyID)
+	}
+	return SignRequest(r, secret)
+}
+
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error creating nonce: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CheckHmacTimestamp returns ErrHmacTimestamp if the unix timestamp is
+// further than skew from now, in either direction.
+func CheckHmacTimestamp(timestamp string, skew time.Duration) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid hmac timestamp: %v", err)
+	}
+	diff := time.Since(time.Unix(sec, 0))
+	if diff > skew || diff < -skew {
+		return ErrHmacTimestamp
+	}
+	return nil
+}
+
+// HmacClockSkew reads HMAC_CLOCK_SKEW (e.g. "5m"), defaulting to
+// DefaultHmacClockSkew.
+func HmacClockSkew() time.Duration {
+	skew, err := time.ParseDuration(os.Getenv("HMAC_CLOCK_SKEW"))
+	if err != nil || skew <= 0 {
+		return DefaultHmacClockSkew
+	}
+	return skew
+}
+
+// HmacAcceptV1 reports whether v1 signatures are accepted. They carry no
+// timestamp or nonce and can be replayed, so they are rejected unless
+// HMAC_ACCEPT_V1=true is set while callers migrate to v2.
+func HmacAcceptV1() bool {
+	accept, _ := strconv.ParseBool(os.Getenv("HMAC_ACCEPT_V1"))
+	return accept
+}
+
+// HmacKeyCompat reports whether signatures without a key id are checked
+// against every valid key. Set HMAC_KEY_COMPAT=false once every caller
+// sends X-HMAC-KEY-ID.
+func HmacKeyCompat() bool {
+	compat, err := strconv.ParseBool(os.Getenv("HMAC_KEY_COMPAT"))
+	return err != nil || compat
+}
+
+func signedHeaders() []string {
+	var headers []string
+	for _, h := range strings.Split(os.Getenv("HMAC_HEADERS"), ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			headers = append(headers, h)
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+func canonicalPath(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func canonicalQuery(r *http.Request) string {
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, queryEscape(k)+"="+queryEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
 
-	return hash
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
 }
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HmacResponseHeader carries the response signature, as a header or, for
+// streamed responses, a trailer.
+const HmacResponseHeader = "X-HMAC-RESPONSE"
+
+// ResponseHeaders are the response headers signed, from
+// HMAC_RESPONSE_HEADERS, defaulting to Content-Type.
+func ResponseHeaders() []string {
+	raw := os.Getenv("HMAC_RESPONSE_HEADERS")
+	if raw == "" {
+		raw = "Content-Type"
+	}
+	var headers []string
+	for _, h := range strings.Split(raw, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" {
+			headers = append(headers, h)
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+// CanonicalResponse is the signed message of a response, one field per line:
+// status, the request's method and nonce, the ResponseHeaders as
+// "name:value", the signed header names, the body digest and timestamp. The
+// nonce binds the response to its request; the path is left out as proxies
+// rewrite it.
+func CanonicalResponse(status int, header http.Header, method, nonce, bodyDigest, timestamp string) string {
+	headers := ResponseHeaders()
+	var headerLines []string
+	for _, h := range headers {
+		headerLines = append(headerLines, h+":"+strings.TrimSpace(header.Get(h)))
+	}
+	return strings.Join([]string{
+		"v2-response",
+		strconv.Itoa(status),
+		strings.ToUpper(method),
+		nonce,
+		strings.Join(headerLines, "\n"),
+		strings.Join(headers, ";"),
+		bodyDigest,
+		timestamp,
+	}, "\n")
+}